@@ -5,22 +5,29 @@ import (
 	"errors"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/araminian/gozero/internal/admin"
+	"github.com/araminian/gozero/internal/coldstart"
 	"github.com/araminian/gozero/internal/config"
 	"github.com/araminian/gozero/internal/metric"
 	"github.com/araminian/gozero/internal/proxy"
+	"github.com/araminian/gozero/internal/route"
 	"github.com/araminian/gozero/internal/store"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
 type Storer interface {
+	metric.Storer
+	store.BatchStorer
 	Close() error
 	GetAllScaleUpKeys() ([]string, error)
-	ScaleUp(host string, scaleThreshold int, scaleDuration time.Duration) error
+	ResetTimer(host string, scaleDuration time.Duration) error
+	RecordInFlight(replica string, counts map[string]int, ttl time.Duration) error
 }
 
 type MetricServer interface {
@@ -28,23 +35,43 @@ type MetricServer interface {
 	Shutdown(ctx context.Context) error
 }
 
+// Notifier is implemented by metric servers which want to know about requests as soon as they are seen
+type Notifier interface {
+	Notify(host string)
+}
+
 type Server struct {
-	proxy  proxy.Proxier
-	store  Storer
-	metric MetricServer
-	done   chan struct{}
+	proxy      proxy.Proxier
+	store      Storer
+	batcher    *store.Batcher
+	metrics    []MetricServer
+	admin      *admin.Server
+	coldStarts *coldstart.Tracker
+	// replica identifies this GoZero replica in the store
+	replica string
+	done    chan struct{}
 }
 
 const (
 	defaultProxyPort       = 8443
 	defaultMetricPort      = 9090
 	defaultMetricPath      = "/metrics"
+	defaultScalerPort      = 9091
 	defaultBuffer          = 1000
 	defaultRedisPort       = 6379
 	defaultRedisAddr       = "localhost"
 	defaultLogLevel        = "info"
 	defaultScaleUpTarget   = 10
 	defaultScaleUpDuration = 5 * time.Minute
+	defaultRateWindow      = time.Minute
+	defaultStoreBackend    = "redis"
+	defaultFlushInterval   = time.Second
+	defaultDroppedReport   = 10 * time.Second
+	defaultPrometheusPath  = "/prometheus"
+	defaultMaxTargetLabels = 100
+	defaultAdminPort       = 9092
+	defaultColdStartCount  = 10
+	defaultInFlightRefresh = 30 * time.Second
 )
 
 func main() {
@@ -52,10 +79,53 @@ func main() {
 	proxyPort := config.GetEnvOrDefaultInt("PROXY_PORT", defaultProxyPort)
 	metricPort := config.GetEnvOrDefaultInt("METRIC_PORT", defaultMetricPort)
 	metricPath := config.GetEnvOrDefaultString("METRIC_PATH", defaultMetricPath)
+	prometheusPath := config.GetEnvOrDefaultString("PROMETHEUS_PATH", defaultPrometheusPath)
+	maxTargetLabels := config.GetEnvOrDefaultInt("PROMETHEUS_MAX_TARGETS", defaultMaxTargetLabels)
+	scalerPort := config.GetEnvOrDefaultInt("EXTERNAL_SCALER_PORT", defaultScalerPort)
+	adminPort := config.GetEnvOrDefaultInt("ADMIN_PORT", defaultAdminPort)
+	coldStartHistory := config.GetEnvOrDefaultInt("COLD_START_HISTORY", defaultColdStartCount)
 	buffer := config.GetEnvOrDefaultInt("REQUEST_BUFFER", defaultBuffer)
+	queueDepth := config.GetEnvOrDefaultInt("QUEUE_DEPTH", proxy.DefaultQueueDepth)
+	queueMaxWait := config.GetEnvOrDefaultDuration("QUEUE_MAX_WAIT", proxy.DefaultMaxWait)
+	bodyBufferSize := config.GetEnvOrDefaultInt("BODY_BUFFER_SIZE", proxy.DefaultBodyBufferSize)
+	storeBackend := config.GetEnvOrDefaultString("STORE_BACKEND", defaultStoreBackend)
 	redisAddr := config.GetEnvOrDefaultString("REDIS_ADDR", defaultRedisAddr)
 	redisPort := config.GetEnvOrDefaultInt("REDIS_PORT", defaultRedisPort)
+	redisUsername := config.GetEnvOrDefaultString("REDIS_USERNAME", "")
+	redisPassword := config.GetEnvOrDefaultString("REDIS_PASSWORD", "")
+	redisPasswordFile := config.GetEnvOrDefaultString("REDIS_PASSWORD_FILE", "")
+	redisDB := config.GetEnvOrDefaultInt("REDIS_DB", 0)
+	redisTLS := config.GetEnvOrDefaultBool("REDIS_TLS", false)
+	redisTLSCAFile := config.GetEnvOrDefaultString("REDIS_TLS_CA_FILE", "")
+	redisTLSCertFile := config.GetEnvOrDefaultString("REDIS_TLS_CERT_FILE", "")
+	redisTLSKeyFile := config.GetEnvOrDefaultString("REDIS_TLS_KEY_FILE", "")
+	redisSentinelMaster := config.GetEnvOrDefaultString("REDIS_SENTINEL_MASTER", "")
+	redisSentinelAddrs := config.GetEnvOrDefaultStringSlice("REDIS_SENTINEL_ADDRS", nil)
+	redisSentinelPassword := config.GetEnvOrDefaultString("REDIS_SENTINEL_PASSWORD", "")
+	redisClusterAddrs := config.GetEnvOrDefaultStringSlice("REDIS_CLUSTER_ADDRS", nil)
 	logLevel := config.GetEnvOrDefaultString("LOG_LEVEL", defaultLogLevel)
+	rateWindow := config.GetEnvOrDefaultDuration("REQUEST_RATE_WINDOW", defaultRateWindow)
+	flushInterval := config.GetEnvOrDefaultDuration("SCALE_UP_FLUSH_INTERVAL", defaultFlushInterval)
+	routesFile := config.GetEnvOrDefaultString("ROUTES_FILE", "")
+	targetAllowlist := config.GetEnvOrDefaultStringSlice("TARGET_ALLOWLIST", nil)
+	targetDenylist := config.GetEnvOrDefaultStringSlice("TARGET_DENYLIST", nil)
+	targetPorts := config.GetEnvOrDefaultStringSlice("TARGET_ALLOWED_PORTS", nil)
+	waitingPage := config.GetEnvOrDefaultBool("WAITING_PAGE", false)
+	waitingPageTemplate := config.GetEnvOrDefaultString("WAITING_PAGE_TEMPLATE", "")
+	waitingPageRefresh := config.GetEnvOrDefaultDuration("WAITING_PAGE_REFRESH", proxy.DefaultWaitingPageRefresh)
+	inFlightRefresh := config.GetEnvOrDefaultDuration("IN_FLIGHT_REFRESH", defaultInFlightRefresh)
+	tlsCertFiles := config.GetEnvOrDefaultStringSlice("TLS_CERT_FILES", nil)
+	tlsKeyFiles := config.GetEnvOrDefaultStringSlice("TLS_KEY_FILES", nil)
+	tlsReload := config.GetEnvOrDefaultDuration("TLS_RELOAD_INTERVAL", proxy.DefaultTLSReloadInterval)
+	upstreamCAFile := config.GetEnvOrDefaultString("UPSTREAM_TLS_CA_FILE", "")
+	upstreamCertFile := config.GetEnvOrDefaultString("UPSTREAM_TLS_CERT_FILE", "")
+	upstreamKeyFile := config.GetEnvOrDefaultString("UPSTREAM_TLS_KEY_FILE", "")
+	notReadyProfile := config.GetEnvOrDefaultString("NOT_READY_PROFILE", proxy.DefaultNotReadyProfile)
+	breakerFailures := config.GetEnvOrDefaultInt("BREAKER_FAILURES", proxy.DefaultBreakerThreshold)
+	breakerCoolOff := config.GetEnvOrDefaultDuration("BREAKER_COOL_OFF", proxy.DefaultBreakerCoolOff)
+	maxIdleTimeout := config.GetEnvOrDefaultDuration("MAX_IDLE_TIMEOUT", proxy.DefaultMaxIdleTimeout)
+	maxMinActive := config.GetEnvOrDefaultDuration("MAX_MIN_ACTIVE", proxy.DefaultMaxMinActive)
+	maxScaleValue := config.GetEnvOrDefaultInt("MAX_SCALE_VALUE", proxy.DefaultMaxScaleValue)
 
 	logLevelObj, err := zapcore.ParseLevel(logLevel)
 	if err != nil {
@@ -66,41 +136,189 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	httpProxy, err := proxy.NewHTTPReverseProxy(proxy.WithListenPort(proxyPort), proxy.WithBufferSize(buffer))
+	var routes *route.Table
+	if routesFile != "" {
+		routes, err = route.LoadFile(routesFile)
+		if err != nil {
+			panic("failed to load route table: " + err.Error())
+		}
+		config.Log.Info("Loaded route table", zap.String("file", routesFile), zap.Int("routes", len(routes.Routes)))
+	}
+
+	// Bound the target label values of the Prometheus metrics, the routed targets always get their own
+	metric.SetTargetLabelLimit(maxTargetLabels)
+	if routes != nil {
+		for _, r := range routes.Routes {
+			metric.AddConfiguredTargets(r.Target.Host)
+		}
+	}
+
+	var allowedPorts []int
+	for _, port := range targetPorts {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			panic("invalid target port " + port + ": " + err.Error())
+		}
+		allowedPorts = append(allowedPorts, p)
+	}
+
+	coldStarts, err := coldstart.NewTracker(coldstart.WithHistorySize(coldStartHistory), coldstart.WithIdleTimeout(defaultScaleUpDuration))
 	if err != nil {
-		panic("failed to create http proxy: " + err.Error())
+		panic("failed to create cold start tracker: " + err.Error())
 	}
 
-	redisClient, err := store.NewRedisClient(ctx, store.WithRedisHost(redisAddr), store.WithRedisPort(redisPort))
+	proxyConfigs := []proxy.HTTPReverseProxyConfig{
+		proxy.WithColdStartTracker(coldStarts),
+		proxy.WithRouteTable(routes),
+		proxy.WithTargetAllowlist(targetAllowlist...),
+		proxy.WithTargetDenylist(targetDenylist...),
+		proxy.WithTargetPorts(allowedPorts...),
+		proxy.WithListenPort(proxyPort),
+		proxy.WithBufferSize(buffer),
+		proxy.WithQueueDepth(queueDepth),
+		proxy.WithMaxWait(queueMaxWait),
+		proxy.WithBodyBufferSize(int64(bodyBufferSize)),
+		proxy.WithNotReadyProfile(notReadyProfile),
+		proxy.WithBreakerThreshold(breakerFailures),
+		proxy.WithBreakerCoolOff(breakerCoolOff),
+		proxy.WithMaxIdleTimeout(maxIdleTimeout),
+		proxy.WithMaxMinActive(maxMinActive),
+		proxy.WithMaxScaleValue(maxScaleValue),
+	}
+	if waitingPage {
+		proxyConfigs = append(proxyConfigs, proxy.WithWaitingPage(waitingPageTemplate), proxy.WithWaitingPageRefresh(waitingPageRefresh))
+	}
+	if len(tlsCertFiles) != len(tlsKeyFiles) {
+		panic("TLS_CERT_FILES and TLS_KEY_FILES must list the same number of files")
+	}
+	for i := range tlsCertFiles {
+		proxyConfigs = append(proxyConfigs, proxy.WithTLSCertificate(tlsCertFiles[i], tlsKeyFiles[i]))
+	}
+	if upstreamCAFile != "" {
+		proxyConfigs = append(proxyConfigs, proxy.WithUpstreamCA(upstreamCAFile))
+	}
+	if upstreamCertFile != "" || upstreamKeyFile != "" {
+		proxyConfigs = append(proxyConfigs, proxy.WithUpstreamClientCertificate(upstreamCertFile, upstreamKeyFile))
+	}
+	if len(tlsCertFiles) > 0 || upstreamCertFile != "" {
+		proxyConfigs = append(proxyConfigs, proxy.WithTLSReloadInterval(tlsReload))
+	}
+
+	httpProxy, err := proxy.NewHTTPReverseProxy(proxyConfigs...)
 	if err != nil {
-		panic("failed to create redis client: " + err.Error())
+		panic("failed to create http proxy: " + err.Error())
 	}
 
-	metricServer, err := metric.NewFiberMetricExposer(metric.WithFiberMetricExposerPath(metricPath), metric.WithFiberMetricExposerPort(metricPort))
+	var backend Storer
+	switch storeBackend {
+	case "redis":
+		redisConfigs := []store.RedisConfig{
+			store.WithRedisHost(redisAddr),
+			store.WithRedisPort(redisPort),
+			store.WithRequestRateWindow(rateWindow),
+			store.WithRedisUsername(redisUsername),
+			store.WithRedisPassword(redisPassword),
+			store.WithRedisDB(redisDB),
+			store.WithRedisSentinelPassword(redisSentinelPassword),
+		}
+		if redisPasswordFile != "" {
+			redisConfigs = append(redisConfigs, store.WithRedisPasswordFile(redisPasswordFile))
+		}
+		if redisTLS {
+			redisConfigs = append(redisConfigs, store.WithRedisTLS(redisTLSCAFile, redisTLSCertFile, redisTLSKeyFile))
+		}
+		if redisSentinelMaster != "" {
+			redisConfigs = append(redisConfigs, store.WithRedisSentinel(redisSentinelMaster, redisSentinelAddrs...))
+		}
+		if len(redisClusterAddrs) > 0 {
+			redisConfigs = append(redisConfigs, store.WithRedisCluster(redisClusterAddrs...))
+		}
+
+		backend, err = store.NewRedisClient(ctx, redisConfigs...)
+		if err != nil {
+			panic("failed to create redis client: " + err.Error())
+		}
+	case "memory":
+		// The state is not shared, only for a single GoZero replica or local development
+		backend, err = store.NewMemoryStore(ctx, store.WithMemoryRequestRateWindow(rateWindow))
+		if err != nil {
+			panic("failed to create memory store: " + err.Error())
+		}
+	default:
+		panic("unsupported store backend " + storeBackend)
+	}
+	config.Log.Info("Using store", zap.String("backend", storeBackend))
+
+	metricServer, err := metric.NewFiberMetricExposer(
+		metric.WithFiberMetricExposerPath(metricPath),
+		metric.WithFiberMetricExposerPort(metricPort),
+		metric.WithFiberPrometheusPath(prometheusPath),
+	)
 	if err != nil {
 		panic("failed to create metric server: " + err.Error())
 	}
+
+	externalScaler, err := metric.NewGRPCExternalScaler(metric.WithGRPCExternalScalerPort(scalerPort))
+	if err != nil {
+		panic("failed to create external scaler: " + err.Error())
+	}
+
+	replica, err := os.Hostname()
+	if err != nil {
+		panic("failed to get hostname: " + err.Error())
+	}
+
+	adminServer, err := admin.NewServer(coldStarts, admin.WithAdminPort(adminPort), admin.WithHealthSource(httpProxy), admin.WithBreakerSource(httpProxy))
+	if err != nil {
+		panic("failed to create admin server: " + err.Error())
+	}
+
 	server := &Server{
-		proxy:  httpProxy,
-		store:  redisClient,
-		metric: metricServer,
-		done:   make(chan struct{}),
+		proxy:      httpProxy,
+		store:      backend,
+		metrics:    []MetricServer{metricServer, externalScaler},
+		admin:      adminServer,
+		coldStarts: coldStarts,
+		replica:    replica,
+		done:       make(chan struct{}),
+	}
+
+	server.batcher, err = store.NewBatcher(backend,
+		store.WithFlushInterval(flushInterval),
+		store.WithOnFlush(server.scaledUp),
+		store.WithOnActivate(server.activated),
+	)
+	if err != nil {
+		panic("failed to create scale up batcher: " + err.Error())
 	}
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	var wg sync.WaitGroup
-	wg.Add(2)
+	wg.Add(len(server.metrics) + 3)
+
+	// Start metric servers
+	for _, metricServer := range server.metrics {
+		go func() {
+			defer func() {
+				wg.Done()
+				config.Log.Info("Metric server shutdown complete")
+			}()
+			if err := metricServer.Start(ctx, server.store); err != nil && !errors.Is(err, context.Canceled) {
+				config.Log.Error("metric server error", zap.Error(err))
+			}
+		}()
+	}
 
-	// Start metric server
+	// Start admin server
 	go func() {
 		defer func() {
 			wg.Done()
-			config.Log.Info("Metric server shutdown complete")
+			config.Log.Info("Admin server shutdown complete")
 		}()
-		if err := server.metric.Start(ctx, redisClient); err != nil && !errors.Is(err, context.Canceled) {
-			config.Log.Error("metric server error", zap.Error(err))
+		if err := server.admin.Start(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			config.Log.Error("admin server error", zap.Error(err))
 		}
 	}()
 
@@ -115,7 +333,14 @@ func main() {
 		}
 	}()
 
+	// Write the scale ups, the pending ones are written on shutdown before the store is closed
+	go func() {
+		defer wg.Done()
+		server.batcher.Run(ctx)
+	}()
+
 	go server.processRequests(ctx)
+	go server.refreshInFlight(ctx, inFlightRefresh)
 
 	<-sigChan
 	config.Log.Info("Shutting down servers...")
@@ -146,15 +371,26 @@ func main() {
 	config.Log.Info("Shutdown complete")
 }
 
+// processRequests turns the requests seen by the proxy into scale ups. It never waits for the
+// store, the batcher coalesces the scale ups per host and writes them in the background.
 func (s *Server) processRequests(ctx context.Context) {
 	requests := s.proxy.Requests()
 
+	ticker := time.NewTicker(defaultDroppedReport)
+	defer ticker.Stop()
+	var reportedDropped uint64
+
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-s.done:
 			return
+		case <-ticker.C:
+			if dropped := s.proxy.Dropped(); dropped > reportedDropped {
+				config.Log.Warn("Dropped scale up events, the request buffer is full", zap.Uint64("dropped", dropped-reportedDropped))
+				reportedDropped = dropped
+			}
 		case request, ok := <-requests:
 			if !ok {
 				// Channel was closed
@@ -163,20 +399,105 @@ func (s *Server) processRequests(ctx context.Context) {
 
 			config.Log.Debug("Received request", zap.Any("request", request))
 
-			config.Log.Debug("Scaling up host", zap.String("host", request.Host), zap.Int("target", defaultScaleUpTarget), zap.Duration("duration", defaultScaleUpDuration))
-			err := s.store.ScaleUp(request.Host, defaultScaleUpTarget, defaultScaleUpDuration)
-			if err != nil {
-				config.Log.Error("Error scaling up host", zap.String("host", request.Host), zap.Error(err))
-				continue
+			scaleValue := defaultScaleUpTarget
+			if request.ScaleValue > 0 {
+				scaleValue = request.ScaleValue
+			}
+			idleTimeout := defaultScaleUpDuration
+			if request.IdleTimeout > 0 {
+				idleTimeout = request.IdleTimeout
 			}
 
-			keyValues, err := s.store.GetAllScaleUpKeys()
-			if err != nil {
-				config.Log.Error("Error getting all scale up keys", zap.Error(err))
-				continue
+			s.batcher.Add(store.ScaleUpRequest{
+				Host:       request.Host,
+				Value:      scaleValue,
+				Duration:   idleTimeout,
+				MinActive:  request.MinActive,
+				MetricMode: request.MetricMode,
+				Requests:   1,
+				Received:   request.Received,
+			})
+		}
+	}
+}
+
+// refreshInFlight keeps the targets with requests in flight scaled up, e.g. long gRPC streams, SSE streams,
+// downloads and WebSockets, which see no new requests. It also stores the counts to expose them as a metric.
+func (s *Server) refreshInFlight(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	reported := make(map[string]bool)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		inFlight := s.proxy.InFlight()
+		counts := make(map[string]int, len(inFlight)+len(reported))
+		// Hosts which have nothing in flight anymore are reset to 0
+		for host := range reported {
+			counts[host] = 0
+		}
+		for host, f := range inFlight {
+			counts[host] = f.Count
+
+			idleTimeout := defaultScaleUpDuration
+			if f.IdleTimeout > 0 {
+				idleTimeout = f.IdleTimeout
+			}
+			// The target must not expire before the next refresh, so a short idle timeout is extended to two refreshes
+			if err := s.store.ResetTimer(host, max(idleTimeout, 2*interval)); err != nil {
+				config.Log.Error("Error resetting timer of host with requests in flight", zap.String("host", host), zap.Error(err))
 			}
+		}
+
+		if err := s.store.RecordInFlight(s.replica, counts, 3*interval); err != nil {
+			config.Log.Error("Error recording requests in flight", zap.Error(err))
+			continue
+		}
+		reported = make(map[string]bool, len(inFlight))
+		for host := range inFlight {
+			reported[host] = true
+		}
+	}
+}
+
+// scaledUp is called once the scale ups were written to the store
+func (s *Server) scaledUp(requests []store.ScaleUpRequest) {
+	for _, request := range requests {
+		config.Log.Debug("Scaled up host", zap.String("host", request.Host), zap.Int("target", request.Value), zap.Duration("duration", request.Duration),
+			zap.Duration("minActive", request.MinActive), zap.String("metricMode", request.MetricMode), zap.Int("requests", request.Requests))
+		s.notify(request.Host)
+	}
+
+	// Listing the keys costs a round trip per active host, only do it when it is logged
+	if config.Log.Core().Enabled(zapcore.DebugLevel) {
+		keyValues, err := s.store.GetAllScaleUpKeys()
+		if err != nil {
+			config.Log.Error("Error getting all scale up keys", zap.Error(err))
+			return
+		}
+
+		config.Log.Debug("Scale up keys", zap.Any("keys", keyValues))
+	}
+}
+
+// activated is called for every scale up which activated a host without an active key,
+// the host is cold until it serves its first successful response
+func (s *Server) activated(request store.ScaleUpRequest) {
+	s.coldStarts.Cold(request.Host, coldstart.ReasonNoActiveKey, request.Received)
+}
 
-			config.Log.Debug("Scale up keys", zap.Any("keys", keyValues))
+// notify tells the metric servers which push events to KEDA that the host has received a request
+func (s *Server) notify(host string) {
+	for _, metricServer := range s.metrics {
+		if notifier, ok := metricServer.(Notifier); ok {
+			notifier.Notify(host)
 		}
 	}
 }
@@ -0,0 +1,157 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/araminian/gozero/internal/coldstart"
+	"github.com/araminian/gozero/internal/proxy"
+)
+
+const defaultAdminPort = 9092
+
+type serverConfig struct {
+	port     *int
+	health   HealthSource
+	breakers BreakerSource
+}
+
+// HealthSource reports the state of the health checks of the targets
+type HealthSource interface {
+	Health() map[string]proxy.TargetHealth
+}
+
+// BreakerSource reports the circuit breakers of the targets
+type BreakerSource interface {
+	Breakers() map[string]proxy.TargetBreaker
+}
+
+type ServerConfig func(config *serverConfig) error
+
+func WithAdminPort(port int) ServerConfig {
+	return func(config *serverConfig) error {
+		config.port = &port
+		return nil
+	}
+}
+
+// WithHealthSource serves the health checks of the targets
+func WithHealthSource(source HealthSource) ServerConfig {
+	return func(config *serverConfig) error {
+		config.health = source
+		return nil
+	}
+}
+
+// WithBreakerSource serves the circuit breakers of the targets
+func WithBreakerSource(source BreakerSource) ServerConfig {
+	return func(config *serverConfig) error {
+		config.breakers = source
+		return nil
+	}
+}
+
+// Server serves the admin endpoints of GoZero, it is meant for operators and not exposed to KEDA
+type Server struct {
+	port       int
+	coldStarts *coldstart.Tracker
+	health     HealthSource
+	breakers   BreakerSource
+	app        *fiber.App
+}
+
+func NewServer(coldStarts *coldstart.Tracker, configs ...ServerConfig) (*Server, error) {
+	cfg := &serverConfig{}
+	for _, config := range configs {
+		if err := config(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	port := defaultAdminPort
+	if cfg.port != nil {
+		port = *cfg.port
+	}
+
+	return &Server{
+		port:       port,
+		coldStarts: coldStarts,
+		health:     cfg.health,
+		breakers:   cfg.breakers,
+	}, nil
+}
+
+func (s *Server) Start(ctx context.Context) error {
+	s.app = fiber.New()
+
+	// Last cold starts of every target, or of a single target, e.g. /coldstarts/app.foo.svc.cluster.local:3000
+	s.app.Get("/coldstarts", s.listColdStarts)
+	s.app.Get("/coldstarts/:host", s.listColdStarts)
+	// Health checks of the targets which have one, e.g. /health/app.foo.svc.cluster.local:3000
+	s.app.Get("/health", s.listHealth)
+	s.app.Get("/health/:host", s.listHealth)
+	// Circuit breakers of the targets which failed recently, a target without one is closed
+	s.app.Get("/breakers", s.listBreakers)
+	s.app.Get("/breakers/:host", s.listBreakers)
+
+	go func() {
+		<-ctx.Done()
+		_ = s.app.Shutdown()
+	}()
+
+	return s.app.Listen(fmt.Sprintf(":%d", s.port))
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.app != nil {
+		return s.app.ShutdownWithContext(ctx)
+	}
+	return nil
+}
+
+func (s *Server) listColdStarts(c *fiber.Ctx) error {
+	host := c.Params("host")
+	if host == "" {
+		return c.JSON(s.coldStarts.Histories())
+	}
+
+	return c.JSON(s.coldStarts.History(host))
+}
+
+func (s *Server) listHealth(c *fiber.Ctx) error {
+	health := map[string]proxy.TargetHealth{}
+	if s.health != nil {
+		health = s.health.Health()
+	}
+
+	host := c.Params("host")
+	if host == "" {
+		return c.JSON(health)
+	}
+
+	h, ok := health[host]
+	if !ok {
+		return fiber.NewError(fiber.StatusNotFound, "target has no health check")
+	}
+	return c.JSON(h)
+}
+
+func (s *Server) listBreakers(c *fiber.Ctx) error {
+	breakers := map[string]proxy.TargetBreaker{}
+	if s.breakers != nil {
+		breakers = s.breakers.Breakers()
+	}
+
+	host := c.Params("host")
+	if host == "" {
+		return c.JSON(breakers)
+	}
+
+	b, ok := breakers[host]
+	if !ok {
+		return c.JSON(proxy.TargetBreaker{State: proxy.BreakerClosed})
+	}
+	return c.JSON(b)
+}
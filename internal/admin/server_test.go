@@ -0,0 +1,203 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/araminian/gozero/internal/coldstart"
+	"github.com/araminian/gozero/internal/config"
+	"github.com/araminian/gozero/internal/proxy"
+)
+
+func TestServerColdStarts(t *testing.T) {
+	config.InitLogger(zapcore.ErrorLevel)
+
+	tracker, err := coldstart.NewTracker()
+	if err != nil {
+		t.Fatalf("failed to create tracker: %v", err)
+	}
+	start := time.Now()
+	tracker.Requested("app.svc:80", start)
+	tracker.Cold("app.svc:80", coldstart.ReasonNoActiveKey, start)
+	tracker.Served("app.svc:80", start.Add(2*time.Second))
+
+	server, err := NewServer(tracker, WithAdminPort(9192))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Start(ctx)
+	defer server.Shutdown(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", "localhost:9192")
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("admin server did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var all map[string][]coldstart.Event
+	getJSON(t, "http://localhost:9192/coldstarts", &all)
+	if len(all["app.svc:80"]) != 1 {
+		t.Errorf("expected 1 cold start of app.svc:80, got %+v", all)
+	}
+
+	var events []coldstart.Event
+	getJSON(t, "http://localhost:9192/coldstarts/app.svc:80", &events)
+	if len(events) != 1 || events[0].Seconds != 2 {
+		t.Errorf("expected 1 cold start of 2s, got %+v", events)
+	}
+
+	getJSON(t, "http://localhost:9192/coldstarts/other.svc:80", &events)
+	if len(events) != 0 {
+		t.Errorf("expected no cold starts, got %+v", events)
+	}
+}
+
+type healthSource map[string]proxy.TargetHealth
+
+func (h healthSource) Health() map[string]proxy.TargetHealth {
+	return h
+}
+
+func TestServerHealth(t *testing.T) {
+	config.InitLogger(zapcore.ErrorLevel)
+
+	tracker, err := coldstart.NewTracker()
+	if err != nil {
+		t.Fatalf("failed to create tracker: %v", err)
+	}
+	source := healthSource{"app.svc:80": {State: proxy.HealthHealthy, Since: time.Now()}}
+
+	server, err := NewServer(tracker, WithAdminPort(9193), WithHealthSource(source))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Start(ctx)
+	defer server.Shutdown(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", "localhost:9193")
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("admin server did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var all map[string]proxy.TargetHealth
+	getJSON(t, "http://localhost:9193/health", &all)
+	if all["app.svc:80"].State != proxy.HealthHealthy {
+		t.Errorf("expected app.svc:80 to be healthy, got %+v", all)
+	}
+
+	var health proxy.TargetHealth
+	getJSON(t, "http://localhost:9193/health/app.svc:80", &health)
+	if health.State != proxy.HealthHealthy {
+		t.Errorf("expected app.svc:80 to be healthy, got %+v", health)
+	}
+
+	resp, err := http.Get("http://localhost:9193/health/other.svc:80")
+	if err != nil {
+		t.Fatalf("failed to do request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status code %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func getJSON(t *testing.T, url string, v any) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("failed to do request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("failed to decode response body: %v", err)
+	}
+}
+
+type breakerSource map[string]proxy.TargetBreaker
+
+func (b breakerSource) Breakers() map[string]proxy.TargetBreaker {
+	return b
+}
+
+func TestServerBreakers(t *testing.T) {
+	config.InitLogger(zapcore.ErrorLevel)
+
+	tracker, err := coldstart.NewTracker()
+	if err != nil {
+		t.Fatalf("failed to create tracker: %v", err)
+	}
+	source := breakerSource{"app.svc:80": {State: proxy.BreakerOpen, Since: time.Now(), Failures: 5}}
+
+	server, err := NewServer(tracker, WithAdminPort(9194), WithBreakerSource(source))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go server.Start(ctx)
+	defer server.Shutdown(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", "localhost:9194")
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("admin server did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var all map[string]proxy.TargetBreaker
+	getJSON(t, "http://localhost:9194/breakers", &all)
+	if all["app.svc:80"].State != proxy.BreakerOpen {
+		t.Errorf("expected the breaker of app.svc:80 to be open, got %+v", all)
+	}
+
+	var breaker proxy.TargetBreaker
+	getJSON(t, "http://localhost:9194/breakers/app.svc:80", &breaker)
+	if breaker.State != proxy.BreakerOpen || breaker.Failures != 5 {
+		t.Errorf("expected the breaker of app.svc:80 to be open after 5 failures, got %+v", breaker)
+	}
+
+	// A target which didn't fail has a closed breaker
+	getJSON(t, "http://localhost:9194/breakers/other.svc:80", &breaker)
+	if breaker.State != proxy.BreakerClosed {
+		t.Errorf("expected the breaker of other.svc:80 to be closed, got %+v", breaker)
+	}
+}
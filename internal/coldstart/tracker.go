@@ -0,0 +1,261 @@
+package coldstart
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/araminian/gozero/internal/config"
+	"github.com/araminian/gozero/internal/metric"
+)
+
+const (
+	defaultHistorySize = 10
+	defaultIdleTimeout = 5 * time.Minute
+)
+
+const (
+	// ReasonNoActiveKey is a cold start of a host which had no active key in the store
+	ReasonNoActiveKey = "no_active_key"
+	// ReasonUpstreamUnavailable is a cold start of a host whose upstream was not ready
+	ReasonUpstreamUnavailable = "upstream_unavailable"
+)
+
+// Event is a single cold start of a host
+type Event struct {
+	Reason  string    `json:"reason"`
+	Started time.Time `json:"started"`
+	Ready   time.Time `json:"ready"`
+	Seconds float64   `json:"seconds"`
+}
+
+type TrackerConfig func(*trackerConfig) error
+
+type trackerConfig struct {
+	historySize *int
+	idleTimeout *time.Duration
+}
+
+// WithHistorySize sets how many of the last cold starts are kept per host
+func WithHistorySize(size int) TrackerConfig {
+	return func(cfg *trackerConfig) error {
+		if size <= 0 {
+			return fmt.Errorf("history size must be positive, got %d", size)
+		}
+		cfg.historySize = &size
+		return nil
+	}
+}
+
+// WithIdleTimeout sets after how long without requests a host is forgotten, its history is kept
+func WithIdleTimeout(timeout time.Duration) TrackerConfig {
+	return func(cfg *trackerConfig) error {
+		if timeout <= 0 {
+			return fmt.Errorf("idle timeout must be positive, got %s", timeout)
+		}
+		cfg.idleTimeout = &timeout
+		return nil
+	}
+}
+
+// hostState follows the requests of a host from the first request to the first successful response
+type hostState struct {
+	// first is the first request since the last successful response, zero if there is none
+	first  time.Time
+	reason string
+
+	// lastFirst and lastServed are the last closed window, a late cold signal may still claim it
+	lastFirst  time.Time
+	lastServed time.Time
+	// lastSeen is the latest request or response of the host
+	lastSeen time.Time
+
+	history []Event
+}
+
+// Tracker measures how long hosts take from the first request after they were cold
+// to the first successful upstream response
+type Tracker struct {
+	historySize int
+	idleTimeout time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostState
+	// expired is when idle hosts were expired last
+	expired time.Time
+}
+
+func NewTracker(configs ...TrackerConfig) (*Tracker, error) {
+	cfg := &trackerConfig{}
+	for _, config := range configs {
+		if err := config(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	historySize := defaultHistorySize
+	if cfg.historySize != nil {
+		historySize = *cfg.historySize
+	}
+
+	idleTimeout := defaultIdleTimeout
+	if cfg.idleTimeout != nil {
+		idleTimeout = *cfg.idleTimeout
+	}
+
+	return &Tracker{
+		historySize: historySize,
+		idleTimeout: idleTimeout,
+		hosts:       make(map[string]*hostState),
+	}, nil
+}
+
+// Requested registers a request for the host
+func (t *Tracker) Requested(host string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := t.state(host, at)
+	if state.first.IsZero() {
+		state.first = at
+	}
+}
+
+// Cold marks the host as cold for the request which arrived at since.
+// The cold start ends with the first successful response, which may already have happened.
+func (t *Tracker) Cold(host, reason string, since time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := t.state(host, since)
+	switch {
+	case !state.first.IsZero() && !since.Before(state.first):
+		if state.reason == "" {
+			state.reason = reason
+		}
+	case !state.lastFirst.IsZero() && !since.Before(state.lastFirst) && !since.After(state.lastServed):
+		t.record(host, state, Event{Reason: reason, Started: state.lastFirst, Ready: state.lastServed})
+		state.lastFirst = time.Time{}
+	}
+}
+
+// Served registers a successful upstream response of the host
+func (t *Tracker) Served(host string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.hosts[host]
+	if !ok || state.first.IsZero() {
+		return
+	}
+	state.lastSeen = maxTime(state.lastSeen, at)
+
+	if state.reason != "" {
+		t.record(host, state, Event{Reason: state.reason, Started: state.first, Ready: at})
+		state.lastFirst = time.Time{}
+	} else {
+		state.lastFirst = state.first
+	}
+	state.lastServed = at
+	state.first = time.Time{}
+	state.reason = ""
+}
+
+// History returns the last cold starts of the host, the latest first
+func (t *Tracker) History(host string) []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.hosts[host]
+	if !ok {
+		return []Event{}
+	}
+	return latestFirst(state.history)
+}
+
+// Histories returns the last cold starts of every host which had one, the latest first
+func (t *Tracker) Histories() map[string][]Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire()
+
+	result := make(map[string][]Event)
+	for host, state := range t.hosts {
+		if len(state.history) > 0 {
+			result[host] = latestFirst(state.history)
+		}
+	}
+	return result
+}
+
+// state returns the state of the host seen at, t.mu must be held
+func (t *Tracker) state(host string, at time.Time) *hostState {
+	state, ok := t.hosts[host]
+	if !ok {
+		t.expire()
+		state = &hostState{}
+		t.hosts[host] = state
+	}
+	state.lastSeen = maxTime(state.lastSeen, at)
+	return state
+}
+
+// expire forgets the hosts which weren't seen for the idle timeout, so hosts which never get a response,
+// e.g. typos, don't add up. The history of a host outlives it, only its open cold start is dropped.
+// It runs at most once per idle timeout, so a host is forgotten after one to two idle timeouts.
+// t.mu must be held.
+func (t *Tracker) expire() {
+	now := time.Now()
+	if now.Sub(t.expired) < t.idleTimeout {
+		return
+	}
+	t.expired = now
+
+	for host, state := range t.hosts {
+		if now.Sub(state.lastSeen) < t.idleTimeout {
+			continue
+		}
+		if len(state.history) == 0 {
+			delete(t.hosts, host)
+			continue
+		}
+		t.hosts[host] = &hostState{history: state.history, lastSeen: state.lastSeen}
+	}
+}
+
+// record reports a finished cold start and keeps it in the history of the host, t.mu must be held
+func (t *Tracker) record(host string, state *hostState, event Event) {
+	duration := event.Ready.Sub(event.Started)
+	event.Seconds = duration.Seconds()
+
+	state.history = append(state.history, event)
+	if len(state.history) > t.historySize {
+		state.history = state.history[len(state.history)-t.historySize:]
+	}
+
+	metric.ObserveColdStart(host, event.Reason, duration)
+	config.Log.Info("Cold start",
+		zap.String("host", host),
+		zap.String("reason", event.Reason),
+		zap.Time("started", event.Started),
+		zap.Duration("duration", duration))
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+func latestFirst(history []Event) []Event {
+	events := make([]Event, len(history))
+	copy(events, history)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Ready.After(events[j].Ready)
+	})
+	return events
+}
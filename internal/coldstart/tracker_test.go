@@ -0,0 +1,123 @@
+package coldstart
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+
+	"github.com/araminian/gozero/internal/config"
+)
+
+func newTestTracker(t *testing.T, configs ...TrackerConfig) *Tracker {
+	t.Helper()
+	config.InitLogger(zapcore.ErrorLevel)
+
+	tracker, err := NewTracker(configs...)
+	if err != nil {
+		t.Fatalf("failed to create tracker: %v", err)
+	}
+	return tracker
+}
+
+func TestTrackerColdStart(t *testing.T) {
+	tracker := newTestTracker(t)
+	start := time.Now()
+
+	tracker.Requested("app.svc:80", start)
+	tracker.Requested("app.svc:80", start.Add(time.Second))
+	tracker.Cold("app.svc:80", ReasonUpstreamUnavailable, start.Add(time.Second))
+	tracker.Served("app.svc:80", start.Add(3*time.Second))
+
+	events := tracker.History("app.svc:80")
+	if len(events) != 1 {
+		t.Fatalf("expected 1 cold start, got %d", len(events))
+	}
+	if events[0].Seconds != 3 {
+		t.Errorf("expected the cold start to take 3s from the first request, got %.2fs", events[0].Seconds)
+	}
+
+	// Warm requests are no cold starts
+	tracker.Requested("app.svc:80", start.Add(4*time.Second))
+	tracker.Served("app.svc:80", start.Add(5*time.Second))
+	if events := tracker.History("app.svc:80"); len(events) != 1 {
+		t.Errorf("expected 1 cold start, got %d", len(events))
+	}
+}
+
+func TestTrackerLateColdSignal(t *testing.T) {
+	tracker := newTestTracker(t)
+	start := time.Now()
+
+	// The store reports the host as activated after its first response
+	tracker.Requested("app.svc:80", start)
+	tracker.Served("app.svc:80", start.Add(200*time.Millisecond))
+	tracker.Cold("app.svc:80", ReasonNoActiveKey, start)
+	tracker.Cold("app.svc:80", ReasonNoActiveKey, start)
+
+	events := tracker.History("app.svc:80")
+	if len(events) != 1 {
+		t.Fatalf("expected 1 cold start, got %d", len(events))
+	}
+	if events[0].Reason != ReasonNoActiveKey || events[0].Seconds != 0.2 {
+		t.Errorf("unexpected cold start %+v", events[0])
+	}
+}
+
+func TestTrackerHistorySize(t *testing.T) {
+	tracker := newTestTracker(t, WithHistorySize(2))
+	start := time.Now()
+
+	for i := range 3 {
+		at := start.Add(time.Duration(i) * time.Minute)
+		tracker.Requested("app.svc:80", at)
+		tracker.Cold("app.svc:80", ReasonNoActiveKey, at)
+		tracker.Served("app.svc:80", at.Add(time.Duration(i+1)*time.Second))
+	}
+
+	events := tracker.Histories()["app.svc:80"]
+	if len(events) != 2 {
+		t.Fatalf("expected the last 2 cold starts, got %d", len(events))
+	}
+	if events[0].Seconds != 3 || events[1].Seconds != 2 {
+		t.Errorf("expected the latest cold start first, got %+v", events)
+	}
+
+	if _, err := NewTracker(WithHistorySize(0)); err == nil {
+		t.Errorf("expected an error for an empty history")
+	}
+}
+
+func TestTrackerExpiresIdleHosts(t *testing.T) {
+	tracker := newTestTracker(t, WithIdleTimeout(time.Minute))
+	start := time.Now().Add(-2 * time.Minute)
+
+	// A host which never answers and a host with a cold start, both idle since
+	tracker.Requested("typo.svc:80", start)
+	tracker.Requested("app.svc:80", start)
+	tracker.Cold("app.svc:80", ReasonNoActiveKey, start)
+	tracker.Served("app.svc:80", start.Add(time.Second))
+	tracker.Requested("app.svc:80", start.Add(2*time.Second))
+
+	// The next new host expires them, as if the last expiry was an idle timeout ago
+	tracker.expired = time.Time{}
+	tracker.Requested("other.svc:80", time.Now())
+
+	if _, ok := tracker.hosts["typo.svc:80"]; ok {
+		t.Errorf("expected the idle host to be forgotten")
+	}
+	state, ok := tracker.hosts["app.svc:80"]
+	if !ok || len(state.history) != 1 {
+		t.Fatalf("expected the history of the idle host to be kept, got %+v", state)
+	}
+	if !state.first.IsZero() {
+		t.Errorf("expected the open cold start of the idle host to be dropped")
+	}
+	if _, ok := tracker.hosts["other.svc:80"]; !ok {
+		t.Errorf("expected the new host to be tracked")
+	}
+
+	if _, err := NewTracker(WithIdleTimeout(0)); err == nil {
+		t.Errorf("expected an error for an empty idle timeout")
+	}
+}
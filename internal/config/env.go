@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -16,6 +17,20 @@ func GetEnvOrDefaultString(key, defaultValue string) string {
 	return value
 }
 
+func GetEnvOrDefaultStringSlice(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return defaultValue
+	}
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
 func GetEnvOrDefaultInt(key string, defaultValue int) int {
 	value := os.Getenv(key)
 	if len(value) == 0 {
@@ -28,6 +43,18 @@ func GetEnvOrDefaultInt(key string, defaultValue int) int {
 	return intValue
 }
 
+func GetEnvOrDefaultBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return defaultValue
+	}
+	boolValue, err := strconv.ParseBool(value)
+	if err != nil {
+		return defaultValue
+	}
+	return boolValue
+}
+
 func GetEnvOrDefaultDuration(key string, defaultValue time.Duration) time.Duration {
 	value := os.Getenv(key)
 	if len(value) == 0 {
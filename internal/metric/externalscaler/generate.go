@@ -0,0 +1,4 @@
+// Package externalscaler is the gRPC API of KEDA external scalers, generated from externalscaler.proto of KEDA
+package externalscaler
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative externalscaler.proto
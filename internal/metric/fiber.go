@@ -3,18 +3,23 @@ package metric
 import (
 	"context"
 	"fmt"
+	"strconv"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
 	defaultFiberMetricExposerPort = 9090
 	defaultFiberMetricExposerPath = "/metrics"
+	defaultFiberPrometheusPath    = "/prometheus"
 )
 
 type fiberMetricExposerConfig struct {
-	port *int
-	path *string
+	port           *int
+	path           *string
+	prometheusPath *string
 }
 
 type FiberMetricExposerConfig func(config *fiberMetricExposerConfig) error
@@ -33,11 +38,20 @@ func WithFiberMetricExposerPath(path string) FiberMetricExposerConfig {
 	}
 }
 
+// WithFiberPrometheusPath sets the path GoZero's own metrics are exposed on in the Prometheus format
+func WithFiberPrometheusPath(path string) FiberMetricExposerConfig {
+	return func(config *fiberMetricExposerConfig) error {
+		config.prometheusPath = &path
+		return nil
+	}
+}
+
 type FiberMetricExposer struct {
-	port  int
-	path  string
-	store Storer
-	app   *fiber.App
+	port           int
+	path           string
+	prometheusPath string
+	store          Storer
+	app            *fiber.App
 }
 
 func NewFiberMetricExposer(configs ...FiberMetricExposerConfig) (*FiberMetricExposer, error) {
@@ -50,8 +64,9 @@ func NewFiberMetricExposer(configs ...FiberMetricExposerConfig) (*FiberMetricExp
 	}
 
 	var (
-		port = defaultFiberMetricExposerPort
-		path = defaultFiberMetricExposerPath
+		port           = defaultFiberMetricExposerPort
+		path           = defaultFiberMetricExposerPath
+		prometheusPath = defaultFiberPrometheusPath
 	)
 	if cfg.port != nil {
 		port = *cfg.port
@@ -59,10 +74,17 @@ func NewFiberMetricExposer(configs ...FiberMetricExposerConfig) (*FiberMetricExp
 	if cfg.path != nil {
 		path = *cfg.path
 	}
+	if cfg.prometheusPath != nil {
+		prometheusPath = *cfg.prometheusPath
+	}
+	if prometheusPath == path {
+		return nil, fmt.Errorf("prometheus path %s must differ from the metric path", prometheusPath)
+	}
 
 	return &FiberMetricExposer{
-		port: port,
-		path: path,
+		port:           port,
+		path:           path,
+		prometheusPath: prometheusPath,
 	}, nil
 }
 
@@ -70,6 +92,9 @@ func (m *FiberMetricExposer) Start(ctx context.Context, store Storer) error {
 	m.store = store
 	m.app = fiber.New()
 
+	// GoZero's own metrics
+	m.app.Get(m.prometheusPath, m.exposePrometheus)
+
 	// Add route for base metrics path
 	m.app.Get(m.path, m.exposeMetrics)
 
@@ -108,9 +133,32 @@ func (m *FiberMetricExposer) exposeMetrics(c *fiber.Ctx) error {
 		keys[svc] = "0"
 	}
 
+	rates, err := m.store.GetRequestRates()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	inFlight, err := m.store.GetInFlight()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
+	}
+
 	svcValue := fiber.Map{
-		"value": keys[svc],
+		"value":    keys[svc],
+		"rate":     strconv.FormatFloat(rates[svc], 'f', 2, 64),
+		"inFlight": strconv.Itoa(inFlight[svc]),
 	}
 
 	return c.JSON(svcValue)
 }
+
+var prometheusHandler = adaptor.HTTPHandler(promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+
+func (m *FiberMetricExposer) exposePrometheus(c *fiber.Ctx) error {
+	keys, err := m.store.GetAllScaleUpKeysValues()
+	if err == nil {
+		activeHosts.Set(float64(len(keys)))
+	}
+
+	return prometheusHandler(c)
+}
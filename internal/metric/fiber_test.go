@@ -4,8 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"io"
+	"net"
 	"net/http"
+	"strings"
 	"testing"
+	"time"
 )
 
 type mockStore struct{}
@@ -14,6 +17,35 @@ func (m *mockStore) GetAllScaleUpKeysValues() (map[string]string, error) {
 	return map[string]string{"bar-foo-svc-cluster-local": "10"}, nil
 }
 
+func (m *mockStore) GetScaleUpValue(name string) (string, bool, error) {
+	values, _ := m.GetAllScaleUpKeysValues()
+	value, ok := values[name]
+	return value, ok, nil
+}
+
+func (m *mockStore) GetRequestRates() (map[string]float64, error) {
+	return map[string]float64{"bar-foo-svc-cluster-local": 2.5}, nil
+}
+
+func (m *mockStore) GetInFlight() (map[string]int, error) {
+	return map[string]int{"bar-foo-svc-cluster-local": 3}, nil
+}
+
+// waitForPort waits until the server started in the background accepts connections
+func waitForPort(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server on %s did not start", addr)
+}
+
 func TestFiberMetricExposer(t *testing.T) {
 	exposer, err := NewFiberMetricExposer(WithFiberMetricExposerPath("/metrics"), WithFiberMetricExposerPort(8080))
 	if err != nil {
@@ -24,6 +56,7 @@ func TestFiberMetricExposer(t *testing.T) {
 	go exposer.Start(c, &mockStore{})
 	defer cancel()
 	defer exposer.Shutdown(c)
+	waitForPort(t, "localhost:8080")
 
 	// Ask for existing host metrics
 	req, err := http.NewRequestWithContext(c, "GET", "http://localhost:8080/metrics/bar-foo-svc-cluster-local", nil)
@@ -58,6 +91,14 @@ func TestFiberMetricExposer(t *testing.T) {
 		t.Fatalf("expected value %s, got %s", "10", result["value"])
 	}
 
+	if result["rate"] != "2.50" {
+		t.Fatalf("expected rate %s, got %s", "2.50", result["rate"])
+	}
+
+	if result["inFlight"] != "3" {
+		t.Fatalf("expected in flight %s, got %s", "3", result["inFlight"])
+	}
+
 	// Ask for non-existing host metrics
 	req, err = http.NewRequestWithContext(c, "GET", "http://localhost:8080/metrics/no-foo-svc-cluster-local", nil)
 	if err != nil {
@@ -91,4 +132,56 @@ func TestFiberMetricExposer(t *testing.T) {
 		t.Fatalf("expected value %s, got %s", "0", resultNotFound["value"])
 	}
 
+	if resultNotFound["rate"] != "0.00" {
+		t.Fatalf("expected rate %s, got %s", "0.00", resultNotFound["rate"])
+	}
+
+	if resultNotFound["inFlight"] != "0" {
+		t.Fatalf("expected in flight %s, got %s", "0", resultNotFound["inFlight"])
+	}
+
+}
+
+func TestFiberPrometheusExposer(t *testing.T) {
+	if _, err := NewFiberMetricExposer(WithFiberMetricExposerPath("/metrics"), WithFiberPrometheusPath("/metrics")); err == nil {
+		t.Fatalf("expected an error for the same metric and prometheus path")
+	}
+
+	exposer, err := NewFiberMetricExposer(WithFiberMetricExposerPort(8081))
+	if err != nil {
+		t.Fatalf("failed to create exposer: %v", err)
+	}
+
+	c, cancel := context.WithCancel(context.Background())
+	go exposer.Start(c, &mockStore{})
+	defer cancel()
+	defer exposer.Shutdown(c)
+	waitForPort(t, "localhost:8081")
+
+	ObserveProxyRequest("bar.foo.svc.cluster.local:80", http.StatusOK, 10*time.Millisecond)
+
+	resp, err := http.Get("http://localhost:8081/prometheus")
+	if err != nil {
+		t.Fatalf("failed to do request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	for _, want := range []string{
+		`gozero_proxy_requests_total{code="200",target="bar.foo.svc.cluster.local"} 1`,
+		"gozero_active_hosts 1",
+		"gozero_request_buffer_length",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("expected %q in the exposition", want)
+		}
+	}
 }
@@ -0,0 +1,340 @@
+package metric
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/araminian/gozero/internal/config"
+	"github.com/araminian/gozero/internal/metric/externalscaler"
+)
+
+const (
+	defaultGRPCExternalScalerPort         = 9091
+	defaultGRPCExternalScalerPollInterval = 5 * time.Second
+	defaultGRPCExternalScalerTargetValue  = 1
+	scalerMetadataHost                    = "host"
+	scalerMetadataTargetValue             = "targetValue"
+	scalerMetadataMetric                  = "metric"
+	scalerMetricValue                     = "value"
+	scalerMetricRate                      = "rate"
+)
+
+type grpcExternalScalerConfig struct {
+	port         *int
+	pollInterval *time.Duration
+}
+
+type GRPCExternalScalerConfig func(config *grpcExternalScalerConfig) error
+
+func WithGRPCExternalScalerPort(port int) GRPCExternalScalerConfig {
+	return func(config *grpcExternalScalerConfig) error {
+		config.port = &port
+		return nil
+	}
+}
+
+// WithGRPCExternalScalerPollInterval sets how often StreamIsActive re-reads the store
+// to report hosts which became inactive.
+func WithGRPCExternalScalerPollInterval(interval time.Duration) GRPCExternalScalerConfig {
+	return func(config *grpcExternalScalerConfig) error {
+		if interval <= 0 {
+			return fmt.Errorf("poll interval must be positive, got %s", interval)
+		}
+		config.pollInterval = &interval
+		return nil
+	}
+}
+
+// GRPCExternalScaler implements the KEDA external-push scaler protocol on top of the store.
+// Besides answering KEDA polls, it pushes an active event to every StreamIsActive
+// subscriber as soon as a request for the host is seen.
+type GRPCExternalScaler struct {
+	externalscaler.UnimplementedExternalScalerServer
+
+	port         int
+	pollInterval time.Duration
+	store        Storer
+	server       *grpc.Server
+
+	mu          sync.Mutex
+	subscribers map[string]map[chan struct{}]struct{}
+}
+
+func NewGRPCExternalScaler(configs ...GRPCExternalScalerConfig) (*GRPCExternalScaler, error) {
+	cfg := &grpcExternalScalerConfig{}
+	for _, config := range configs {
+		err := config(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		port         = defaultGRPCExternalScalerPort
+		pollInterval = defaultGRPCExternalScalerPollInterval
+	)
+	if cfg.port != nil {
+		port = *cfg.port
+	}
+	if cfg.pollInterval != nil {
+		pollInterval = *cfg.pollInterval
+	}
+
+	// The server exists before Start, so Shutdown may run concurrently with it
+	s := &GRPCExternalScaler{
+		port:         port,
+		pollInterval: pollInterval,
+		server:       grpc.NewServer(),
+		subscribers:  make(map[string]map[chan struct{}]struct{}),
+	}
+	externalscaler.RegisterExternalScalerServer(s.server, s)
+	return s, nil
+}
+
+func (s *GRPCExternalScaler) Start(ctx context.Context, store Storer) error {
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
+	if err != nil {
+		return err
+	}
+
+	return s.serve(ctx, lis, store)
+}
+
+func (s *GRPCExternalScaler) serve(ctx context.Context, lis net.Listener, store Storer) error {
+	// The handlers only read the store once Serve accepted a connection
+	s.store = store
+
+	go func() {
+		<-ctx.Done()
+		s.server.GracefulStop()
+	}()
+
+	config.Log.Info("Starting KEDA external scaler", zap.String("address", lis.Addr().String()))
+	err := s.server.Serve(lis)
+	if errors.Is(err, grpc.ErrServerStopped) {
+		return nil
+	}
+	return err
+}
+
+func (s *GRPCExternalScaler) Shutdown(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		s.server.Stop()
+		return ctx.Err()
+	}
+}
+
+// Notify wakes up every StreamIsActive subscriber watching the given host.
+// The host may be given either as the proxied "host:port" or in its metric form.
+func (s *GRPCExternalScaler) Notify(host string) {
+	name := metricHostName(host)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ch := range s.subscribers[name] {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// A wake-up is already pending for this subscriber.
+		}
+	}
+}
+
+func (s *GRPCExternalScaler) subscribe(name string) (chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	if s.subscribers[name] == nil {
+		s.subscribers[name] = make(map[chan struct{}]struct{})
+	}
+	s.subscribers[name][ch] = struct{}{}
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.subscribers[name], ch)
+		if len(s.subscribers[name]) == 0 {
+			delete(s.subscribers, name)
+		}
+	}
+}
+
+func (s *GRPCExternalScaler) IsActive(ctx context.Context, ref *externalscaler.ScaledObjectRef) (*externalscaler.IsActiveResponse, error) {
+	name, err := scaledObjectHost(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := s.hostValue(name)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &externalscaler.IsActiveResponse{Result: value > 0}, nil
+}
+
+func (s *GRPCExternalScaler) StreamIsActive(ref *externalscaler.ScaledObjectRef, stream externalscaler.ExternalScaler_StreamIsActiveServer) error {
+	name, err := scaledObjectHost(ref)
+	if err != nil {
+		return err
+	}
+
+	notifyCh, unsubscribe := s.subscribe(name)
+	defer unsubscribe()
+
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+
+	var lastActive *bool
+	send := func(active bool) error {
+		lastActive = &active
+		return stream.Send(&externalscaler.IsActiveResponse{Result: active})
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-notifyCh:
+			config.Log.Debug("Pushing active event to KEDA", zap.String("host", name))
+			if err := send(true); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			value, err := s.hostValue(name)
+			if err != nil {
+				config.Log.Error("Error getting scale up value", zap.String("host", name), zap.Error(err))
+				continue
+			}
+			active := value > 0
+			if lastActive != nil && *lastActive == active {
+				continue
+			}
+			if err := send(active); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *GRPCExternalScaler) GetMetricSpec(ctx context.Context, ref *externalscaler.ScaledObjectRef) (*externalscaler.GetMetricSpecResponse, error) {
+	name, err := scaledObjectHost(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	targetValue := int64(defaultGRPCExternalScalerTargetValue)
+	if raw, ok := ref.GetScalerMetadata()[scalerMetadataTargetValue]; ok {
+		targetValue, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || targetValue <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s %q", scalerMetadataTargetValue, raw)
+		}
+	}
+
+	return &externalscaler.GetMetricSpecResponse{
+		MetricSpecs: []*externalscaler.MetricSpec{{
+			MetricName: name,
+			TargetSize: targetValue,
+		}},
+	}, nil
+}
+
+func (s *GRPCExternalScaler) GetMetrics(ctx context.Context, req *externalscaler.GetMetricsRequest) (*externalscaler.GetMetricsResponse, error) {
+	name, err := scaledObjectHost(req.GetScaledObjectRef())
+	if err != nil {
+		return nil, err
+	}
+
+	var value int64
+	switch metric := req.GetScaledObjectRef().GetScalerMetadata()[scalerMetadataMetric]; metric {
+	case "", scalerMetricValue:
+		value, err = s.hostValue(name)
+	case scalerMetricRate:
+		value, err = s.hostRate(name)
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported %s %q", scalerMetadataMetric, metric)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	metricName := req.GetMetricName()
+	if metricName == "" {
+		metricName = name
+	}
+
+	return &externalscaler.GetMetricsResponse{
+		MetricValues: []*externalscaler.MetricValue{{
+			MetricName:  metricName,
+			MetricValue: value,
+		}},
+	}, nil
+}
+
+// hostValue returns the current scale value of the host, or 0 if it is not in the store.
+func (s *GRPCExternalScaler) hostValue(name string) (int64, error) {
+	raw, ok, err := s.store.GetScaleUpValue(name)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, nil
+	}
+
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid scale up value %q for host %s: %w", raw, name, err)
+	}
+
+	return int64(math.Ceil(value)), nil
+}
+
+// hostRate returns the requests per second of the host, rounded up so any traffic counts
+func (s *GRPCExternalScaler) hostRate(name string) (int64, error) {
+	rates, err := s.store.GetRequestRates()
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(math.Ceil(rates[name])), nil
+}
+
+func scaledObjectHost(ref *externalscaler.ScaledObjectRef) (string, error) {
+	host := ref.GetScalerMetadata()[scalerMetadataHost]
+	if host == "" {
+		return "", status.Errorf(codes.InvalidArgument, "scaler metadata %q is required", scalerMetadataHost)
+	}
+	return metricHostName(host), nil
+}
+
+// metricHostName converts a target host into the name used by the store when exposing
+// metrics, e.g. app.app-a.svc.cluster.local:3000 -> app-app-a-svc-cluster-local
+func metricHostName(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ReplaceAll(host, ".", "-")
+}
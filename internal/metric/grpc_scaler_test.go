@@ -0,0 +1,176 @@
+package metric
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/araminian/gozero/internal/config"
+	"github.com/araminian/gozero/internal/metric/externalscaler"
+)
+
+func setupGRPCExternalScaler(t *testing.T) (*GRPCExternalScaler, externalscaler.ExternalScalerClient, context.CancelFunc) {
+	t.Helper()
+	config.InitLogger(zapcore.ErrorLevel)
+
+	scaler, err := NewGRPCExternalScaler(WithGRPCExternalScalerPollInterval(50 * time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create external scaler: %v", err)
+	}
+
+	lis := bufconn.Listen(1024 * 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	go scaler.serve(ctx, lis, &mockStore{})
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create grpc client: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return scaler, externalscaler.NewExternalScalerClient(conn), cancel
+}
+
+func scaledObjectRef(host string) *externalscaler.ScaledObjectRef {
+	return &externalscaler.ScaledObjectRef{
+		Name:           "app",
+		Namespace:      "foo",
+		ScalerMetadata: map[string]string{"host": host},
+	}
+}
+
+func TestGRPCExternalScaler(t *testing.T) {
+	_, client, cancel := setupGRPCExternalScaler(t)
+	defer cancel()
+
+	ctx := context.Background()
+
+	tests := []struct {
+		name          string
+		host          string
+		expectedValue int64
+	}{
+		{name: "active host", host: "bar-foo-svc-cluster-local", expectedValue: 10},
+		{name: "active host with port", host: "bar.foo.svc.cluster.local:8080", expectedValue: 10},
+		{name: "inactive host", host: "no-foo-svc-cluster-local", expectedValue: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			active, err := client.IsActive(ctx, scaledObjectRef(tt.host))
+			if err != nil {
+				t.Fatalf("IsActive failed: %v", err)
+			}
+			if active.Result != (tt.expectedValue > 0) {
+				t.Errorf("expected active %t, got %t", tt.expectedValue > 0, active.Result)
+			}
+
+			spec, err := client.GetMetricSpec(ctx, scaledObjectRef(tt.host))
+			if err != nil {
+				t.Fatalf("GetMetricSpec failed: %v", err)
+			}
+			if len(spec.MetricSpecs) != 1 || spec.MetricSpecs[0].TargetSize != 1 {
+				t.Errorf("unexpected metric spec: %v", spec.MetricSpecs)
+			}
+
+			metrics, err := client.GetMetrics(ctx, &externalscaler.GetMetricsRequest{
+				ScaledObjectRef: scaledObjectRef(tt.host),
+				MetricName:      spec.MetricSpecs[0].MetricName,
+			})
+			if err != nil {
+				t.Fatalf("GetMetrics failed: %v", err)
+			}
+			if len(metrics.MetricValues) != 1 || metrics.MetricValues[0].MetricValue != tt.expectedValue {
+				t.Errorf("expected metric value %d, got %v", tt.expectedValue, metrics.MetricValues)
+			}
+		})
+	}
+
+	t.Run("request rate metric", func(t *testing.T) {
+		ref := scaledObjectRef("bar-foo-svc-cluster-local")
+		ref.ScalerMetadata["metric"] = "rate"
+
+		metrics, err := client.GetMetrics(ctx, &externalscaler.GetMetricsRequest{ScaledObjectRef: ref})
+		if err != nil {
+			t.Fatalf("GetMetrics failed: %v", err)
+		}
+		// 2.5 requests per second are rounded up
+		if len(metrics.MetricValues) != 1 || metrics.MetricValues[0].MetricValue != 3 {
+			t.Errorf("expected metric value %d, got %v", 3, metrics.MetricValues)
+		}
+	})
+
+	t.Run("missing host metadata", func(t *testing.T) {
+		_, err := client.IsActive(ctx, &externalscaler.ScaledObjectRef{Name: "app"})
+		if err == nil {
+			t.Fatal("expected error for missing host metadata")
+		}
+	})
+}
+
+func TestGRPCExternalScalerStreamIsActive(t *testing.T) {
+	scaler, client, cancel := setupGRPCExternalScaler(t)
+	defer cancel()
+
+	ctx, streamCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer streamCancel()
+
+	stream, err := client.StreamIsActive(ctx, scaledObjectRef("no-foo-svc-cluster-local"))
+	if err != nil {
+		t.Fatalf("StreamIsActive failed: %v", err)
+	}
+
+	// The first poll reports the host as inactive
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("failed to receive: %v", err)
+	}
+	if resp.Result {
+		t.Fatal("expected inactive host")
+	}
+
+	// A request seen by the proxy is pushed immediately
+	scaler.Notify("no.foo.svc.cluster.local:3000")
+	resp, err = stream.Recv()
+	if err != nil {
+		t.Fatalf("failed to receive: %v", err)
+	}
+	if !resp.Result {
+		t.Fatal("expected active event after notify")
+	}
+}
+
+func TestGRPCExternalScalerShutdownAfterStart(t *testing.T) {
+	config.InitLogger(zapcore.ErrorLevel)
+
+	scaler, err := NewGRPCExternalScaler(WithGRPCExternalScalerPort(0))
+	if err != nil {
+		t.Fatalf("failed to create external scaler: %v", err)
+	}
+
+	started := make(chan error, 1)
+	go func() { started <- scaler.Start(context.Background(), &mockStore{}) }()
+
+	if err := scaler.Shutdown(context.Background()); err != nil {
+		t.Errorf("failed to shut down external scaler: %v", err)
+	}
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Errorf("expected Start to return without an error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Start to return after Shutdown")
+	}
+}
@@ -2,4 +2,7 @@ package metric
 
 type Storer interface {
 	GetAllScaleUpKeysValues() (map[string]string, error)
+	GetScaleUpValue(name string) (string, bool, error)
+	GetRequestRates() (map[string]float64, error)
+	GetInFlight() (map[string]int, error)
 }
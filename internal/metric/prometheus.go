@@ -0,0 +1,363 @@
+package metric
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	defaultMaxTargetLabels = 100
+	defaultTargetLabelIdle = time.Hour
+	// otherTargetLabel is used for targets beyond the label limit
+	otherTargetLabel = "other"
+)
+
+// Registry holds the metrics of GoZero itself, exposed in the Prometheus text format
+var Registry = prometheus.NewRegistry()
+
+var (
+	proxyRequests = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "gozero_proxy_requests_total",
+		Help: "Proxied requests by target and status code.",
+	}, []string{"target", "code"})
+
+	proxyRequestDuration = promauto.With(Registry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gozero_proxy_request_duration_seconds",
+		Help:    "Time to serve proxied requests, including waiting for cold targets.",
+		Buckets: prometheus.ExponentialBuckets(0.005, 3, 12),
+	}, []string{"target"})
+
+	proxyRejected = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "gozero_proxy_rejected_total",
+		Help: "Requests which were not proxied, by reason.",
+	}, []string{"reason"})
+
+	upstreamDuration = promauto.With(Registry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gozero_upstream_duration_seconds",
+		Help:    "Time until the response headers of a single attempt to the target.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"target"})
+
+	retryAttempts = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "gozero_retry_attempts_total",
+		Help: "Attempts to reach targets which were not ready yet.",
+	}, []string{"target"})
+
+	coldStartWait = promauto.With(Registry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gozero_cold_start_wait_seconds",
+		Help:    "Time requests waited for cold targets, by outcome.",
+		Buckets: []float64{0.1, 0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300},
+	}, []string{"target", "outcome"})
+
+	coldStarts = promauto.With(Registry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gozero_cold_start_duration_seconds",
+		Help:    "Time from the first request of a cold target to its first successful response, by reason.",
+		Buckets: []float64{0.1, 0.5, 1, 2, 5, 10, 20, 30, 60, 120, 300},
+	}, []string{"target", "reason"})
+
+	abandonedWaits = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "gozero_cold_start_abandoned_total",
+		Help: "Requests whose client gave up waiting for a cold target, by reason (canceled or deadline).",
+	}, []string{"target", "reason"})
+
+	inFlightRequests = promauto.With(Registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gozero_in_flight_requests",
+		Help: "Requests the proxy is serving right now, including open streams and upgraded connections.",
+	}, []string{"target"})
+
+	breakerStates = promauto.With(Registry).NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gozero_circuit_breakers",
+		Help: "Targets whose circuit breaker is open or half-open, by state.",
+	}, []string{"target", "state"})
+
+	breakerRejected = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "gozero_circuit_breaker_rejected_total",
+		Help: "Requests which failed fast because the circuit breaker of their target was open.",
+	}, []string{"target"})
+
+	droppedEvents = promauto.With(Registry).NewCounter(prometheus.CounterOpts{
+		Name: "gozero_dropped_scale_up_events_total",
+		Help: "Scale up events dropped because the request buffer was full.",
+	})
+
+	storeDuration = promauto.With(Registry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gozero_store_operation_duration_seconds",
+		Help:    "Latency of store operations.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+	}, []string{"operation"})
+
+	storeErrors = promauto.With(Registry).NewCounterVec(prometheus.CounterOpts{
+		Name: "gozero_store_errors_total",
+		Help: "Failed store operations.",
+	}, []string{"operation"})
+
+	activeHosts = promauto.With(Registry).NewGauge(prometheus.GaugeOpts{
+		Name: "gozero_active_hosts",
+		Help: "Hosts which are currently scaled up in the store.",
+	})
+
+	requestBufferLength atomic.Pointer[func() int]
+
+	targets = newTargetLabels(defaultMaxTargetLabels, defaultTargetLabelIdle,
+		proxyRequests.MetricVec, proxyRequestDuration.MetricVec, upstreamDuration.MetricVec, retryAttempts.MetricVec, coldStartWait.MetricVec, coldStarts.MetricVec, abandonedWaits.MetricVec, inFlightRequests.MetricVec,
+		breakerStates.MetricVec, breakerRejected.MetricVec)
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "gozero_request_buffer_length",
+			Help: "Scale up events waiting in the request buffer.",
+		}, func() float64 {
+			if length := requestBufferLength.Load(); length != nil {
+				return float64((*length)())
+			}
+			return 0
+		}),
+	)
+}
+
+// SetTargetLabelLimit sets how many targets get their own label, the rest are counted as "other".
+// Targets which were not seen for a while give up their label.
+func SetTargetLabelLimit(limit int) {
+	targets.setLimit(limit)
+}
+
+// AddConfiguredTargets always gives the targets their own label, e.g. the targets of the route table
+func AddConfiguredTargets(hosts ...string) {
+	targets.configure(hosts...)
+}
+
+// SetRequestBufferLength reports the length of the request buffer of the proxy
+func SetRequestBufferLength(length func() int) {
+	requestBufferLength.Store(&length)
+}
+
+// ObserveProxyRequest records a proxied request to the target, which is a host with or without port
+func ObserveProxyRequest(target string, code int, duration time.Duration) {
+	label := targets.label(target)
+	proxyRequests.WithLabelValues(label, strconv.Itoa(code)).Inc()
+	proxyRequestDuration.WithLabelValues(label).Observe(duration.Seconds())
+}
+
+// ObserveRejectedRequest records a request which was not proxied
+func ObserveRejectedRequest(reason string) {
+	proxyRejected.WithLabelValues(reason).Inc()
+}
+
+// ObserveUpstream records a single attempt to the target
+func ObserveUpstream(target string, duration time.Duration) {
+	upstreamDuration.WithLabelValues(targets.label(target)).Observe(duration.Seconds())
+}
+
+// ObserveRetryAttempt records an attempt to reach a target which is not ready yet
+func ObserveRetryAttempt(target string) {
+	retryAttempts.WithLabelValues(targets.label(target)).Inc()
+}
+
+// ObserveColdStartWait records how long a request waited for a cold target and how it ended
+func ObserveColdStartWait(target, outcome string, duration time.Duration) {
+	coldStartWait.WithLabelValues(targets.label(target), outcome).Observe(duration.Seconds())
+}
+
+// ObserveColdStart records how long a cold target took to serve its first successful response
+func ObserveColdStart(target, reason string, duration time.Duration) {
+	coldStarts.WithLabelValues(targets.label(target), reason).Observe(duration.Seconds())
+}
+
+// ObserveAbandonedWait records a request whose client gave up waiting for a cold target
+func ObserveAbandonedWait(target, reason string) {
+	abandonedWaits.WithLabelValues(targets.label(target), reason).Inc()
+}
+
+// ObserveInFlight adds a request in flight of the target with delta 1 and removes it with -1,
+// the target keeps its label while it has requests in flight
+func ObserveInFlight(target string, delta int) {
+	if delta > 0 {
+		inFlightRequests.WithLabelValues(targets.pin(target)).Inc()
+		return
+	}
+	inFlightRequests.WithLabelValues(targets.unpin(target)).Dec()
+}
+
+// ObserveBreakerState records that the circuit breaker of the target changed its state, closed breakers aren't counted
+func ObserveBreakerState(target, from, to string) {
+	// The target keeps its label while its breaker isn't closed
+	var label string
+	switch {
+	case from == "closed":
+		label = targets.pin(target)
+	case to == "closed":
+		label = targets.unpin(target)
+	default:
+		label = targets.label(target)
+	}
+
+	if from != "closed" {
+		breakerStates.WithLabelValues(label, from).Dec()
+	}
+	if to != "closed" {
+		breakerStates.WithLabelValues(label, to).Inc()
+	}
+}
+
+// ObserveBreakerRejected records a request which failed fast because the circuit breaker of the target was open
+func ObserveBreakerRejected(target string) {
+	breakerRejected.WithLabelValues(targets.label(target)).Inc()
+}
+
+// ObserveDroppedEvent records a scale up event which was dropped
+func ObserveDroppedEvent() {
+	droppedEvents.Inc()
+}
+
+// ObserveStoreOperation records the latency of a store operation and whether it failed
+func ObserveStoreOperation(operation string, duration time.Duration, err error) {
+	storeDuration.WithLabelValues(operation).Observe(duration.Seconds())
+	if err != nil {
+		storeErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// targetLabels bounds the number of target label values. Configured targets always get a label,
+// others get one while there is room, idle ones are evicted to make room.
+// Targets with gauges which are not zero are pinned, they keep their label until the gauges are back at zero.
+type targetLabels struct {
+	vecs []*prometheus.MetricVec
+
+	mu         sync.Mutex
+	limit      int
+	idle       time.Duration
+	configured map[string]struct{}
+	seen       map[string]time.Time
+	pinned     map[string]*pinnedLabel
+}
+
+// pinnedLabel is the label of a target with gauges which are not zero
+type pinnedLabel struct {
+	label string
+	count int
+}
+
+func newTargetLabels(limit int, idle time.Duration, vecs ...*prometheus.MetricVec) *targetLabels {
+	return &targetLabels{
+		vecs:       vecs,
+		limit:      limit,
+		idle:       idle,
+		configured: make(map[string]struct{}),
+		seen:       make(map[string]time.Time),
+		pinned:     make(map[string]*pinnedLabel),
+	}
+}
+
+func (l *targetLabels) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+}
+
+func (l *targetLabels) configure(hosts ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, host := range hosts {
+		l.configured[targetHost(host)] = struct{}{}
+	}
+}
+
+func (l *targetLabels) label(target string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.labelOf(targetHost(target))
+}
+
+// pin returns the label of the target and keeps it until unpin is called as often as pin
+func (l *targetLabels) pin(target string) string {
+	host := targetHost(target)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.pinned[host]
+	if !ok {
+		p = &pinnedLabel{label: l.labelOf(host)}
+		l.pinned[host] = p
+	}
+	p.count++
+	return p.label
+}
+
+// unpin releases the label of the target pinned by pin and returns it
+func (l *targetLabels) unpin(target string) string {
+	host := targetHost(target)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p, ok := l.pinned[host]
+	if !ok {
+		return l.labelOf(host)
+	}
+	p.count--
+	if p.count == 0 {
+		delete(l.pinned, host)
+	}
+	return p.label
+}
+
+// labelOf returns the label of the host, l.mu must be held
+func (l *targetLabels) labelOf(host string) string {
+	now := time.Now()
+
+	if _, ok := l.configured[host]; ok {
+		return host
+	}
+	if p, ok := l.pinned[host]; ok {
+		if p.label == host {
+			l.seen[host] = now
+		}
+		return p.label
+	}
+	if _, ok := l.seen[host]; ok {
+		l.seen[host] = now
+		return host
+	}
+
+	if len(l.seen) >= l.limit {
+		l.evictIdle(now)
+	}
+	if len(l.seen) >= l.limit {
+		return otherTargetLabel
+	}
+
+	l.seen[host] = now
+	return host
+}
+
+// evictIdle drops the labels of targets which were not seen for a while, l.mu must be held
+func (l *targetLabels) evictIdle(now time.Time) {
+	for host, lastSeen := range l.seen {
+		if _, ok := l.pinned[host]; ok || now.Sub(lastSeen) < l.idle {
+			continue
+		}
+		delete(l.seen, host)
+		for _, vec := range l.vecs {
+			vec.DeletePartialMatch(prometheus.Labels{"target": host})
+		}
+	}
+}
+
+func targetHost(target string) string {
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		return host
+	}
+	return target
+}
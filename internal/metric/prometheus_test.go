@@ -0,0 +1,72 @@
+package metric
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTargetLabelsAreBounded(t *testing.T) {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total"}, []string{"target"})
+	labels := newTargetLabels(2, time.Hour, vec.MetricVec)
+	labels.configure("app.svc:80")
+
+	for _, target := range []string{"a.svc:80", "b.svc:80", "c.svc:80", "app.svc:8080"} {
+		vec.WithLabelValues(labels.label(target)).Inc()
+	}
+
+	if got := testutil.ToFloat64(vec.WithLabelValues(otherTargetLabel)); got != 1 {
+		t.Errorf("expected 1 request counted as %s, got %v", otherTargetLabel, got)
+	}
+	// Configured targets don't count against the limit
+	if got := testutil.ToFloat64(vec.WithLabelValues("app.svc")); got != 1 {
+		t.Errorf("expected 1 request for the configured target, got %v", got)
+	}
+	if got := testutil.CollectAndCount(vec); got != 4 {
+		t.Errorf("expected 4 label values, got %d", got)
+	}
+}
+
+func TestTargetLabelsEvictIdle(t *testing.T) {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total"}, []string{"target"})
+	labels := newTargetLabels(1, 0, vec.MetricVec)
+
+	vec.WithLabelValues(labels.label("a.svc:80")).Inc()
+	// a.svc is idle right away and makes room for b.svc
+	vec.WithLabelValues(labels.label("b.svc:80")).Inc()
+
+	if got := testutil.CollectAndCount(vec); got != 1 {
+		t.Errorf("expected 1 label value, got %d", got)
+	}
+	if got := testutil.ToFloat64(vec.WithLabelValues("b.svc")); got != 1 {
+		t.Errorf("expected 1 request for b.svc, got %v", got)
+	}
+}
+
+func TestTargetLabelsKeepPinned(t *testing.T) {
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_in_flight"}, []string{"target"})
+	labels := newTargetLabels(1, 0, gauge.MetricVec)
+
+	// a.svc has a request in flight, so b.svc can't take its label although it is idle
+	gauge.WithLabelValues(labels.pin("a.svc:80")).Inc()
+	gauge.WithLabelValues(labels.pin("b.svc:80")).Inc()
+	if got := testutil.ToFloat64(gauge.WithLabelValues(otherTargetLabel)); got != 1 {
+		t.Errorf("expected b.svc to be counted as %s, got %v", otherTargetLabel, got)
+	}
+
+	// The requests end in the series they started in
+	gauge.WithLabelValues(labels.unpin("a.svc:80")).Dec()
+	gauge.WithLabelValues(labels.unpin("b.svc:80")).Dec()
+	for _, label := range []string{"a.svc", otherTargetLabel} {
+		if got := testutil.ToFloat64(gauge.WithLabelValues(label)); got != 0 {
+			t.Errorf("expected no requests in flight for %s, got %v", label, got)
+		}
+	}
+
+	// Once nothing is in flight, the label can be evicted
+	if label := labels.label("b.svc:80"); label != "b.svc" {
+		t.Errorf("expected b.svc to get its own label, got %s", label)
+	}
+}
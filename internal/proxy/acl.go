@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// errTargetForbidden is returned when the target is rejected by the allowlist or denylist
+	errTargetForbidden = errors.New("target is not allowed")
+	// errTargetLookup is returned when the target host couldn't be resolved, the decision is not cached
+	errTargetLookup = errors.New("failed to resolve target")
+)
+
+// defaultDeniedTargets are loopback, unspecified, link-local and IPv6 unique local targets, e.g. the cloud metadata
+// endpoint. They are denied unless they are explicitly allowed. RFC 1918 ranges aren't, in-cluster Services use them.
+var defaultDeniedTargets = []string{
+	"localhost",
+	"127.0.0.0/8",
+	"::1/128",
+	"0.0.0.0/8",
+	"::/128",
+	"169.254.0.0/16",
+	"fe80::/10",
+	"fc00::/7",
+}
+
+// targetRules is a set of hosts, DNS suffixes and CIDRs
+type targetRules struct {
+	hosts    map[string]struct{}
+	suffixes []string
+	cidrs    []*net.IPNet
+}
+
+func parseTargetRules(entries []string) (*targetRules, error) {
+	rules := &targetRules{hosts: make(map[string]struct{})}
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+			continue
+		case strings.Contains(entry, "/"):
+			_, cidr, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target CIDR %q: %w", entry, err)
+			}
+			rules.cidrs = append(rules.cidrs, cidr)
+		case net.ParseIP(entry) != nil:
+			ip := net.ParseIP(entry)
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			rules.cidrs = append(rules.cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		case strings.HasPrefix(entry, "*."):
+			rules.suffixes = append(rules.suffixes, entry[1:])
+		default:
+			rules.hosts[entry] = struct{}{}
+		}
+	}
+	return rules, nil
+}
+
+func (r *targetRules) empty() bool {
+	return len(r.hosts) == 0 && len(r.suffixes) == 0 && len(r.cidrs) == 0
+}
+
+func (r *targetRules) matchName(host string) bool {
+	if _, ok := r.hosts[host]; ok {
+		return true
+	}
+	for _, suffix := range r.suffixes {
+		if strings.HasSuffix(host, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *targetRules) matchIP(ip net.IP) bool {
+	for _, cidr := range r.cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclDecision is a cached result of checking a target
+type aclDecision struct {
+	err     error
+	expires time.Time
+}
+
+// targetACL decides which targets the proxy is allowed to forward requests to.
+// Explicit denies win over explicit allows, which win over the default denies.
+// If an allowlist is set, anything it doesn't match is denied.
+// Names are always resolved, the addresses they point to must pass the denylist and the default denies too.
+type targetACL struct {
+	allow         *targetRules
+	deny          *targetRules
+	defaultDeny   *targetRules
+	ports         map[int]struct{}
+	lookupIP      func(ctx context.Context, host string) ([]net.IP, error)
+	cacheDuration time.Duration
+
+	mu    sync.Mutex
+	cache map[string]aclDecision
+}
+
+func newTargetACL(allow, deny []string, ports []int) (*targetACL, error) {
+	allowRules, err := parseTargetRules(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyRules, err := parseTargetRules(deny)
+	if err != nil {
+		return nil, err
+	}
+	defaultDenyRules, err := parseTargetRules(defaultDeniedTargets)
+	if err != nil {
+		return nil, err
+	}
+
+	allowedPorts := make(map[int]struct{}, len(ports))
+	for _, port := range ports {
+		allowedPorts[port] = struct{}{}
+	}
+
+	return &targetACL{
+		allow:       allowRules,
+		deny:        denyRules,
+		defaultDeny: defaultDenyRules,
+		ports:       allowedPorts,
+		lookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
+		cacheDuration: defaultACLCacheDuration,
+		cache:         make(map[string]aclDecision),
+	}, nil
+}
+
+// check returns an error wrapping errTargetForbidden if requests must not be sent to the target
+func (a *targetACL) check(ctx context.Context, t *target) error {
+	// A fully qualified name with a trailing dot is the same host
+	host := strings.TrimSuffix(strings.ToLower(t.host), ".")
+	key := net.JoinHostPort(host, t.port)
+
+	a.mu.Lock()
+	decision, ok := a.cache[key]
+	a.mu.Unlock()
+	if ok && time.Now().Before(decision.expires) {
+		return decision.err
+	}
+
+	err := a.evaluate(ctx, host, t.port)
+	if errors.Is(err, errTargetLookup) {
+		return err
+	}
+
+	a.mu.Lock()
+	// Targets come from the clients, don't let them grow the cache without bounds
+	if len(a.cache) >= maxACLCacheSize {
+		a.cache = make(map[string]aclDecision)
+	}
+	a.cache[key] = aclDecision{err: err, expires: time.Now().Add(a.cacheDuration)}
+	a.mu.Unlock()
+
+	return err
+}
+
+func (a *targetACL) evaluate(ctx context.Context, host, port string) error {
+	if len(a.ports) > 0 {
+		p, err := strconv.Atoi(port)
+		if _, ok := a.ports[p]; err != nil || !ok {
+			return fmt.Errorf("%w: port %s is not allowed", errTargetForbidden, port)
+		}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return a.evaluateIP(host, ip, false, false)
+	}
+
+	if a.deny.matchName(host) {
+		return fmt.Errorf("%w: host %s is denied", errTargetForbidden, host)
+	}
+	allowed := a.allow.matchName(host)
+	deniedByDefault := a.defaultDeny.matchName(host)
+	if deniedByDefault && !allowed {
+		return fmt.Errorf("%w: host %s is denied by default", errTargetForbidden, host)
+	}
+	if !allowed && !a.allow.empty() && len(a.allow.cidrs) == 0 {
+		return fmt.Errorf("%w: host %s is not in the allowlist", errTargetForbidden, host)
+	}
+
+	// Even an allowed name may point to a denied address, check where it points to
+	lookupCtx, cancel := context.WithTimeout(ctx, defaultACLLookupTimeout)
+	defer cancel()
+	ips, err := a.lookupIP(lookupCtx, host)
+	if err != nil {
+		return fmt.Errorf("%w: %w %s: %v", errTargetForbidden, errTargetLookup, host, err)
+	}
+	for _, ip := range ips {
+		// Only a name which is denied by default and was allowed anyway, like localhost, may point to such addresses
+		if err := a.evaluateIP(host, ip, allowed, allowed && deniedByDefault); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// evaluateIP checks an address of the host. nameAllowed tells that the allowlist matched the name of the host,
+// defaultAllowed that it lifted the default denies for it.
+func (a *targetACL) evaluateIP(host string, ip net.IP, nameAllowed, defaultAllowed bool) error {
+	switch {
+	case a.deny.matchIP(ip):
+		return fmt.Errorf("%w: host %s (%s) is denied", errTargetForbidden, host, ip)
+	case a.allow.matchIP(ip):
+		return nil
+	case a.defaultDeny.matchIP(ip) && !defaultAllowed:
+		return fmt.Errorf("%w: host %s (%s) is denied by default", errTargetForbidden, host, ip)
+	case !a.allow.empty() && !nameAllowed:
+		return fmt.Errorf("%w: host %s (%s) is not in the allowlist", errTargetForbidden, host, ip)
+	}
+	return nil
+}
+
+// dialControl checks the address a connection to the host is made to. The name is resolved again when it is dialed
+// and may point to another address than the one check resolved, e.g. after a DNS rebinding.
+func (a *targetACL) dialControl(host string) func(network, address string, c syscall.RawConn) error {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	named := net.ParseIP(host) == nil
+	allowed := named && a.allow.matchName(host)
+	deniedByDefault := named && a.defaultDeny.matchName(host)
+
+	return func(network, address string, c syscall.RawConn) error {
+		ip, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return fmt.Errorf("%w: invalid address %s: %v", errTargetForbidden, address, err)
+		}
+		return a.evaluateIP(host, net.ParseIP(ip), allowed, allowed && deniedByDefault)
+	}
+}
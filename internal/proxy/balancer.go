@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/araminian/gozero/internal/config"
+	"github.com/araminian/gozero/internal/route"
+)
+
+// errNoEndpoints is returned while the balancer knows no endpoint of the target, e.g. it is scaled to zero
+var errNoEndpoints = errors.New("target has no endpoints")
+
+// endpoint is an address of a target the requests are balanced over
+type endpoint struct {
+	addr string
+	// active are the requests in flight to the endpoint
+	active atomic.Int64
+	// failedUntil is when an endpoint which failed is tried again, in unix nanoseconds
+	failedUntil atomic.Int64
+}
+
+// balancer spreads the requests of a target over its endpoints. Endpoints which fail are left out
+// for the failure timeout, if all of them failed they are all tried.
+type balancer struct {
+	cfg            route.Balancer
+	port           string
+	refresh        time.Duration
+	failureTimeout time.Duration
+	lookupHost     func(ctx context.Context, host string) ([]string, error)
+	lookupSRV      func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	next           atomic.Uint64
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+	resolved  time.Time
+	// resolving is set while a lookup runs, so there is only one at a time
+	resolving bool
+	// lookupFailed is set while the lookups fail, so a failing resolver is only logged once
+	lookupFailed bool
+}
+
+// newBalancer creates the balancer of a route target, port is used for the endpoints resolved from A records
+func newBalancer(cfg *route.Balancer, port string) *balancer {
+	b := &balancer{
+		cfg:            *cfg,
+		port:           port,
+		refresh:        defaultBalancerRefresh,
+		failureTimeout: defaultEndpointFailureTimeout,
+		lookupHost:     net.DefaultResolver.LookupHost,
+		lookupSRV:      net.DefaultResolver.LookupSRV,
+	}
+	if cfg.Refresh > 0 {
+		b.refresh = cfg.Refresh
+	}
+	if cfg.FailureTimeout > 0 {
+		b.failureTimeout = cfg.FailureTimeout
+	}
+	for _, addr := range cfg.Endpoints {
+		b.endpoints = append(b.endpoints, &endpoint{addr: addr})
+	}
+	return b
+}
+
+// current returns the known endpoints. Resolved endpoints are refreshed in the background once they are stale,
+// without endpoints they are resolved right away, but at most once per second.
+// The lookups run without holding b.mu, so a slow resolver never blocks the other requests.
+func (b *balancer) current(ctx context.Context) []*endpoint {
+	b.mu.Lock()
+	if len(b.cfg.Endpoints) > 0 {
+		defer b.mu.Unlock()
+		return b.endpoints
+	}
+
+	endpoints := b.endpoints
+	since := time.Since(b.resolved)
+	switch {
+	case b.resolving:
+	case len(endpoints) == 0 && since >= minResolveInterval:
+		b.resolving = true
+		b.mu.Unlock()
+		b.resolve(ctx)
+		b.mu.Lock()
+		endpoints = b.endpoints
+	case since >= b.refresh:
+		b.resolving = true
+		go b.resolve(context.Background())
+	}
+	b.mu.Unlock()
+	return endpoints
+}
+
+// resolve looks up the endpoints, it keeps the state of endpoints which are still there.
+// If the lookup fails, the previous endpoints are kept.
+func (b *balancer) resolve(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, defaultResolveTimeout)
+	defer cancel()
+	addrs, err := b.lookup(ctx)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.resolved = time.Now()
+	b.resolving = false
+	if err != nil {
+		if !b.lookupFailed {
+			config.Log.Warn("Failed to resolve endpoints of target", zap.String("dns", b.cfg.DNS), zap.String("srv", b.cfg.SRV), zap.Error(err))
+		}
+		b.lookupFailed = true
+		return
+	}
+	if b.lookupFailed {
+		config.Log.Info("Resolved endpoints of target again", zap.String("dns", b.cfg.DNS), zap.String("srv", b.cfg.SRV))
+	}
+	b.lookupFailed = false
+
+	known := make(map[string]*endpoint, len(b.endpoints))
+	for _, e := range b.endpoints {
+		known[e.addr] = e
+	}
+	endpoints := make([]*endpoint, 0, len(addrs))
+	for _, addr := range addrs {
+		e, ok := known[addr]
+		if !ok {
+			e = &endpoint{addr: addr}
+		}
+		endpoints = append(endpoints, e)
+	}
+	b.endpoints = endpoints
+}
+
+// lookup returns the addresses of the endpoints from DNS
+func (b *balancer) lookup(ctx context.Context) ([]string, error) {
+	var addrs []string
+	if b.cfg.SRV != "" {
+		_, records, err := b.lookupSRV(ctx, "", "", b.cfg.SRV)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			addrs = append(addrs, net.JoinHostPort(record.Target, strconv.Itoa(int(record.Port))))
+		}
+		return addrs, nil
+	}
+
+	hosts, err := b.lookupHost(ctx, b.cfg.DNS)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		addrs = append(addrs, net.JoinHostPort(host, b.port))
+	}
+	return addrs, nil
+}
+
+// pick chooses the endpoint for the request by the policy of the balancer
+func (b *balancer) pick(req *http.Request) (*endpoint, error) {
+	all := b.current(req.Context())
+	if len(all) == 0 {
+		return nil, errNoEndpoints
+	}
+
+	now := time.Now().UnixNano()
+	healthy := make([]*endpoint, 0, len(all))
+	for _, e := range all {
+		if e.failedUntil.Load() <= now {
+			healthy = append(healthy, e)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = all
+	}
+
+	switch b.cfg.Policy {
+	case route.PolicyHash:
+		if key := b.hashKey(req); key != "" {
+			return rendezvous(healthy, key), nil
+		}
+	case route.PolicyLeastConnections:
+		// Start at the next endpoint in turn, so endpoints with the same count share the requests
+		start := int(b.next.Add(1) % uint64(len(healthy)))
+		least := healthy[start]
+		for i := 1; i < len(healthy); i++ {
+			if e := healthy[(start+i)%len(healthy)]; e.active.Load() < least.active.Load() {
+				least = e
+			}
+		}
+		return least, nil
+	}
+
+	return healthy[b.next.Add(1)%uint64(len(healthy))], nil
+}
+
+// hashKey is the header or cookie value requests are hashed by, empty if the request has none
+func (b *balancer) hashKey(req *http.Request) string {
+	if b.cfg.HashHeader != "" {
+		if key := req.Header.Get(b.cfg.HashHeader); key != "" {
+			return key
+		}
+	}
+	if b.cfg.HashCookie != "" {
+		if cookie, err := req.Cookie(b.cfg.HashCookie); err == nil {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// rendezvous picks the endpoint with the highest hash of key and address,
+// so a key only moves to another endpoint if its endpoint goes away
+func rendezvous(endpoints []*endpoint, key string) *endpoint {
+	var best *endpoint
+	var bestScore uint64
+	for _, e := range endpoints {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(e.addr))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = e, score
+		}
+	}
+	return best
+}
+
+// done ends a request to the endpoint, an endpoint which failed is left out for the failure timeout
+func (b *balancer) done(e *endpoint, err error) {
+	e.active.Add(-1)
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return
+	}
+	b.markFailed(e, err)
+}
+
+// markFailed leaves the endpoint out for the failure timeout, it only logs if the endpoint wasn't left out already
+func (b *balancer) markFailed(e *endpoint, err error) {
+	now := time.Now()
+	if e.failedUntil.Swap(now.Add(b.failureTimeout).UnixNano()) > now.UnixNano() {
+		return
+	}
+	config.Log.Warn("Endpoint failed, leaving it out", zap.String("endpoint", e.addr), zap.Duration("for", b.failureTimeout), zap.Error(err))
+}
+
+// endpointBody ends the request to the endpoint once the response body is closed
+type endpointBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *endpointBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// endpointUpgradeBody is the endpointBody of an upgraded connection, the reverse proxy writes to it
+type endpointUpgradeBody struct {
+	io.ReadWriteCloser
+	once sync.Once
+	done func()
+}
+
+func (b *endpointUpgradeBody) Close() error {
+	err := b.ReadWriteCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// trackBody calls done once the response body is closed
+func trackBody(body io.ReadCloser, done func()) io.ReadCloser {
+	if rwc, ok := body.(io.ReadWriteCloser); ok {
+		return &endpointUpgradeBody{ReadWriteCloser: rwc, done: done}
+	}
+	return &endpointBody{ReadCloser: body, done: done}
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/araminian/gozero/internal/config"
+	"github.com/araminian/gozero/internal/metric"
+)
+
+// errBreakerOpen is returned right away for a target whose requests failed too often in a row
+var errBreakerOpen = errors.New("circuit breaker is open")
+
+// States of the circuit breaker of a target
+const (
+	// BreakerClosed means requests are sent to the target
+	BreakerClosed = "closed"
+	// BreakerOpen means requests fail fast until the cool-off is over
+	BreakerOpen = "open"
+	// BreakerHalfOpen means a single request probes the target, the others fail fast
+	BreakerHalfOpen = "half-open"
+)
+
+// TargetBreaker is the state of the circuit breaker of a target
+type TargetBreaker struct {
+	State string `json:"state"`
+	// Since is when the breaker got into the state
+	Since time.Time `json:"since"`
+	// Failures are the requests which failed in a row
+	Failures  int    `json:"failures"`
+	LastError string `json:"lastError,omitempty"`
+	// RetryAt is when an open breaker lets a request probe the target
+	RetryAt time.Time `json:"retryAt,omitempty"`
+}
+
+// breakers are the circuit breakers of the targets. A breaker only exists while its target failed,
+// it is dropped once its target serves a request again, or once nobody asked for the target for a cool-off.
+// Unlike the breaker of go-resiliency, a success resets the failures and the failures don't need to be
+// within the cool-off of each other.
+type breakers struct {
+	threshold int
+	coolOff   time.Duration
+
+	mu     sync.Mutex
+	byHost map[string]*breaker
+}
+
+// breaker is the circuit breaker of a single target
+type breaker struct {
+	host    string
+	health  TargetBreaker
+	probing bool
+	// failed is when the target failed last
+	failed time.Time
+}
+
+// newBreakers creates the breakers which open after threshold failures in a row, zero turns them off
+func newBreakers(threshold int, coolOff time.Duration) *breakers {
+	return &breakers{
+		threshold: threshold,
+		coolOff:   coolOff,
+		byHost:    make(map[string]*breaker),
+	}
+}
+
+// allow returns an error if the breaker of the host is open. Once the cool-off is over,
+// the first request probes the target and the others keep failing until it is done.
+// The returned func reports the outcome of an allowed request.
+func (b *breakers) allow(host string) (func(err error, verdict bool), error) {
+	if b.threshold == 0 {
+		return func(error, bool) {}, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br, ok := b.byHost[host]
+	if !ok {
+		return func(err error, verdict bool) { b.done(host, false, err, verdict) }, nil
+	}
+
+	if br.health.State == BreakerOpen && !time.Now().Before(br.health.RetryAt) {
+		b.setState(br, BreakerHalfOpen)
+	}
+	if br.health.State == BreakerOpen || (br.health.State == BreakerHalfOpen && br.probing) {
+		metric.ObserveBreakerRejected(host)
+		return nil, fmt.Errorf("%w: service '%s' failed %d requests in a row, last with: %s. Retrying it at %s",
+			errBreakerOpen, host, br.health.Failures, br.health.LastError, br.health.RetryAt.Format(time.RFC3339))
+	}
+
+	probe := br.health.State == BreakerHalfOpen
+	br.probing = probe
+	return func(err error, verdict bool) { b.done(host, probe, err, verdict) }, nil
+}
+
+// failed records a failure of the target which isn't tied to a single request, e.g. a prober which gave up
+func (b *breakers) failed(host string, err error) {
+	if b.threshold == 0 {
+		return
+	}
+	b.done(host, false, err, true)
+}
+
+// done records the outcome of a request. Without a verdict, e.g. the waiting page was returned
+// or the client gave up, a probe only makes room for the next one.
+func (b *breakers) done(host string, probe bool, err error, verdict bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br, ok := b.byHost[host]
+	if probe && ok {
+		br.probing = false
+	}
+	if !verdict || !isTargetFailure(err) {
+		if verdict && err == nil && ok {
+			if br.health.State != BreakerClosed {
+				config.Log.Info("Service recovered, closing circuit breaker", zap.String("to", host))
+			}
+			b.setState(br, BreakerClosed)
+			delete(b.byHost, host)
+		}
+		return
+	}
+
+	if !ok {
+		b.expire()
+		br = &breaker{host: host, health: TargetBreaker{State: BreakerClosed, Since: time.Now()}}
+		b.byHost[host] = br
+	}
+	br.failed = time.Now()
+	br.health.Failures++
+	br.health.LastError = err.Error()
+
+	// A request which was allowed before the breaker opened doesn't extend the cool-off
+	if br.health.State == BreakerOpen {
+		return
+	}
+	if br.health.State == BreakerHalfOpen || br.health.Failures >= b.threshold {
+		config.Log.Warn("Service failed too often, opening circuit breaker", zap.String("to", host), zap.Int("failures", br.health.Failures), zap.Duration("for", b.coolOff), zap.Error(err))
+		br.health.RetryAt = time.Now().Add(b.coolOff)
+		b.setState(br, BreakerOpen)
+	}
+}
+
+// setState changes the state, b.mu must be held
+func (b *breakers) setState(br *breaker, state string) {
+	if br.health.State == state {
+		return
+	}
+	metric.ObserveBreakerState(br.host, br.health.State, state)
+	br.health.State = state
+	br.health.Since = time.Now()
+}
+
+// expire drops the breakers of targets nobody asked for since a cool-off: closed breakers whose last failure
+// is that old, and open breakers which nobody probed for a cool-off after they could have. Otherwise targets
+// which never come up, e.g. typos in the target header, would be kept forever. b.mu must be held.
+func (b *breakers) expire() {
+	now := time.Now()
+	for host, br := range b.byHost {
+		idle := now.Sub(br.failed) > b.coolOff
+		if br.health.State != BreakerClosed {
+			idle = !br.probing && now.Sub(br.health.RetryAt) > b.coolOff
+		}
+		if idle {
+			b.setState(br, BreakerClosed)
+			delete(b.byHost, host)
+		}
+	}
+}
+
+// status returns the breakers of the targets which failed by host:port
+func (b *breakers) status() map[string]TargetBreaker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire()
+
+	status := make(map[string]TargetBreaker, len(b.byHost))
+	for host, br := range b.byHost {
+		status[host] = br.health
+	}
+	return status
+}
+
+// isTargetFailure reports whether the error means the target didn't serve the request at all.
+// Errors of the client and of a full waiting room say nothing about the target,
+// a target failing its health check already fails fast.
+func isTargetFailure(err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.Is(err, errQueueFull), errors.Is(err, errTargetFailing), errors.Is(err, errBreakerOpen):
+		return false
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/araminian/gozero/internal/config"
+)
+
+// certificateFiles is a certificate and its key as mounted from a secret
+type certificateFiles struct {
+	certFile string
+	keyFile  string
+}
+
+// fileVersion identifies the content of a file without reading it
+type fileVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+// certificates serves the certificates of the TLS listener and reloads them once their files change.
+// A reload only affects new handshakes, open connections keep the certificate they were set up with.
+type certificates struct {
+	files []certificateFiles
+
+	mu       sync.RWMutex
+	certs    []tls.Certificate
+	versions map[string]fileVersion
+}
+
+// newCertificates loads the certificates, the first one is served to clients which don't send a matching SNI
+func newCertificates(files []certificateFiles) (*certificates, error) {
+	c := &certificates{files: files}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load reads all certificates, it keeps the previous ones if any of them is broken
+func (c *certificates) load() error {
+	certs := make([]tls.Certificate, 0, len(c.files))
+	versions := make(map[string]fileVersion, 2*len(c.files))
+	for _, f := range c.files {
+		for _, file := range []string{f.certFile, f.keyFile} {
+			version, err := statFile(file)
+			if err != nil {
+				return err
+			}
+			versions[file] = version
+		}
+
+		cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate %s: %w", f.certFile, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	c.mu.Lock()
+	c.certs = certs
+	c.versions = versions
+	c.mu.Unlock()
+	return nil
+}
+
+// changed reports whether any certificate or key file changed since the last load.
+// Kubernetes swaps the symlink of a mounted secret, so the files are followed.
+func (c *certificates) changed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for file, loaded := range c.versions {
+		version, err := statFile(file)
+		if err != nil || version != loaded {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the certificates every interval if their files changed, until the context is done
+func (c *certificates) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !c.changed() {
+			continue
+		}
+		if err := c.load(); err != nil {
+			config.Log.Error("Failed to reload TLS certificates, keeping the previous ones", zap.Error(err))
+			continue
+		}
+		config.Log.Info("Reloaded TLS certificates", zap.Int("certificates", len(c.files)))
+	}
+}
+
+// getCertificate picks the certificate by the SNI of the client, the first certificate is the default
+func (c *certificates) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for i := range c.certs {
+		if hello.SupportsCertificate(&c.certs[i]) == nil {
+			return &c.certs[i], nil
+		}
+	}
+	return &c.certs[0], nil
+}
+
+// getClientCertificate picks the client certificate the target accepts, the first certificate is the default
+func (c *certificates) getClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for i := range c.certs {
+		if info.SupportsCertificate(&c.certs[i]) == nil {
+			return &c.certs[i], nil
+		}
+	}
+	return &c.certs[0], nil
+}
+
+// tlsConfig is the TLS configuration of the listener, it offers HTTP/2 and HTTP/1.1 over ALPN
+func (c *certificates) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: c.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+}
+
+func statFile(file string) (fileVersion, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fileVersion{}, fmt.Errorf("failed to stat %s: %w", file, err)
+	}
+	return fileVersion{size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+// newUpstreamTLSConfig is the TLS configuration for https targets. The CA file is trusted in addition
+// to the system CAs, the client certificates are presented to targets which ask for one (mTLS).
+func newUpstreamTLSConfig(caFile string, clientCerts *certificates) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in upstream CA file %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if clientCerts != nil {
+		cfg.GetClientCertificate = clientCerts.getClientCertificate
+	}
+
+	return cfg, nil
+}
@@ -1,22 +1,61 @@
 package proxy
 
-import "time"
+import (
+	"time"
 
+	"github.com/araminian/gozero/internal/route"
+)
+
+const (
+	defaultTimeout                = 10 * time.Minute
+	defaultPort                   = 8443
+	defaultBuffer                 = 1000
+	targetHostHeader              = "X-Gozero-Target-Host"
+	targetPortHeader              = "X-Gozero-Target-Port"
+	targetSchemeHeader            = "X-Gozero-Target-Scheme"
+	targetRetriesHeader           = "X-Gozero-Target-Retries"
+	targetBackoffHeader           = "X-Gozero-Target-Backoff"
+	targetTimeoutHeader           = "X-Gozero-Target-Timeout"
+	retryNonIdempotentHeader      = "X-Gozero-Retry-Non-Idempotent"
+	idleTimeoutHeader             = "X-Gozero-Idle-Timeout"
+	scaleValueHeader              = "X-Gozero-Scale-Value"
+	minActiveHeader               = "X-Gozero-Min-Active"
+	metricModeHeader              = "X-Gozero-Metric-Mode"
+	defaultTargetPort             = 443
+	defaultTargetScheme           = "https"
+	defaultMaxRetries             = 20
+	defaultInitialBackoff         = 100 * time.Millisecond
+	defaultMaxBackoff             = 5 * time.Second
+	defaultIdleTimeout            = 120 * time.Second
+	defaultTLSHandshakeTimeout    = 10 * time.Second
+	defaultResponseHeaderTimeout  = 30 * time.Second
+	defaultDialTimeout            = 300 * time.Second
+	defaultACLCacheDuration       = 30 * time.Second
+	defaultACLLookupTimeout       = 5 * time.Second
+	maxACLCacheSize               = 10000
+	defaultBalancerRefresh        = 30 * time.Second
+	defaultEndpointFailureTimeout = 10 * time.Second
+	minResolveInterval            = time.Second
+	defaultResolveTimeout         = 5 * time.Second
+	defaultHealthCheckInterval    = 5 * time.Second
+	defaultHealthCheckTimeout     = 2 * time.Second
+	defaultUnhealthyThreshold     = 3
+	defaultHealthCheckLinger      = 5 * time.Minute
+	defaultNotReadyBodyLimit      = 4096
+	notReadyProfileHeader         = "X-Gozero-Not-Ready-Profile"
+)
+
+// Defaults of the options of the proxy, the command uses them as the defaults of its env vars
 const (
-	defaultTimeout               = 10 * time.Minute
-	defaultPort                  = 8443
-	defaultBuffer                = 1000
-	targetHostHeader             = "X-Gozero-Target-Host"
-	targetPortHeader             = "X-Gozero-Target-Port"
-	targetSchemeHeader           = "X-Gozero-Target-Scheme"
-	targetRetriesHeader          = "X-Gozero-Target-Retries"
-	targetBackoffHeader          = "X-Gozero-Target-Backoff"
-	defaultTargetPort            = 443
-	defaultTargetScheme          = "https"
-	defaultMaxRetries            = 20
-	defaultInitialBackoff        = 100 * time.Millisecond
-	defaultIdleTimeout           = 120 * time.Second
-	defaultTLSHandshakeTimeout   = 10 * time.Second
-	defaultResponseHeaderTimeout = 30 * time.Second
-	defaultDialTimeout           = 300 * time.Second
+	DefaultQueueDepth         = 1000
+	DefaultMaxWait            = 5 * time.Minute
+	DefaultBodyBufferSize     = 1 << 20
+	DefaultWaitingPageRefresh = 5 * time.Second
+	DefaultTLSReloadInterval  = 30 * time.Second
+	DefaultNotReadyProfile    = route.ProfileIstio
+	DefaultBreakerThreshold   = 5
+	DefaultBreakerCoolOff     = 30 * time.Second
+	DefaultMaxIdleTimeout     = time.Hour
+	DefaultMaxMinActive       = time.Hour
+	DefaultMaxScaleValue      = 100
 )
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	grpcTimeoutHeader = "Grpc-Timeout"
+	grpcStatusHeader  = "Grpc-Status"
+	grpcMessageHeader = "Grpc-Message"
+)
+
+// isGRPC reports whether the request is a gRPC call
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcTimeout parses the grpc-timeout header of the client, e.g. 500m for 500 milliseconds
+func grpcTimeout(r *http.Request) (time.Duration, bool) {
+	value := r.Header.Get(grpcTimeoutHeader)
+	// At most 8 digits and the unit
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+
+	amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || amount < 0 {
+		return 0, false
+	}
+
+	var unit time.Duration
+	switch value[len(value)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, false
+	}
+
+	return time.Duration(amount) * unit, true
+}
+
+// grpcCode maps the error of a request which could not be proxied to a gRPC status code
+func grpcCode(err error) codes.Code {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, errTargetForbidden):
+		return codes.PermissionDenied
+	default:
+		return codes.Unavailable
+	}
+}
+
+// writeGRPCError writes a trailers-only gRPC response, so gRPC clients see the status
+// instead of an unexpected HTTP status and content type
+func writeGRPCError(w http.ResponseWriter, code codes.Code, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set(grpcStatusHeader, strconv.Itoa(int(code)))
+	w.Header().Set(grpcMessageHeader, encodeGRPCMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// encodeGRPCMessage percent-encodes the message as the gRPC spec requires for grpc-message
+func encodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
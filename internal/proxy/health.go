@@ -0,0 +1,329 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	"github.com/araminian/gozero/internal/config"
+	"github.com/araminian/gozero/internal/route"
+)
+
+// errTargetFailing is returned right away for a target which passed its health check and is failing it now
+var errTargetFailing = errors.New("service is failing its health check")
+
+// States of the health check of a target
+const (
+	// HealthIdle means the target got no requests for its idle timeout, it isn't checked
+	HealthIdle = "idle"
+	// HealthWaking means the target didn't pass a check since it is in use, requests wait for it
+	HealthWaking = "waking"
+	// HealthHealthy means the target passed the last check, requests are forwarded
+	HealthHealthy = "healthy"
+	// HealthFailing means the target was healthy and is failing its checks, requests fail fast
+	HealthFailing = "failing"
+)
+
+// TargetHealth is the state of the health check of a target
+type TargetHealth struct {
+	State string `json:"state"`
+	// Since is when the target got into the state
+	Since     time.Time `json:"since"`
+	LastCheck time.Time `json:"lastCheck,omitempty"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// healthChecker checks a target while it is in use, i.e. it got a request within its idle timeout
+type healthChecker struct {
+	cfg       route.HealthCheck
+	host      string
+	scheme    string
+	linger    time.Duration
+	balancer  *balancer
+	tlsConfig *tls.Config
+	client    *http.Client
+
+	// done stops the checks once the proxy shuts down
+	done     chan struct{}
+	stopOnce sync.Once
+
+	mu       sync.Mutex
+	running  bool
+	lastUsed time.Time
+	failures int
+	// passed is when the target passed a check last
+	passed  time.Time
+	checked chan struct{}
+	health  TargetHealth
+}
+
+// newHealthChecker creates the health checker of a route target. The TLS config is used for https targets.
+func newHealthChecker(cfg *route.HealthCheck, host, scheme string, linger time.Duration, b *balancer, tlsConfig *tls.Config) *healthChecker {
+	h := &healthChecker{
+		cfg:       *cfg,
+		host:      host,
+		scheme:    scheme,
+		linger:    linger,
+		balancer:  b,
+		tlsConfig: tlsConfig,
+		done:      make(chan struct{}),
+		health:    TargetHealth{State: HealthIdle, Since: time.Now()},
+	}
+	if h.cfg.Type == "" {
+		h.cfg.Type = route.HealthCheckHTTP
+	}
+	if h.cfg.Path == "" {
+		h.cfg.Path = "/"
+	}
+	if h.cfg.Interval == 0 {
+		h.cfg.Interval = defaultHealthCheckInterval
+	}
+	if h.cfg.Timeout == 0 {
+		h.cfg.Timeout = defaultHealthCheckTimeout
+	}
+	if h.cfg.UnhealthyThreshold == 0 {
+		h.cfg.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+
+	h.client = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true},
+		// A redirect is an answer, the target is up
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return h
+}
+
+// use marks the target as in use and waits for the first check if the checker just started
+func (h *healthChecker) use(ctx context.Context) string {
+	h.mu.Lock()
+	h.lastUsed = time.Now()
+	if !h.running {
+		h.running = true
+		h.failures = 0
+		h.checked = make(chan struct{})
+		h.setState(HealthWaking)
+		go h.run(h.checked)
+	}
+	checked := h.checked
+	h.mu.Unlock()
+
+	select {
+	case <-checked:
+	case <-ctx.Done():
+	}
+	return h.state()
+}
+
+// run checks the target every interval until it wasn't used for the linger time
+func (h *healthChecker) run(checked chan struct{}) {
+	config.Log.Debug("Starting health checks", zap.String("to", h.host), zap.String("type", h.cfg.Type))
+	_ = h.probe(context.Background())
+	close(checked)
+
+	ticker := time.NewTicker(h.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.done:
+			config.Log.Debug("Stopping health checks, the proxy is shutting down", zap.String("to", h.host))
+			return
+		}
+
+		h.mu.Lock()
+		if time.Since(h.lastUsed) > h.linger {
+			h.running = false
+			h.setState(HealthIdle)
+			h.mu.Unlock()
+			config.Log.Debug("Stopping health checks of unused target", zap.String("to", h.host))
+			return
+		}
+		h.mu.Unlock()
+
+		_ = h.probe(context.Background())
+	}
+}
+
+// stop ends the checks for good
+func (h *healthChecker) stop() {
+	h.stopOnce.Do(func() { close(h.done) })
+}
+
+// probe checks the target once, it is healthy if any of its endpoints passes the check
+func (h *healthChecker) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.Timeout)
+	defer cancel()
+
+	var err error
+	if h.balancer == nil {
+		err = h.check(ctx, h.host)
+	} else {
+		err = h.checkEndpoints(ctx)
+	}
+	h.report(err)
+	return err
+}
+
+// checkEndpoints checks every endpoint of the balancer, failing endpoints are left out until they pass again
+func (h *healthChecker) checkEndpoints(ctx context.Context) error {
+	endpoints := h.balancer.current(ctx)
+	if len(endpoints) == 0 {
+		return errNoEndpoints
+	}
+
+	errs := make([]error, len(endpoints))
+	var wg sync.WaitGroup
+	for i, e := range endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = h.check(ctx, e.addr)
+		}()
+	}
+	wg.Wait()
+
+	healthy := false
+	for i, e := range endpoints {
+		if errs[i] != nil {
+			h.balancer.markFailed(e, errs[i])
+			continue
+		}
+		if e.failedUntil.Swap(0) != 0 {
+			config.Log.Info("Endpoint passes its health check again", zap.String("endpoint", e.addr))
+		}
+		healthy = true
+	}
+	if !healthy {
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// check checks a single address of the target
+func (h *healthChecker) check(ctx context.Context, addr string) error {
+	switch h.cfg.Type {
+	case route.HealthCheckTCP:
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case route.HealthCheckGRPC:
+		return h.checkGRPC(ctx, addr)
+	default:
+		return h.checkHTTP(ctx, addr)
+	}
+}
+
+func (h *healthChecker) checkHTTP(ctx context.Context, addr string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s%s", h.scheme, addr, h.cfg.Path), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = h.host
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("health check of '%s' returned status %d", addr, resp.StatusCode)
+	}
+	return nil
+}
+
+func (h *healthChecker) checkGRPC(ctx context.Context, addr string) error {
+	creds := insecure.NewCredentials()
+	if h.scheme == "https" {
+		creds = credentials.NewTLS(h.tlsConfig)
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds), grpc.WithAuthority(h.host))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: h.cfg.Service})
+	if err != nil {
+		return err
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("health check of '%s' returned %s", addr, resp.GetStatus())
+	}
+	return nil
+}
+
+// report updates the state of the target with the result of a check
+func (h *healthChecker) report(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.health.LastCheck = time.Now()
+	if err == nil {
+		if h.health.State != HealthHealthy && h.health.State != HealthWaking {
+			config.Log.Info("Service passes its health check again", zap.String("to", h.host))
+		}
+		h.failures = 0
+		h.passed = h.health.LastCheck
+		h.health.LastError = ""
+		h.setState(HealthHealthy)
+		return
+	}
+
+	h.failures++
+	h.health.LastError = err.Error()
+	if h.health.State != HealthHealthy || h.failures < h.cfg.UnhealthyThreshold {
+		return
+	}
+	// A target without requests since it passed was likely scaled down for being idle
+	if h.lastUsed.Before(h.passed) {
+		config.Log.Info("Unused service is failing its health check, waking it with the next request", zap.String("to", h.host), zap.Error(err))
+		h.setState(HealthWaking)
+		return
+	}
+	config.Log.Warn("Service is failing its health check", zap.String("to", h.host), zap.Error(err))
+	h.setState(HealthFailing)
+}
+
+// setState changes the state, h.mu must be held
+func (h *healthChecker) setState(state string) {
+	if h.health.State != state {
+		h.health.State = state
+		h.health.Since = time.Now()
+	}
+}
+
+func (h *healthChecker) state() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.health.State
+}
+
+func (h *healthChecker) status() TargetHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.health
+}
+
+// schedule probes the target every interval while requests wait for it
+func (h *healthChecker) schedule(maxWait time.Duration) []time.Duration {
+	schedule := make([]time.Duration, int(maxWait/h.cfg.Interval)+1)
+	for i := range schedule {
+		schedule[i] = h.cfg.Interval
+	}
+	return schedule
+}
@@ -2,17 +2,25 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 
+	"github.com/araminian/gozero/internal/coldstart"
 	"github.com/araminian/gozero/internal/config"
+	"github.com/araminian/gozero/internal/metric"
+	"github.com/araminian/gozero/internal/route"
 )
 
 // NewHTTPReverseProxy creates a new HTTP reverse proxy with the given configuration
@@ -24,8 +32,11 @@ func NewHTTPReverseProxy(configs ...HTTPReverseProxyConfig) (*HTTPReverseProxy,
 		}
 	}
 	var (
-		listenPort        int = defaultPort
-		requestBufferSize int = defaultBuffer
+		listenPort        int           = defaultPort
+		requestBufferSize int           = defaultBuffer
+		queueDepth        int           = DefaultQueueDepth
+		maxWait           time.Duration = DefaultMaxWait
+		bodyBufferSize    int64         = DefaultBodyBufferSize
 	)
 
 	if cfg.listenPort != nil {
@@ -36,26 +47,245 @@ func NewHTTPReverseProxy(configs ...HTTPReverseProxyConfig) (*HTTPReverseProxy,
 		requestBufferSize = *cfg.requestBuffer
 	}
 
+	if cfg.queueDepth != nil {
+		queueDepth = *cfg.queueDepth
+	}
+
+	if cfg.maxWait != nil {
+		maxWait = *cfg.maxWait
+	}
+
+	if cfg.bodyBuffer != nil {
+		bodyBufferSize = *cfg.bodyBuffer
+	}
+
+	acl, err := newTargetACL(cfg.allowTargets, cfg.denyTargets, cfg.targetPorts)
+	if err != nil {
+		return nil, err
+	}
+
+	coldStarts := cfg.coldStarts
+	if coldStarts == nil {
+		if coldStarts, err = coldstart.NewTracker(); err != nil {
+			return nil, err
+		}
+	}
+
+	var page *waitingPage
+	if cfg.waitingPage != nil {
+		refresh := DefaultWaitingPageRefresh
+		if cfg.pageRefresh != nil {
+			refresh = *cfg.pageRefresh
+		}
+		if page, err = newWaitingPage(*cfg.waitingPage, refresh); err != nil {
+			return nil, err
+		}
+	}
+
+	var certs *certificates
+	if len(cfg.certificates) > 0 {
+		if certs, err = newCertificates(cfg.certificates); err != nil {
+			return nil, err
+		}
+	}
+
+	var clientCerts *certificates
+	if cfg.clientCert != nil {
+		if clientCerts, err = newCertificates([]certificateFiles{*cfg.clientCert}); err != nil {
+			return nil, err
+		}
+	}
+
+	upstreamCA := ""
+	if cfg.upstreamCA != nil {
+		upstreamCA = *cfg.upstreamCA
+	}
+	upstreamTLS, err := newUpstreamTLSConfig(upstreamCA, clientCerts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Balancers keep the state of the endpoints, so there is one per route target
+	balancers := make(map[*route.Target]*balancer)
+	if cfg.routes != nil {
+		for i := range cfg.routes.Routes {
+			t := &cfg.routes.Routes[i].Target
+			if t.Balancer == nil {
+				continue
+			}
+			port := defaultTargetPort
+			if t.Port != 0 {
+				port = t.Port
+			}
+			balancers[t] = newBalancer(t.Balancer, strconv.Itoa(port))
+		}
+	}
+
+	notReadyProfile := DefaultNotReadyProfile
+	if cfg.notReady != nil {
+		notReadyProfile = *cfg.notReady
+	}
+	profiles := make(map[string]*notReadyClassifier, len(profileRules))
+	for profile := range profileRules {
+		if profiles[profile], err = newNotReadyClassifier(profile, nil); err != nil {
+			return nil, err
+		}
+	}
+	classifiers := make(map[*route.Target]*notReadyClassifier)
+	if cfg.routes != nil {
+		for i := range cfg.routes.Routes {
+			t := &cfg.routes.Routes[i].Target
+			if t.NotReady == nil {
+				continue
+			}
+			if classifiers[t], err = newNotReadyClassifier(notReadyProfile, t.NotReady); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	healthChecks := make(map[*route.Target]*healthChecker)
+	if cfg.routes != nil {
+		for i := range cfg.routes.Routes {
+			t := &cfg.routes.Routes[i].Target
+			if t.HealthCheck != nil {
+				healthChecks[t] = newRouteHealthChecker(t, balancers[t], upstreamTLS)
+			}
+		}
+	}
+
+	tlsReload := DefaultTLSReloadInterval
+	if cfg.tlsReload != nil {
+		tlsReload = *cfg.tlsReload
+	}
+
+	breakerThreshold, breakerCoolOff := DefaultBreakerThreshold, DefaultBreakerCoolOff
+	if cfg.breakerThreshold != nil {
+		breakerThreshold = *cfg.breakerThreshold
+	}
+	if cfg.breakerCoolOff != nil {
+		breakerCoolOff = *cfg.breakerCoolOff
+	}
+	limits := scaleLimits{idleTimeout: DefaultMaxIdleTimeout, minActive: DefaultMaxMinActive, scaleValue: DefaultMaxScaleValue}
+	if cfg.maxIdleTimeout != nil {
+		limits.idleTimeout = *cfg.maxIdleTimeout
+	}
+	if cfg.maxMinActive != nil {
+		limits.minActive = *cfg.maxMinActive
+	}
+	if cfg.maxScaleValue != nil {
+		limits.scaleValue = *cfg.maxScaleValue
+	}
+
+	breakers := newBreakers(breakerThreshold, breakerCoolOff)
+	room := newWaitingRoom(queueDepth, maxWait)
+	room.onFailure = breakers.failed
+
 	return &HTTPReverseProxy{
 		listenPort:        listenPort,
 		requestBufferSize: requestBufferSize,
 		requestsCh:        make(chan Requests, requestBufferSize),
+		queueDepth:        queueDepth,
+		maxWait:           maxWait,
+		bodyBufferSize:    bodyBufferSize,
+		routes:            cfg.routes,
+		balancers:         balancers,
+		healthChecks:      healthChecks,
+		classifiers:       classifiers,
+		profiles:          profiles,
+		notReadyProfile:   notReadyProfile,
+		acl:               acl,
+		coldStarts:        coldStarts,
+		room:              room,
+		breakers:          breakers,
+		waitingPage:       page,
+		inFlight:          newInFlightTracker(),
+		certificates:      certs,
+		tlsReload:         tlsReload,
+		clientCerts:       clientCerts,
+		upstreamTLS:       upstreamTLS,
+		scaleLimits:       limits,
 	}, nil
 }
 
+// newRouteHealthChecker creates the health checker of a route target with its defaults
+func newRouteHealthChecker(t *route.Target, b *balancer, upstreamTLS *tls.Config) *healthChecker {
+	port := defaultTargetPort
+	if t.Port != 0 {
+		port = t.Port
+	}
+	scheme := defaultTargetScheme
+	if t.Scheme != "" {
+		scheme = t.Scheme
+	}
+	linger := defaultHealthCheckLinger
+	if t.IdleTimeout > 0 {
+		linger = t.IdleTimeout
+	}
+
+	tlsConfig := upstreamTLS.Clone()
+	tlsConfig.ServerName = t.Host
+	if t.ServerName != "" {
+		tlsConfig.ServerName = t.ServerName
+	}
+	tlsConfig.InsecureSkipVerify = t.InsecureSkipVerify
+
+	return newHealthChecker(t.HealthCheck, net.JoinHostPort(t.Host, strconv.Itoa(port)), scheme, linger, b, tlsConfig)
+}
+
+// Health returns the state of the health checks of the targets by host:port
+func (p *HTTPReverseProxy) Health() map[string]TargetHealth {
+	health := make(map[string]TargetHealth, len(p.healthChecks))
+	for _, h := range p.healthChecks {
+		health[h.host] = h.status()
+	}
+	return health
+}
+
+// Breakers returns the circuit breakers of the targets which failed recently by host:port
+func (p *HTTPReverseProxy) Breakers() map[string]TargetBreaker {
+	return p.breakers.status()
+}
+
 // Shutdown gracefully shuts down the proxy server
 func (p *HTTPReverseProxy) Shutdown(ctx context.Context) error {
 	close(p.requestsCh)
+	p.stopHealthChecks()
 	return p.httpServer.Shutdown(ctx)
 }
 
+// stopHealthChecks stops checking the targets of the route table
+func (p *HTTPReverseProxy) stopHealthChecks() {
+	for _, h := range p.healthChecks {
+		h.stop()
+	}
+}
+
 // handleProxyError handles errors that occur during proxying
 func (p *HTTPReverseProxy) handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if isGRPC(r) {
+		code := grpcCode(err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			err = fmt.Errorf("service did not become ready within the deadline of the call: %w", err)
+		}
+		config.Log.Debug("Returning gRPC error", zap.String("to", r.Host), zap.String("code", code.String()), zap.Error(err))
+		writeGRPCError(w, code, err.Error())
+		return
+	}
 	if r.URL.Scheme == "error" {
 		http.Error(w, "Service unavailable or starting up", http.StatusServiceUnavailable)
 		return
 	}
-	http.Error(w, err.Error(), http.StatusBadGateway)
+	switch {
+	case errors.Is(err, errTargetForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errQueueFull), errors.Is(err, errTargetFailing), errors.Is(err, errBreakerOpen):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, errWaitTimeout):
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
 }
 
 // modifyProxyResponse modifies the response before sending it back to the client
@@ -95,24 +325,42 @@ func (p *HTTPReverseProxy) modifyProxyResponse(r *http.Response) error {
 
 // Start starts the proxy server
 func (p *HTTPReverseProxy) Start(ctx context.Context) error {
-	transport := newConditionalTransport()
+	transport := newConditionalTransport(p.upstreamTLS, p.acl)
+	if p.clientCerts != nil {
+		go p.clientCerts.watch(ctx, p.tlsReload)
+	}
+	metric.SetRequestBufferLength(func() int { return len(p.requestsCh) })
 
 	proxy := &httputil.ReverseProxy{
 		Director:       p.httpDirector,
 		ErrorHandler:   p.handleProxyError,
 		ModifyResponse: p.modifyProxyResponse,
 		Transport: &retryRoundTripper{
-			next: transport,
+			next:           transport,
+			room:           p.room,
+			bodyBufferSize: p.bodyBufferSize,
+			coldStarts:     p.coldStarts,
+			waitingPage:    p.waitingPage,
+			breakers:       p.breakers,
+			notReady:       p.profiles[p.notReadyProfile],
 		},
 	}
 
 	h2s := &http2.Server{}
-	handler := h2c.NewHandler(proxy, h2s)
+	handler := p.routeHandler(proxy)
+	if p.certificates == nil {
+		// Without TLS, HTTP/2 is spoken in cleartext
+		handler = h2c.NewHandler(handler, h2s)
+	}
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", p.listenPort),
 		Handler: handler,
 	}
+	if p.certificates != nil {
+		server.TLSConfig = p.certificates.tlsConfig()
+		go p.certificates.watch(ctx, p.tlsReload)
+	}
 
 	err := http2.ConfigureServer(server, h2s)
 	if err != nil {
@@ -123,8 +371,13 @@ func (p *HTTPReverseProxy) Start(ctx context.Context) error {
 	p.httpServer = server
 
 	go func() {
-		config.Log.Info("Starting reverse proxy server", zap.Int("port", p.listenPort))
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		config.Log.Info("Starting reverse proxy server", zap.Int("port", p.listenPort), zap.Bool("tls", p.certificates != nil))
+		listen := server.ListenAndServe
+		if p.certificates != nil {
+			// The certificates come from the TLS config
+			listen = func() error { return server.ListenAndServeTLS("", "") }
+		}
+		if err := listen(); err != nil && err != http.ErrServerClosed {
 			config.Log.Error("Error starting reverse proxy server", zap.Error(err))
 			return
 		}
@@ -133,6 +386,7 @@ func (p *HTTPReverseProxy) Start(ctx context.Context) error {
 	<-ctx.Done()
 
 	config.Log.Info("Reverse proxy server shutting down", zap.Int("port", p.listenPort))
+	p.stopHealthChecks()
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
 	defer cancel()
 
@@ -144,53 +398,79 @@ func (p *HTTPReverseProxy) Start(ctx context.Context) error {
 	return nil
 }
 
+// routeHandler resolves the target of every request before it is handed to the reverse proxy
+func (p *HTTPReverseProxy) routeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, err := p.resolveTarget(r)
+		if err != nil {
+			config.Log.Error("Target host is not set", zap.String("header", targetHostHeader), zap.String("host", r.Host), zap.String("path", r.URL.Path))
+			metric.ObserveRejectedRequest("no_target")
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		// Reject the target before it is forwarded to or published for scaling
+		if err := p.acl.check(r.Context(), t); err != nil {
+			config.Log.Warn("Rejected request to forbidden target",
+				zap.String("from", r.Host),
+				zap.String("to", net.JoinHostPort(t.host, t.port)),
+				zap.String("remoteAddr", r.RemoteAddr),
+				zap.Error(err))
+			metric.ObserveRejectedRequest("forbidden")
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		if p.waitingPage != nil && p.waitingPage.isPoll(r, net.JoinHostPort(t.host, t.port)) {
+			serveWaitingPageStatus(w, !p.room.isCold(net.JoinHostPort(t.host, t.port)))
+			return
+		}
+
+		// The client gives up after its grpc-timeout, so there is no point waiting longer for a cold target
+		if timeout, ok := grpcTimeout(r); ok && isGRPC(r) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+
+		// Streams and upgraded connections may stay open long after the request was published
+		done := p.inFlight.start(net.JoinHostPort(t.host, t.port), t.idleTimeout)
+		defer done()
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(withTarget(r.Context(), t)))
+		metric.ObserveProxyRequest(t.host, recorder.Status(), time.Since(start))
+	})
+}
+
 // httpDirector modifies the request before sending it to the target server
 func (p *HTTPReverseProxy) httpDirector(req *http.Request) {
-	var targetHost string
-
 	originalHost := req.Host
 	originalScheme := req.URL.Scheme
 	if originalScheme == "" {
 		originalScheme = defaultTargetScheme
 	}
 
-	isDev := config.GetEnvOrDefaultString("IS_DEV", "false") == "true"
-	if isDev {
-		targetHost = "www.trivago.com"
-	} else {
-		targetHost = req.Header.Get(targetHostHeader)
-		if targetHost == "" {
-			config.Log.Error("Target host is not set", zap.String("header", targetHostHeader))
-			return
-		}
-	}
-
-	config.Log.Debug("Proxying request", zap.String("from", req.URL.String()), zap.String("to", targetHost))
-
-	scheme := req.Header.Get(targetSchemeHeader)
-	if scheme == "" {
-		scheme = defaultTargetScheme
-		config.Log.Debug("Target scheme is not set", zap.String("scheme", scheme), zap.String("from", req.URL.String()), zap.String("to", targetHost))
+	t, ok := targetFromContext(req.Context())
+	if !ok {
+		config.Log.Error("Target is not resolved", zap.String("from", req.URL.String()))
+		return
 	}
 
-	targetPort := req.Header.Get(targetPortHeader)
-	if targetPort == "" {
-		targetPort = fmt.Sprintf("%d", defaultTargetPort)
-		config.Log.Debug("Target port is not set", zap.String("port", targetPort), zap.String("from", req.URL.String()), zap.String("to", targetHost))
-	}
+	config.Log.Debug("Proxying request", zap.String("from", req.URL.String()), zap.String("to", t.host))
 
-	targetURL, err := url.Parse(fmt.Sprintf("%s://%s:%s", scheme, targetHost, targetPort))
+	targetURL, err := t.url()
 	if err != nil {
-		config.Log.Error("Error parsing target URL", zap.Error(err), zap.String("from", req.URL.String()), zap.String("to", targetHost))
+		config.Log.Error("Error parsing target URL", zap.Error(err), zap.String("from", req.URL.String()), zap.String("to", t.host))
 		return
 	}
 
 	path, _ := joinURLPath(targetURL, req.URL)
-	p.requestsCh <- Requests{
-		Host: targetURL.Host,
-		Path: path,
-	}
-	config.Log.Debug("Sending request", zap.String("path", path), zap.String("from", req.URL.String()), zap.String("to", targetHost))
+	received := time.Now()
+	p.coldStarts.Requested(targetURL.Host, received)
+	p.publish(t.request(targetURL.Host, path, received))
+	config.Log.Debug("Sending request", zap.String("path", path), zap.String("from", req.URL.String()), zap.String("to", t.host))
 
 	req.URL.Scheme = targetURL.Scheme
 	req.URL.Host = targetURL.Host
@@ -203,10 +483,32 @@ func (p *HTTPReverseProxy) httpDirector(req *http.Request) {
 	req.Header.Set("X-Forwarded-Host", originalHost)
 	req.Header.Set("X-Forwarded-Proto", originalScheme)
 
-	config.Log.Debug("Proxying request", zap.String("scheme", req.URL.Scheme), zap.String("url", req.URL.String()), zap.String("to", targetHost))
+	config.Log.Debug("Proxying request", zap.String("scheme", req.URL.Scheme), zap.String("url", req.URL.String()), zap.String("to", t.host))
+}
+
+// publish hands the request over for scaling. It never holds up the request for the store,
+// if the buffer is full the event is dropped.
+func (p *HTTPReverseProxy) publish(req Requests) {
+	select {
+	case p.requestsCh <- req:
+	default:
+		p.dropped.Add(1)
+		metric.ObserveDroppedEvent()
+		config.Log.Debug("Request buffer is full, dropping scale up event", zap.String("to", req.Host), zap.String("path", req.Path))
+	}
+}
+
+// InFlight returns the requests in flight per target host
+func (p *HTTPReverseProxy) InFlight() map[string]InFlight {
+	return p.inFlight.snapshot()
 }
 
 // Requests returns a channel of proxy requests
 func (p *HTTPReverseProxy) Requests() <-chan Requests {
 	return p.requestsCh
 }
+
+// Dropped returns the number of requests which were not published because the buffer was full
+func (p *HTTPReverseProxy) Dropped() uint64 {
+	return p.dropped.Load()
+}
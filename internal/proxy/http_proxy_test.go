@@ -1,24 +1,50 @@
 package proxy
 
 import (
+	"bufio"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"math/big"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/araminian/gozero/internal/coldstart"
 	"github.com/araminian/gozero/internal/config"
+	"github.com/araminian/gozero/internal/metric"
+	"github.com/araminian/gozero/internal/route"
 	grpcclient "github.com/araminian/grpc-simple-app/client"
 	pb "github.com/araminian/grpc-simple-app/proto/todo/v2"
 	grpcserver "github.com/araminian/grpc-simple-app/server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"go.uber.org/zap/zapcore"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
@@ -34,10 +60,16 @@ type testConfig struct {
 	headers    map[string]string
 }
 
+// TestMain initializes the logger once, the proxy logs from goroutines which outlive a test
+func TestMain(m *testing.M) {
+	config.InitLogger(zapcore.ErrorLevel)
+	os.Exit(m.Run())
+}
+
 // setupTestConfig returns a default test configuration
 func setupTestConfig(targetPort string) testConfig {
 	return testConfig{
-		proxyPort:  8080,
+		proxyPort:  freePort(),
 		targetPort: targetPort,
 		headers: map[string]string{
 			"X-Gozero-Target-Port":    targetPort,
@@ -50,21 +82,56 @@ func setupTestConfig(targetPort string) testConfig {
 }
 
 // setupProxy creates and starts a proxy server for testing
-func setupProxy(t *testing.T, cfg testConfig) (*HTTPReverseProxy, context.CancelFunc) {
+func setupProxy(t *testing.T, cfg testConfig, opts ...HTTPReverseProxyConfig) (*HTTPReverseProxy, context.CancelFunc) {
 	t.Helper()
-	config.InitLogger(zapcore.ErrorLevel)
-
-	proxy, err := NewHTTPReverseProxy(WithListenPort(cfg.proxyPort), WithBufferSize(1024))
+	// Loopback targets are denied by default, the test servers run on localhost
+	opts = append([]HTTPReverseProxyConfig{WithListenPort(cfg.proxyPort), WithBufferSize(1024), WithTargetAllowlist("localhost")}, opts...)
+	proxy, err := NewHTTPReverseProxy(opts...)
 	if err != nil {
 		t.Fatalf("failed to create http proxy: %v", err)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
-	go proxy.Start(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		proxy.Start(ctx)
+	}()
+	// The proxy is shut down before the next test starts
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	waitForPort(t, fmt.Sprintf("localhost:%d", cfg.proxyPort))
 
 	return proxy, cancel
 }
 
+// freePort returns a port nothing listens on, so a test never reaches the proxy of another test
+func freePort() int {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		panic(fmt.Sprintf("failed to find a free port: %v", err))
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// waitForPort waits until the server started in the background accepts connections
+func waitForPort(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server on %s did not start", addr)
+}
+
 // setupHTTP1Server creates and starts an HTTP/1.1 test server
 func setupHTTP1Server(t *testing.T, port string) *testServer {
 	t.Helper()
@@ -84,6 +151,20 @@ func setupHTTP1Server(t *testing.T, port string) *testServer {
 	}
 
 	go server.ListenAndServe()
+	waitForPort(t, "localhost:"+port)
+	return &testServer{server: server, port: port}
+}
+
+// setupHTTP1ServerWithHandler creates and starts an HTTP/1.1 test server with the given handler
+func setupHTTP1ServerWithHandler(t *testing.T, port string, handler http.Handler) *testServer {
+	t.Helper()
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: handler,
+	}
+
+	go server.ListenAndServe()
+	waitForPort(t, "localhost:"+port)
 	return &testServer{server: server, port: port}
 }
 
@@ -113,6 +194,7 @@ func setupHTTP2Server(t *testing.T, port string) *testServer {
 	}
 
 	go server.ListenAndServe()
+	waitForPort(t, "localhost:"+port)
 	return &testServer{server: server, port: port}
 }
 
@@ -327,4 +409,2058 @@ func TestHTTPReverseProxyGRPC(t *testing.T) {
 		grpcclient.DeleteTask(client, cfg.headers, deletes...)
 		grpcclient.PrintTasks(client, mask, cfg.headers)
 	})
+
+	// Nothing listens on the port of this target
+	downCfg := setupTestConfig("8089")
+
+	t.Run("target never comes up", func(t *testing.T) {
+		headers := map[string]string{}
+		for k, v := range downCfg.headers {
+			headers[k] = v
+		}
+		headers["X-Gozero-Target-Retries"] = "2"
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(headers))
+
+		_, err := client.AddTask(ctx, &pb.AddTaskRequest{Description: "Buy milk", DueDate: timestamppb.New(time.Now().Add(time.Hour))})
+		st, _ := status.FromError(err)
+		if st.Code() != codes.Unavailable {
+			t.Errorf("expected code %s, got %s: %v", codes.Unavailable, st.Code(), err)
+		}
+		if !strings.Contains(st.Message(), "all retry attempts failed") {
+			t.Errorf("expected the message to explain the scaling failure, got %q", st.Message())
+		}
+	})
+
+	t.Run("grpc-timeout bounds the wait", func(t *testing.T) {
+		// A raw call without a client side deadline, only the proxy can end it
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:%d/todo.v2.TodoService/AddTask", cfg.proxyPort), nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		for k, v := range downCfg.headers {
+			req.Header.Set(k, v)
+		}
+		req.Header.Set("Content-Type", "application/grpc")
+		req.Header.Set("Grpc-Timeout", "500m")
+
+		start := time.Now()
+		resp, err := createHTTP2Client().Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("expected the call to end after its grpc-timeout, took %s", elapsed)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if code := resp.Header.Get("Grpc-Status"); code != strconv.Itoa(int(codes.DeadlineExceeded)) {
+			t.Errorf("expected grpc-status %d, got %q", codes.DeadlineExceeded, code)
+		}
+	})
+}
+
+func TestHTTPReverseProxyColdTarget(t *testing.T) {
+	cfg := setupTestConfig("8081")
+	coldStarts, err := coldstart.NewTracker()
+	if err != nil {
+		t.Fatalf("failed to create cold start tracker: %v", err)
+	}
+	proxy, cancel := setupProxy(t, cfg, WithColdStartTracker(coldStarts))
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	var (
+		mu   sync.Mutex
+		hits int
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pass", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Hello, World!"))
+	})
+	server := &http.Server{
+		Addr:    ":" + cfg.targetPort,
+		Handler: mux,
+	}
+	defer server.Shutdown(context.Background())
+
+	// The target comes up only after the requests are parked
+	time.AfterFunc(500*time.Millisecond, func() {
+		server.ListenAndServe()
+	})
+
+	const parallelRequests = 10
+	var wg sync.WaitGroup
+	statuses := make(chan int, parallelRequests)
+	for range parallelRequests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := makeRequest(t, http.DefaultClient, "GET", "/pass", cfg)
+			defer resp.Body.Close()
+			io.Copy(io.Discard, resp.Body)
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	for status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, status)
+		}
+	}
+
+	// Every parked request is sent once after release, plus a single successful probe
+	mu.Lock()
+	defer mu.Unlock()
+	if hits > parallelRequests+1 {
+		t.Errorf("expected at most %d upstream requests, got %d", parallelRequests+1, hits)
+	}
+
+	// The requests together are a single cold start
+	events := coldStarts.History("localhost:8081")
+	if len(events) != 1 {
+		t.Fatalf("expected 1 cold start, got %d", len(events))
+	}
+	if events[0].Reason != coldstart.ReasonUpstreamUnavailable {
+		t.Errorf("expected reason %s, got %s", coldstart.ReasonUpstreamUnavailable, events[0].Reason)
+	}
+	if events[0].Seconds < 0.5 {
+		t.Errorf("expected the cold start to take at least 0.5s, got %.2fs", events[0].Seconds)
+	}
+}
+
+func TestHTTPReverseProxyWaitingRoomLimits(t *testing.T) {
+	cfg := setupTestConfig("8081")
+	proxy, cancel := setupProxy(t, cfg, WithQueueDepth(1), WithMaxWait(300*time.Millisecond))
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	// The target never comes up
+	var wg sync.WaitGroup
+	statuses := make(chan int, 2)
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := makeRequest(t, http.DefaultClient, "GET", "/pass", cfg)
+			defer resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	got := map[int]int{}
+	for status := range statuses {
+		got[status]++
+	}
+
+	if got[http.StatusServiceUnavailable] != 1 || got[http.StatusGatewayTimeout] != 1 {
+		t.Errorf("expected one %d and one %d, got %v", http.StatusServiceUnavailable, http.StatusGatewayTimeout, got)
+	}
+}
+
+func TestHTTPReverseProxyColdTargetPOST(t *testing.T) {
+	tests := []struct {
+		name       string
+		bufferSize int64
+	}{
+		{name: "body kept in memory", bufferSize: 1 << 20},
+		{name: "body spilled to file", bufferSize: 16},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := setupTestConfig("8081")
+			proxy, cancel := setupProxy(t, cfg, WithBodyBufferSize(tt.bufferSize))
+			defer cancel()
+			defer proxy.Shutdown(context.Background())
+
+			// The target answers like a mesh without healthy endpoints for the first attempts,
+			// after the request body was already sent
+			var attempts atomic.Int32
+			mux := http.NewServeMux()
+			mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if attempts.Add(1) <= 3 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					w.Write([]byte("no healthy upstream"))
+					return
+				}
+				if r.Method != http.MethodPost {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write(body)
+			})
+			server := setupHTTP1ServerWithHandler(t, cfg.targetPort, mux)
+			defer server.server.Shutdown(context.Background())
+
+			payload := strings.Repeat("gozero request body ", 100)
+			req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:%d/echo", cfg.proxyPort), strings.NewReader(payload))
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			for k, v := range cfg.headers {
+				req.Header.Set(k, v)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("failed to read response body: %v", err)
+			}
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, body)
+			}
+
+			if string(body) != payload {
+				t.Errorf("expected body of %d bytes to be echoed, got %d bytes", len(payload), len(body))
+			}
+		})
+	}
+}
+
+func TestReplayableBodyRemovesSpillFile(t *testing.T) {
+	body := newReplayableBody(io.NopCloser(strings.NewReader(strings.Repeat("gozero", 100))), 16)
+
+	// The transport reads and closes the body of the attempt before the round trip returns
+	reader := body.newReader()
+	if _, err := io.ReadAll(reader); err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	body.mu.Lock()
+	file := body.file
+	body.mu.Unlock()
+	if file == nil {
+		t.Fatalf("expected the body to spill to a file")
+	}
+	reader.Close()
+	body.commit()
+
+	if _, err := os.Stat(file.Name()); !os.IsNotExist(err) {
+		t.Errorf("expected the spill file to be removed, got %v", err)
+	}
+}
+
+func TestHTTPReverseProxyNonIdempotentNotRetried(t *testing.T) {
+	cfg := setupTestConfig("8081")
+	proxy, cancel := setupProxy(t, cfg)
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	// The target reads the whole request and drops the connection without answering
+	listener, err := net.Listen("tcp", "localhost:"+cfg.targetPort)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	var received atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if req, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+				io.Copy(io.Discard, req.Body)
+				received.Add(1)
+			}
+			conn.Close()
+		}
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:%d/echo", cfg.proxyPort), strings.NewReader("payload"))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	for k, v := range cfg.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to make request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected status code %d, got %d", http.StatusBadGateway, resp.StatusCode)
+	}
+
+	if got := received.Load(); got != 1 {
+		t.Errorf("expected the request to be sent once, got %d", got)
+	}
+}
+
+func TestHTTPReverseProxyRouteTable(t *testing.T) {
+	cfg := setupTestConfig("8081")
+	table, err := route.Parse([]byte(`
+routes:
+- host: localhost
+  pathPrefix: /pass
+  target:
+    host: localhost
+    port: 8081
+    scheme: http
+`))
+	if err != nil {
+		t.Fatalf("failed to parse route table: %v", err)
+	}
+
+	proxy, cancel := setupProxy(t, cfg, WithRouteTable(table))
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	server := setupHTTP1Server(t, cfg.targetPort)
+	defer server.server.Shutdown(context.Background())
+
+	// No X-Gozero-Target-* headers, the route table tells where to go
+	noHeaders := cfg
+	noHeaders.headers = nil
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+	}{
+		{name: "matched route", path: "/pass", expectedStatus: http.StatusOK},
+		{name: "no route and no headers", path: "/fail", expectedStatus: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := makeRequest(t, http.DefaultClient, "GET", tt.path, noHeaders)
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestHTTPReverseProxyTargetACL(t *testing.T) {
+	cfg := setupTestConfig("8081")
+	proxy, cancel := setupProxy(t, cfg, WithTargetDenylist("*.internal"), WithTargetPorts(8081))
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	server := setupHTTP1Server(t, cfg.targetPort)
+	defer server.server.Shutdown(context.Background())
+
+	tests := []struct {
+		name           string
+		host           string
+		port           string
+		expectedStatus int
+	}{
+		{name: "allowed target", host: "localhost", port: "8081", expectedStatus: http.StatusOK},
+		{name: "metadata endpoint", host: "169.254.169.254", port: "8081", expectedStatus: http.StatusForbidden},
+		{name: "loopback ip", host: "127.0.0.1", port: "8081", expectedStatus: http.StatusForbidden},
+		{name: "denied suffix", host: "db.internal", port: "8081", expectedStatus: http.StatusForbidden},
+		{name: "not in allowlist", host: "example.com", port: "8081", expectedStatus: http.StatusForbidden},
+		{name: "port not allowed", host: "localhost", port: "6379", expectedStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqCfg := setupTestConfig(tt.port)
+			reqCfg.proxyPort = cfg.proxyPort
+			reqCfg.headers["X-Gozero-Target-Host"] = tt.host
+
+			published := len(proxy.Requests())
+			resp := makeRequest(t, http.DefaultClient, "GET", "/pass", reqCfg)
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+
+			// Rejected targets must not be published for scaling
+			if tt.expectedStatus == http.StatusForbidden && len(proxy.Requests()) != published {
+				t.Errorf("expected no scale up request for a rejected target")
+			}
+		})
+	}
+}
+
+func TestHTTPReverseProxyScalePolicy(t *testing.T) {
+	cfg := setupTestConfig("8081")
+	table, err := route.Parse([]byte(`
+routes:
+- host: localhost
+  pathPrefix: /pass
+  target:
+    host: localhost
+    port: 8081
+    scheme: http
+    idleTimeout: 15m
+    scaleValue: 3
+    metricMode: rate
+`))
+	if err != nil {
+		t.Fatalf("failed to parse route table: %v", err)
+	}
+
+	proxy, cancel := setupProxy(t, cfg, WithRouteTable(table), WithMaxIdleTimeout(time.Hour), WithMaxScaleValue(50))
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	server := setupHTTP1Server(t, cfg.targetPort)
+	defer server.server.Shutdown(context.Background())
+
+	tests := []struct {
+		name     string
+		path     string
+		headers  map[string]string
+		expected Requests
+	}{
+		{
+			name: "route table wins over headers",
+			path: "/pass",
+			headers: map[string]string{
+				"X-Gozero-Idle-Timeout": "1m",
+				"X-Gozero-Min-Active":   "30m",
+			},
+			expected: Requests{Host: "localhost:8081", Path: "/pass", IdleTimeout: 15 * time.Minute, ScaleValue: 3, MinActive: 30 * time.Minute, MetricMode: "rate"},
+		},
+		{
+			name: "headers",
+			path: "/header/pass",
+			headers: map[string]string{
+				"X-Gozero-Idle-Timeout": "1m",
+				"X-Gozero-Scale-Value":  "5",
+				"X-Gozero-Metric-Mode":  "value",
+			},
+			expected: Requests{Host: "localhost:8081", Path: "/header/pass", IdleTimeout: time.Minute, ScaleValue: 5, MetricMode: "value"},
+		},
+		{
+			name: "invalid headers are ignored",
+			path: "/header/pass",
+			headers: map[string]string{
+				"X-Gozero-Idle-Timeout": "soon",
+				"X-Gozero-Scale-Value":  "-1",
+				"X-Gozero-Metric-Mode":  "cpu",
+			},
+			expected: Requests{Host: "localhost:8081", Path: "/header/pass"},
+		},
+		{
+			name: "headers above the limits are lowered",
+			path: "/header/pass",
+			headers: map[string]string{
+				"X-Gozero-Idle-Timeout": "8760h",
+				"X-Gozero-Scale-Value":  "1000000",
+				"X-Gozero-Min-Active":   "48h",
+			},
+			expected: Requests{Host: "localhost:8081", Path: "/header/pass", IdleTimeout: time.Hour, ScaleValue: 50, MinActive: DefaultMaxMinActive},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqCfg := setupTestConfig(cfg.targetPort)
+			reqCfg.proxyPort = cfg.proxyPort
+			for k, v := range tt.headers {
+				reqCfg.headers[k] = v
+			}
+
+			resp := makeRequest(t, http.DefaultClient, "GET", tt.path, reqCfg)
+			resp.Body.Close()
+
+			select {
+			case got := <-proxy.Requests():
+				if got.Received.IsZero() {
+					t.Errorf("expected the arrival of the request to be set")
+				}
+				got.Received = time.Time{}
+				if got != tt.expected {
+					t.Errorf("expected request %+v, got %+v", tt.expected, got)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("expected a scale up request")
+			}
+		})
+	}
+}
+
+func TestHTTPReverseProxyFullRequestBuffer(t *testing.T) {
+	cfg := setupTestConfig("8081")
+	// Nobody reads the scale up events
+	proxy, cancel := setupProxy(t, cfg, WithBufferSize(1))
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	server := setupHTTP1Server(t, cfg.targetPort)
+	defer server.server.Shutdown(context.Background())
+
+	for i := 0; i < 10; i++ {
+		resp := makeRequest(t, http.DefaultClient, "GET", "/pass", cfg)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	if len(proxy.Requests()) != 1 {
+		t.Errorf("expected 1 buffered request, got %d", len(proxy.Requests()))
+	}
+	if proxy.Dropped() != 9 {
+		t.Errorf("expected 9 dropped requests, got %d", proxy.Dropped())
+	}
+}
+
+func TestHTTPReverseProxyWaitingPage(t *testing.T) {
+	cfg := setupTestConfig("8081")
+	proxy, cancel := setupProxy(t, cfg, WithWaitingPage(""), WithWaitingPageRefresh(time.Second))
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	browserCfg := setupTestConfig(cfg.targetPort)
+	browserCfg.proxyPort = cfg.proxyPort
+	browserCfg.headers["Accept"] = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+	var statusPath string
+	readyStatus := func() bool {
+		resp := makeRequest(t, http.DefaultClient, "GET", statusPath, browserCfg)
+		defer resp.Body.Close()
+		var status map[string]bool
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatalf("failed to decode status: %v", err)
+		}
+		return status["ready"]
+	}
+
+	// The browser gets the waiting page right away while the target is down
+	start := time.Now()
+	resp := makeRequest(t, http.DefaultClient, "GET", "/pass", browserCfg)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if time.Since(start) > time.Second {
+		t.Errorf("expected the waiting page right away, took %s", time.Since(start))
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status code %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+	if !strings.Contains(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(body), "Waking up") {
+		t.Errorf("expected the waiting page, got %s: %s", resp.Header.Get("Content-Type"), body)
+	}
+	token := regexp.MustCompile(`token=([0-9a-f]+)`).FindSubmatch(body)
+	if token == nil {
+		t.Fatalf("expected the waiting page to poll with a token: %s", body)
+	}
+	statusPath = waitingPageStatusPath + "?token=" + string(token[1])
+	if readyStatus() {
+		t.Errorf("expected the target not to be ready")
+	}
+
+	server := setupHTTP1Server(t, cfg.targetPort)
+	defer server.server.Shutdown(context.Background())
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !readyStatus() {
+		if time.Now().After(deadline) {
+			t.Fatal("target did not become ready")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Once ready the browser gets the real page
+	resp = makeRequest(t, http.DefaultClient, "GET", "/pass", browserCfg)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	// The status path of the target is only taken by polls of a waiting page
+	for _, path := range []string{waitingPageStatusPath, waitingPageStatusPath + "?token=guessed"} {
+		resp = makeRequest(t, http.DefaultClient, "GET", path, browserCfg)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("expected %s to go to the target with status code %d, got %d", path, http.StatusNotFound, resp.StatusCode)
+		}
+	}
+}
+
+func TestWantsWaitingPage(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		headers  map[string]string
+		expected bool
+	}{
+		{"browser", http.MethodGet, map[string]string{"Accept": "text/html,application/xhtml+xml,*/*;q=0.8"}, true},
+		{"api", http.MethodGet, map[string]string{"Accept": "application/json"}, false},
+		{"any", http.MethodGet, map[string]string{"Accept": "*/*"}, false},
+		{"no accept", http.MethodGet, nil, false},
+		{"json preferred", http.MethodGet, map[string]string{"Accept": "text/html;q=0.5,application/json"}, false},
+		{"post", http.MethodPost, map[string]string{"Accept": "text/html"}, false},
+		{"websocket", http.MethodGet, map[string]string{"Accept": "text/html", "Upgrade": "websocket"}, false},
+		{"grpc", http.MethodGet, map[string]string{"Accept": "text/html", "Content-Type": "application/grpc"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, "http://localhost/", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			if got := wantsWaitingPage(req); got != tt.expected {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestNotReadyClassifier(t *testing.T) {
+	custom := &route.NotReady{
+		Profile:   route.ProfileDirect,
+		BodyLimit: 16,
+		Rules: []route.NotReadyRule{
+			{Status: []int{http.StatusBadGateway}, Body: "warming up"},
+			{Headers: map[string]string{"X-Envoy-Overloaded": "true"}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		profile  string
+		cfg      *route.NotReady
+		status   int
+		headers  map[string]string
+		body     string
+		err      error
+		expected bool
+	}{
+		{name: "connection refused", profile: route.ProfileDirect, err: errors.New("connection refused"), expected: true},
+		{name: "direct 503", profile: route.ProfileDirect, status: http.StatusServiceUnavailable, body: "no healthy upstream"},
+		{name: "istio no healthy upstream", profile: route.ProfileIstio, status: http.StatusServiceUnavailable, body: "no healthy upstream", expected: true},
+		{name: "istio upstream connect error", profile: route.ProfileIstio, status: http.StatusServiceUnavailable, body: "upstream connect error or disconnect/reset before headers", expected: true},
+		{name: "istio target 503", profile: route.ProfileIstio, status: http.StatusServiceUnavailable, body: "maintenance"},
+		{name: "istio grpc", profile: route.ProfileIstio, status: http.StatusOK, headers: map[string]string{grpcStatusHeader: "14", grpcMessageHeader: "no healthy upstream"}, expected: true},
+		{name: "istio grpc from target", profile: route.ProfileIstio, status: http.StatusOK, headers: map[string]string{grpcStatusHeader: "14", grpcMessageHeader: "database down"}},
+		{name: "linkerd proxy error", profile: route.ProfileLinkerd, status: http.StatusBadGateway, headers: map[string]string{"L5d-Proxy-Error": "connection refused"}, expected: true},
+		{name: "linkerd target 502", profile: route.ProfileLinkerd, status: http.StatusBadGateway},
+		{name: "nginx 502", profile: route.ProfileNginx, status: http.StatusBadGateway, headers: map[string]string{"Server": "nginx/1.27.0"}, expected: true},
+		{name: "nginx 200", profile: route.ProfileNginx, status: http.StatusOK, headers: map[string]string{"Server": "nginx/1.27.0"}},
+		{name: "custom body", cfg: custom, status: http.StatusBadGateway, body: "still warming up", expected: true},
+		{name: "custom body beyond limit", cfg: custom, status: http.StatusBadGateway, body: strings.Repeat(" ", 16) + "warming up"},
+		{name: "custom header", cfg: custom, status: http.StatusServiceUnavailable, headers: map[string]string{"X-Envoy-Overloaded": "true"}, expected: true},
+		{name: "custom keeps profile", cfg: &route.NotReady{Profile: route.ProfileIstio}, status: http.StatusServiceUnavailable, body: "no healthy upstream", expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := newNotReadyClassifier(tt.profile, tt.cfg)
+			if err != nil {
+				t.Fatalf("failed to create classifier: %v", err)
+			}
+
+			var resp *http.Response
+			if tt.err == nil {
+				resp = &http.Response{StatusCode: tt.status, Header: make(http.Header), Body: io.NopCloser(strings.NewReader(tt.body))}
+				for k, v := range tt.headers {
+					resp.Header.Set(k, v)
+				}
+			}
+
+			got := c.notReady(resp, tt.err, "app.example.com", "app.svc:8080") != nil
+			if got != tt.expected {
+				t.Fatalf("expected not ready %v, got %v", tt.expected, got)
+			}
+
+			// A response which is passed on keeps its whole body
+			if !got && resp != nil {
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatalf("failed to read response body: %v", err)
+				}
+				if string(body) != tt.body {
+					t.Errorf("expected body %q, got %q", tt.body, body)
+				}
+			}
+		})
+	}
+
+	if _, err := newNotReadyClassifier("envoy", nil); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
+
+// openBody is a body which sent some bytes and stays open, like an event stream or an upgraded connection
+type openBody struct {
+	io.Reader
+	written strings.Builder
+	closed  chan struct{}
+}
+
+func newOpenBody(sent string) *openBody {
+	pr, pw := io.Pipe()
+	go pw.Write([]byte(sent))
+	return &openBody{Reader: pr, closed: make(chan struct{})}
+}
+
+func (b *openBody) Write(p []byte) (int, error) { return b.written.Write(p) }
+func (b *openBody) Close() error                { close(b.closed); return nil }
+
+func TestNotReadyClassifierStreams(t *testing.T) {
+	c, err := newNotReadyClassifier(route.ProfileDirect, &route.NotReady{Rules: []route.NotReadyRule{
+		{Status: []int{http.StatusSwitchingProtocols, http.StatusOK, http.StatusServiceUnavailable}, Body: "warming up"},
+	}})
+	if err != nil {
+		t.Fatalf("failed to create classifier: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		sent        string
+		expected    bool
+	}{
+		{name: "body which is still open", status: http.StatusServiceUnavailable, sent: "warming up", expected: true},
+		{name: "peeked body which is still open", status: http.StatusServiceUnavailable, sent: "maintenance"},
+		{name: "upgraded connection", status: http.StatusSwitchingProtocols, sent: "warming up"},
+		{name: "event stream", status: http.StatusOK, contentType: "text/event-stream", sent: "warming up"},
+		{name: "grpc", status: http.StatusOK, contentType: "application/grpc", sent: "warming up"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := newOpenBody(tt.sent)
+			resp := &http.Response{StatusCode: tt.status, Header: make(http.Header), Body: body}
+			resp.Header.Set("Content-Type", tt.contentType)
+
+			result := make(chan bool, 1)
+			go func() { result <- c.notReady(resp, nil, "app.example.com", "app.svc:8080") != nil }()
+			select {
+			case got := <-result:
+				if got != tt.expected {
+					t.Errorf("expected not ready %v, got %v", tt.expected, got)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("expected the classifier not to wait for the rest of the body")
+			}
+
+			// The body of a response which is passed on can still be written to
+			if !tt.expected {
+				w, ok := resp.Body.(io.ReadWriteCloser)
+				if !ok {
+					t.Fatalf("expected the body to stay writable")
+				}
+				w.Write([]byte("ping"))
+				if body.written.String() != "ping" {
+					t.Errorf("expected the write to reach the connection, got %q", body.written.String())
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPReverseProxyNotReadyProfile(t *testing.T) {
+	cfg := setupTestConfig("8081")
+	proxy, cancel := setupProxy(t, cfg, WithNotReadyProfile(route.ProfileLinkerd))
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	// The target answers like the Linkerd proxy of a pod which isn't ready for the first attempts
+	var attempts atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) <= 2 {
+			w.Header().Set("L5d-Proxy-Error", "connection refused")
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ready"))
+	})
+	server := setupHTTP1ServerWithHandler(t, cfg.targetPort, mux)
+	defer server.server.Shutdown(context.Background())
+
+	get := func(profile string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d/", cfg.proxyPort), nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		for k, v := range cfg.headers {
+			req.Header.Set(k, v)
+		}
+		if profile != "" {
+			req.Header.Set(notReadyProfileHeader, profile)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, body := get(""); status != http.StatusOK || body != "ready" {
+		t.Fatalf("expected the request to wait for the target, got %d: %s", status, body)
+	}
+
+	// With the direct profile the response of the Linkerd proxy is passed on
+	attempts.Store(0)
+	if status, _ := get(route.ProfileDirect); status != http.StatusBadGateway {
+		t.Errorf("expected status code %d, got %d", http.StatusBadGateway, status)
+	}
+}
+
+func TestNewHTTPReverseProxyInvalidNotReadyProfile(t *testing.T) {
+	if _, err := NewHTTPReverseProxy(WithNotReadyProfile("envoy")); err == nil {
+		t.Error("expected an error for an unknown not ready profile")
+	}
+}
+
+func TestHTTPReverseProxyWebSocket(t *testing.T) {
+	cfg := setupTestConfig("8081")
+	proxy, cancel := setupProxy(t, cfg)
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	var upgrades atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		upgrades.Add(1)
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("failed to hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		// Echo every line
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			brw.WriteString(line)
+			brw.Flush()
+		}
+	})
+	server := &http.Server{
+		Addr:    ":" + cfg.targetPort,
+		Handler: mux,
+	}
+	defer server.Shutdown(context.Background())
+
+	// The handshake is held until the target is up
+	time.AfterFunc(500*time.Millisecond, func() {
+		server.ListenAndServe()
+	})
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", cfg.proxyPort))
+	if err != nil {
+		t.Fatalf("failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d/ws", cfg.proxyPort), nil)
+	for k, v := range cfg.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("failed to write handshake: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatalf("failed to read handshake response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected status code %d, got %d", http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+
+	conn.Write([]byte("ping\n"))
+	if line, err := reader.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Errorf("expected echo of ping, got %q: %v", line, err)
+	}
+	// The probe must not have upgraded
+	if upgrades.Load() != 1 {
+		t.Errorf("expected 1 upgrade, got %d", upgrades.Load())
+	}
+
+	// The open connection is in flight until it is closed
+	if inFlight := proxy.InFlight()["localhost:8081"]; inFlight.Count != 1 {
+		t.Errorf("expected 1 request in flight, got %d", inFlight.Count)
+	}
+
+	conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(proxy.InFlight()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no requests in flight after the connection was closed, got %+v", proxy.InFlight())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for the DNS name and its key to the directory
+func writeTestCertificate(t *testing.T, dir, dnsName string, serial int64) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, dnsName+".crt")
+	keyFile := filepath.Join(dir, dnsName+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestHTTPReverseProxyTLS(t *testing.T) {
+	dir := t.TempDir()
+	defaultCert, defaultKey := writeTestCertificate(t, dir, "default.example", 1)
+	appCert, appKey := writeTestCertificate(t, dir, "app.example", 2)
+
+	cfg := setupTestConfig("8081")
+	proxy, cancel := setupProxy(t, cfg,
+		WithTLSCertificate(defaultCert, defaultKey),
+		WithTLSCertificate(appCert, appKey),
+		WithTLSReloadInterval(50*time.Millisecond),
+	)
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	server := setupHTTP1Server(t, cfg.targetPort)
+	defer server.server.Shutdown(context.Background())
+
+	dial := func(serverName string, protos ...string) *tls.Conn {
+		t.Helper()
+		conn, err := tls.Dial("tcp", fmt.Sprintf("localhost:%d", cfg.proxyPort), &tls.Config{
+			ServerName:         serverName,
+			NextProtos:         protos,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			t.Fatalf("failed to connect to proxy: %v", err)
+		}
+		return conn
+	}
+	peer := func(conn *tls.Conn) *x509.Certificate {
+		return conn.ConnectionState().PeerCertificates[0]
+	}
+
+	t.Run("certificate is picked by SNI", func(t *testing.T) {
+		for serverName, expected := range map[string]string{
+			"app.example":     "app.example",
+			"default.example": "default.example",
+			"other.example":   "default.example",
+		} {
+			conn := dial(serverName)
+			if name := peer(conn).Subject.CommonName; name != expected {
+				t.Errorf("expected certificate %s for %s, got %s", expected, serverName, name)
+			}
+			conn.Close()
+		}
+	})
+
+	t.Run("ALPN negotiates h2 and http/1.1", func(t *testing.T) {
+		for _, proto := range []string{"h2", "http/1.1"} {
+			conn := dial("app.example", proto)
+			if negotiated := conn.ConnectionState().NegotiatedProtocol; negotiated != proto {
+				t.Errorf("expected protocol %s, got %s", proto, negotiated)
+			}
+			conn.Close()
+		}
+	})
+
+	t.Run("requests are proxied over TLS", func(t *testing.T) {
+		for _, forceHTTP2 := range []bool{false, true} {
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+				ForceAttemptHTTP2: forceHTTP2,
+			}}
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("https://localhost:%d/pass", cfg.proxyPort), nil)
+			for k, v := range cfg.headers {
+				req.Header.Set(k, v)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("failed to make request: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != "Hello, World!" {
+				t.Errorf("expected status code %d and body %q, got %d and %q", http.StatusOK, "Hello, World!", resp.StatusCode, string(body))
+			}
+			if forceHTTP2 && resp.ProtoMajor != 2 {
+				t.Errorf("expected HTTP/2, got %s", resp.Proto)
+			}
+		}
+	})
+
+	t.Run("certificates are reloaded without dropping connections", func(t *testing.T) {
+		// A connection set up with the old certificate
+		open := dial("app.example", "http/1.1")
+		defer open.Close()
+
+		writeTestCertificate(t, dir, "app.example", 3)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			conn := dial("app.example")
+			serial := peer(conn).SerialNumber.Int64()
+			conn.Close()
+			if serial == 3 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the reloaded certificate, got serial %d", serial)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		// The connection set up before the reload still serves requests
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("https://localhost:%d/pass", cfg.proxyPort), nil)
+		for k, v := range cfg.headers {
+			req.Header.Set(k, v)
+		}
+		if err := req.Write(open); err != nil {
+			t.Fatalf("failed to write request: %v", err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(open), req)
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if serial := peer(open).SerialNumber.Int64(); serial != 2 {
+			t.Errorf("expected the open connection to keep serial 2, got %d", serial)
+		}
+	})
+
+	t.Run("broken certificate keeps the previous one", func(t *testing.T) {
+		if err := os.WriteFile(appCert, []byte("not a certificate"), 0o600); err != nil {
+			t.Fatalf("failed to write certificate: %v", err)
+		}
+		time.Sleep(200 * time.Millisecond)
+
+		conn := dial("app.example")
+		defer conn.Close()
+		if serial := peer(conn).SerialNumber.Int64(); serial != 3 {
+			t.Errorf("expected the previous certificate with serial 3, got %d", serial)
+		}
+	})
+}
+
+func TestNewHTTPReverseProxyInvalidCertificate(t *testing.T) {
+	_, err := NewHTTPReverseProxy(WithTLSCertificate(filepath.Join(t.TempDir(), "missing.crt"), filepath.Join(t.TempDir(), "missing.key")))
+	if err == nil {
+		t.Errorf("expected an error for a missing certificate")
+	}
+}
+
+func TestHTTPReverseProxyUpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverCert, serverKey := writeTestCertificate(t, dir, "upstream.example", 1)
+	clientCert, clientKey := writeTestCertificate(t, dir, "client.example", 2)
+
+	cfg := setupTestConfig("8081")
+	cfg.headers["X-Gozero-Target-Scheme"] = "https"
+	cfg.headers["X-Gozero-Target-Retries"] = "1"
+	cfg.headers["X-Gozero-Target-Backoff"] = "10ms"
+	table, err := route.Parse([]byte(`
+routes:
+- pathPrefix: /server-name
+  target:
+    host: localhost
+    port: 8081
+    scheme: https
+    retries: 1
+    backoff: 10ms
+    serverName: upstream.example
+- pathPrefix: /insecure
+  target:
+    host: localhost
+    port: 8081
+    scheme: https
+    retries: 1
+    backoff: 10ms
+    insecureSkipVerify: true
+`))
+	if err != nil {
+		t.Fatalf("failed to parse route table: %v", err)
+	}
+	proxy, cancel := setupProxy(t, cfg,
+		WithRouteTable(table),
+		WithUpstreamCA(serverCert),
+		WithUpstreamClientCertificate(clientCert, clientKey),
+	)
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	clientCAs := x509.NewCertPool()
+	clientPEM, _ := os.ReadFile(clientCert)
+	clientCAs.AppendCertsFromPEM(clientPEM)
+
+	// The target only accepts the client certificate of the proxy
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s", r.Proto, r.TLS.ServerName, r.TLS.PeerCertificates[0].Subject.CommonName)
+	})
+	server := &http.Server{
+		Addr:    ":" + cfg.targetPort,
+		Handler: mux,
+		TLSConfig: &tls.Config{
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			ClientCAs:  clientCAs,
+		},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	go server.ListenAndServeTLS(serverCert, serverKey)
+	defer server.Shutdown(context.Background())
+	waitForPort(t, "localhost:"+cfg.targetPort)
+
+	tests := []struct {
+		name           string
+		path           string
+		headers        map[string]string
+		client         *http.Client
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "certificate does not match the target host",
+			path:           "/pass",
+			client:         http.DefaultClient,
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name:           "server name override",
+			path:           "/server-name",
+			client:         http.DefaultClient,
+			expectedStatus: http.StatusOK,
+			expectedBody:   "HTTP/1.1 upstream.example client.example",
+		},
+		{
+			name:           "insecure skip verify",
+			path:           "/insecure",
+			client:         http.DefaultClient,
+			expectedStatus: http.StatusOK,
+			expectedBody:   "HTTP/1.1 localhost client.example",
+		},
+		{
+			name:           "HTTP/2 over TLS",
+			path:           "/server-name",
+			client:         createHTTP2Client(),
+			expectedStatus: http.StatusOK,
+			expectedBody:   "HTTP/2.0 upstream.example client.example",
+		},
+		{
+			name: "clients can't turn off the verification",
+			path: "/pass",
+			headers: map[string]string{
+				"X-Gozero-Target-Insecure-Skip-Verify": "true",
+				"X-Gozero-Target-Server-Name":          "upstream.example",
+			},
+			client:         http.DefaultClient,
+			expectedStatus: http.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqCfg := cfg
+			reqCfg.headers = make(map[string]string)
+			for k, v := range cfg.headers {
+				reqCfg.headers[k] = v
+			}
+			for k, v := range tt.headers {
+				reqCfg.headers[k] = v
+			}
+
+			resp := makeRequest(t, tt.client, http.MethodGet, tt.path, reqCfg)
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			if tt.expectedBody == "" {
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("failed to read response body: %v", err)
+			}
+			if string(body) != tt.expectedBody {
+				t.Errorf("expected body %q, got %q", tt.expectedBody, string(body))
+			}
+		})
+	}
+}
+
+func TestHTTPReverseProxyLoadBalancing(t *testing.T) {
+	cfg := setupTestConfig("8081")
+	table, err := route.Parse([]byte(`
+routes:
+- pathPrefix: /rr
+  target:
+    host: localhost
+    port: 9999
+    scheme: http
+    balancer:
+      endpoints: [localhost:8081, localhost:8082]
+- pathPrefix: /hash
+  target:
+    host: localhost
+    port: 9999
+    scheme: http
+    balancer:
+      policy: hash
+      hashHeader: X-User
+      endpoints: [localhost:8081, localhost:8082]
+- pathPrefix: /least
+  target:
+    host: localhost
+    port: 9999
+    scheme: http
+    balancer:
+      policy: least-connections
+      endpoints: [localhost:8081, localhost:8082]
+- pathPrefix: /failover
+  target:
+    host: localhost
+    port: 9999
+    scheme: http
+    balancer:
+      endpoints: [localhost:8081, localhost:8083]
+      failureTimeout: 300ms
+- pathPrefix: /dns
+  target:
+    host: localhost
+    port: 8081
+    scheme: http
+    balancer:
+      dns: localhost
+`))
+	if err != nil {
+		t.Fatalf("failed to parse route table: %v", err)
+	}
+
+	proxy, cancel := setupProxy(t, cfg, WithRouteTable(table))
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	release := make(chan struct{})
+	slow := make(chan string, 1)
+	endpointHandler := func(port string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/least/slow" {
+				slow <- port
+				<-release
+			}
+			w.Write([]byte(port))
+		})
+	}
+	for _, port := range []string{"8081", "8082"} {
+		server := setupHTTP1ServerWithHandler(t, port, endpointHandler(port))
+		defer server.server.Shutdown(context.Background())
+	}
+
+	noHeaders := cfg
+	noHeaders.headers = nil
+	get := func(path string, headers map[string]string) string {
+		t.Helper()
+		reqCfg := noHeaders
+		reqCfg.headers = headers
+		resp := makeRequest(t, http.DefaultClient, http.MethodGet, path, reqCfg)
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, resp.StatusCode, body)
+		}
+		return string(body)
+	}
+
+	t.Run("round robin", func(t *testing.T) {
+		seen := map[string]int{}
+		for i := 0; i < 4; i++ {
+			seen[get("/rr", nil)]++
+		}
+		if seen["8081"] != 2 || seen["8082"] != 2 {
+			t.Errorf("expected 2 requests per endpoint, got %v", seen)
+		}
+	})
+
+	t.Run("hash sticks to an endpoint", func(t *testing.T) {
+		for _, user := range []string{"alice", "bob", "carol"} {
+			first := get("/hash", map[string]string{"X-User": user})
+			for i := 0; i < 3; i++ {
+				if got := get("/hash", map[string]string{"X-User": user}); got != first {
+					t.Errorf("expected %s to stay on %s, got %s", user, first, got)
+				}
+			}
+		}
+	})
+
+	t.Run("least connections", func(t *testing.T) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			get("/least/slow", nil)
+		}()
+		busy := <-slow
+
+		for i := 0; i < 3; i++ {
+			if got := get("/least/fast", nil); got == busy {
+				t.Errorf("expected the idle endpoint, got the busy endpoint %s", busy)
+			}
+		}
+		close(release)
+		<-done
+	})
+
+	t.Run("failed endpoints are left out until they recover", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			if got := get("/failover", nil); got != "8081" {
+				t.Errorf("expected the healthy endpoint 8081, got %s", got)
+			}
+		}
+
+		server := setupHTTP1ServerWithHandler(t, "8083", endpointHandler("8083"))
+		defer server.server.Shutdown(context.Background())
+		time.Sleep(400 * time.Millisecond)
+
+		seen := map[string]int{}
+		for i := 0; i < 4; i++ {
+			seen[get("/failover", nil)]++
+		}
+		if seen["8083"] == 0 {
+			t.Errorf("expected the recovered endpoint to get requests again, got %v", seen)
+		}
+	})
+
+	t.Run("endpoints from DNS", func(t *testing.T) {
+		if got := get("/dns", nil); got != "8081" {
+			t.Errorf("expected endpoint 8081, got %s", got)
+		}
+	})
+}
+
+func TestBalancerResolveSRV(t *testing.T) {
+	b := newBalancer(&route.Balancer{SRV: "_http._tcp.app.example"}, "443")
+
+	records := []*net.SRV{{Target: "a.example", Port: 8080}, {Target: "b.example", Port: 8080}}
+	var lookupErr error
+	b.lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		return "", records, lookupErr
+	}
+
+	b.resolve(context.Background())
+	if len(b.endpoints) != 2 || b.endpoints[0].addr != "a.example:8080" || b.endpoints[1].addr != "b.example:8080" {
+		t.Fatalf("expected both SRV records as endpoints, got %d", len(b.endpoints))
+	}
+
+	// An endpoint which stays keeps its state
+	b.endpoints[1].active.Store(3)
+	records = records[1:]
+	b.resolve(context.Background())
+	if len(b.endpoints) != 1 || b.endpoints[0].active.Load() != 3 {
+		t.Errorf("expected b.example to keep its requests in flight")
+	}
+
+	// A failed lookup keeps the previous endpoints
+	lookupErr = errors.New("lookup failed")
+	b.resolve(context.Background())
+	if len(b.endpoints) != 1 {
+		t.Errorf("expected the previous endpoints after a failed lookup, got %d", len(b.endpoints))
+	}
+}
+
+func TestBalancerSlowResolver(t *testing.T) {
+	b := newBalancer(&route.Balancer{DNS: "app.example"}, "8080")
+
+	release := make(chan struct{})
+	b.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		<-release
+		return []string{"10.0.0.1"}, nil
+	}
+
+	// The first request waits for the lookup, the others don't wait behind it
+	resolved := make(chan []*endpoint)
+	go func() { resolved <- b.current(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	if endpoints := b.current(context.Background()); len(endpoints) != 0 {
+		t.Errorf("expected no endpoints while the first lookup runs, got %d", len(endpoints))
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Errorf("expected the request not to wait for the lookup, took %s", elapsed)
+	}
+
+	close(release)
+	if endpoints := <-resolved; len(endpoints) != 1 || endpoints[0].addr != "10.0.0.1:8080" {
+		t.Fatalf("expected the resolved endpoint, got %d", len(endpoints))
+	}
+
+	// A stale refresh runs in the background while the requests keep the known endpoints
+	release = make(chan struct{})
+	b.mu.Lock()
+	b.resolved = time.Now().Add(-time.Hour)
+	b.mu.Unlock()
+	for range 3 {
+		if endpoints := b.current(context.Background()); len(endpoints) != 1 {
+			t.Errorf("expected the known endpoint during the refresh, got %d", len(endpoints))
+		}
+	}
+	close(release)
+}
+
+func TestHTTPReverseProxyHealthCheck(t *testing.T) {
+	cfg := setupTestConfig("8081")
+	table, err := route.Parse([]byte(`
+routes:
+- target:
+    host: localhost
+    port: 8081
+    scheme: http
+    healthCheck:
+      path: /healthz
+      interval: 50ms
+      timeout: 200ms
+      unhealthyThreshold: 2
+`))
+	if err != nil {
+		t.Fatalf("failed to parse route table: %v", err)
+	}
+
+	proxy, cancel := setupProxy(t, cfg, WithRouteTable(table))
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	var healthy atomic.Bool
+	var served atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/pass", func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+		w.Write([]byte("Hello, World!"))
+	})
+	server := setupHTTP1ServerWithHandler(t, cfg.targetPort, mux)
+	defer server.server.Shutdown(context.Background())
+
+	noHeaders := cfg
+	noHeaders.headers = nil
+
+	t.Run("requests wait until the target passes the check", func(t *testing.T) {
+		time.AfterFunc(300*time.Millisecond, func() {
+			if served.Load() != 0 {
+				t.Errorf("expected no request to be forwarded before the target is healthy")
+			}
+			healthy.Store(true)
+		})
+
+		start := time.Now()
+		resp := makeRequest(t, http.DefaultClient, http.MethodGet, "/pass", noHeaders)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+			t.Errorf("expected the request to wait for the health check, it took %s", elapsed)
+		}
+		if state := proxy.Health()["localhost:8081"].State; state != HealthHealthy {
+			t.Errorf("expected the target to be healthy, got %s", state)
+		}
+	})
+
+	t.Run("a failing target fails fast", func(t *testing.T) {
+		healthy.Store(false)
+		deadline := time.Now().Add(2 * time.Second)
+		for proxy.Health()["localhost:8081"].State != HealthFailing {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the target to be failing, got %+v", proxy.Health())
+			}
+			// The target is in use while it fails
+			resp := makeRequest(t, http.DefaultClient, http.MethodGet, "/pass", noHeaders)
+			resp.Body.Close()
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		before := served.Load()
+		resp := makeRequest(t, http.DefaultClient, http.MethodGet, "/pass", noHeaders)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("expected status code %d, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+		}
+		if served.Load() != before {
+			t.Errorf("expected the request not to be forwarded to a failing target")
+		}
+	})
+
+	t.Run("a recovered target gets requests again", func(t *testing.T) {
+		healthy.Store(true)
+		deadline := time.Now().Add(2 * time.Second)
+		for proxy.Health()["localhost:8081"].State != HealthHealthy {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the target to be healthy, got %+v", proxy.Health())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		resp := makeRequest(t, http.DefaultClient, http.MethodGet, "/pass", noHeaders)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	})
+
+	t.Run("an unused target which fails is woken by the next request", func(t *testing.T) {
+		// The target passes checks after its last request
+		time.Sleep(100 * time.Millisecond)
+		healthy.Store(false)
+		deadline := time.Now().Add(2 * time.Second)
+		for proxy.Health()["localhost:8081"].State != HealthWaking {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the target to be waking, got %+v", proxy.Health())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		time.AfterFunc(200*time.Millisecond, func() { healthy.Store(true) })
+		resp := makeRequest(t, http.DefaultClient, http.MethodGet, "/pass", noHeaders)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+	})
+}
+
+func TestHealthCheckTypes(t *testing.T) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	healthServer := health.NewServer()
+	grpcServer := grpc.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+	addr := lis.Addr().String()
+
+	check := func(cfg route.HealthCheck, addr string) error {
+		h := newHealthChecker(&cfg, addr, "http", time.Minute, nil, &tls.Config{})
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return h.check(ctx, addr)
+	}
+
+	if err := check(route.HealthCheck{Type: route.HealthCheckTCP}, addr); err != nil {
+		t.Errorf("expected the tcp check to pass: %v", err)
+	}
+	if err := check(route.HealthCheck{Type: route.HealthCheckTCP}, "localhost:1"); err == nil {
+		t.Errorf("expected the tcp check of a closed port to fail")
+	}
+
+	healthServer.SetServingStatus("todo.v2.TodoService", healthpb.HealthCheckResponse_SERVING)
+	if err := check(route.HealthCheck{Type: route.HealthCheckGRPC, Service: "todo.v2.TodoService"}, addr); err != nil {
+		t.Errorf("expected the grpc check to pass: %v", err)
+	}
+	healthServer.SetServingStatus("todo.v2.TodoService", healthpb.HealthCheckResponse_NOT_SERVING)
+	if err := check(route.HealthCheck{Type: route.HealthCheckGRPC, Service: "todo.v2.TodoService"}, addr); err == nil {
+		t.Errorf("expected the grpc check of a service which is not serving to fail")
+	}
+}
+
+func TestBreakers(t *testing.T) {
+	b := newBreakers(2, 50*time.Millisecond)
+	failure := errors.New("connection refused")
+	fail := func() {
+		done, err := b.allow("app.svc:80")
+		if err != nil {
+			t.Fatalf("expected the request to be allowed, got %v", err)
+		}
+		done(failure, true)
+	}
+
+	// Failures which say nothing about the target and successes don't add up
+	fail()
+	done, _ := b.allow("app.svc:80")
+	done(nil, true)
+	fail()
+	done, _ = b.allow("app.svc:80")
+	done(context.Canceled, true)
+	done, _ = b.allow("app.svc:80")
+	done(failure, false)
+	if state := b.status()["app.svc:80"]; state.State != BreakerClosed || state.Failures != 1 {
+		t.Fatalf("expected a closed breaker with 1 failure, got %+v", state)
+	}
+
+	fail()
+	if _, err := b.allow("app.svc:80"); !errors.Is(err, errBreakerOpen) {
+		t.Fatalf("expected the breaker to be open, got %v", err)
+	}
+
+	// After the cool-off a single request probes the target, a failed probe opens the breaker again
+	time.Sleep(60 * time.Millisecond)
+	probe, err := b.allow("app.svc:80")
+	if err != nil {
+		t.Fatalf("expected the probe to be allowed, got %v", err)
+	}
+	if _, err := b.allow("app.svc:80"); !errors.Is(err, errBreakerOpen) {
+		t.Fatalf("expected only one probe, got %v", err)
+	}
+	probe(failure, true)
+	if state := b.status()["app.svc:80"].State; state != BreakerOpen {
+		t.Fatalf("expected the breaker to open after a failed probe, got %s", state)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	probe, err = b.allow("app.svc:80")
+	if err != nil {
+		t.Fatalf("expected the probe to be allowed, got %v", err)
+	}
+	probe(nil, true)
+	if _, ok := b.status()["app.svc:80"]; ok {
+		t.Errorf("expected the breaker to be dropped after a successful probe, got %+v", b.status())
+	}
+
+	// Zero turns the breakers off
+	off := newBreakers(0, time.Second)
+	for range 3 {
+		done, err := off.allow("app.svc:80")
+		if err != nil {
+			t.Fatalf("expected the request to be allowed, got %v", err)
+		}
+		done(failure, true)
+	}
+}
+
+func TestBreakersExpire(t *testing.T) {
+	b := newBreakers(2, 50*time.Millisecond)
+	failure := errors.New("connection refused")
+	b.failed("closed.svc:80", failure)
+	b.failed("open.svc:80", failure)
+	b.failed("open.svc:80", failure)
+	if len(b.status()) != 2 {
+		t.Fatalf("expected 2 breakers, got %+v", b.status())
+	}
+
+	// A closed breaker is dropped a cool-off after its last failure
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := b.status()["closed.svc:80"]; ok {
+		t.Errorf("expected the closed breaker to expire")
+	}
+	if state := b.status()["open.svc:80"].State; state != BreakerOpen {
+		t.Fatalf("expected the open breaker to be kept until it could be probed, got %s", state)
+	}
+
+	// An open breaker nobody probed is dropped a cool-off after it could have been probed
+	time.Sleep(60 * time.Millisecond)
+	if len(b.status()) != 0 {
+		t.Errorf("expected every breaker to expire, got %+v", b.status())
+	}
+}
+
+func TestHTTPReverseProxyCircuitBreaker(t *testing.T) {
+	cfg := setupTestConfig("8081")
+	cfg.headers["X-Gozero-Target-Retries"] = "2"
+	cfg.headers["X-Gozero-Target-Backoff"] = "10ms"
+	proxy, cancel := setupProxy(t, cfg, WithBreakerThreshold(2), WithBreakerCoolOff(500*time.Millisecond))
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	get := func() (int, string) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d/pass", cfg.proxyPort), nil)
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+		for k, v := range cfg.headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// Nothing listens on the target port, every request goes through the whole retry schedule
+	for range 2 {
+		if status, body := get(); status != http.StatusBadGateway {
+			t.Fatalf("expected status code %d, got %d: %s", http.StatusBadGateway, status, body)
+		}
+	}
+
+	start := time.Now()
+	status, body := get()
+	if status != http.StatusServiceUnavailable || !strings.Contains(body, "circuit breaker is open") {
+		t.Fatalf("expected the open breaker to fail fast with %d, got %d: %s", http.StatusServiceUnavailable, status, body)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("expected the request to fail fast, took %s", elapsed)
+	}
+	if state := proxy.Breakers()["localhost:8081"]; state.State != BreakerOpen || state.Failures != 2 {
+		t.Errorf("expected an open breaker after 2 failures, got %+v", state)
+	}
+
+	// Once the cool-off is over, a request probes the target and closes the breaker
+	server := setupHTTP1Server(t, cfg.targetPort)
+	defer server.server.Shutdown(context.Background())
+	time.Sleep(500 * time.Millisecond)
+
+	if status, body := get(); status != http.StatusOK {
+		t.Fatalf("expected status code %d, got %d: %s", http.StatusOK, status, body)
+	}
+	if len(proxy.Breakers()) != 0 {
+		t.Errorf("expected no breakers after the target recovered, got %+v", proxy.Breakers())
+	}
+}
+
+func TestTimeoutSchedule(t *testing.T) {
+	schedule := timeoutSchedule(10*time.Second, 100*time.Millisecond, time.Second)
+
+	var total time.Duration
+	for i, backoff := range schedule {
+		if backoff > time.Second {
+			t.Errorf("expected backoff %d to be capped at 1s, got %s", i, backoff)
+		}
+		total += backoff
+	}
+	if total != 10*time.Second {
+		t.Errorf("expected the schedule to spread over 10s, got %s", total)
+	}
+	if schedule[0] < 50*time.Millisecond || schedule[0] > 100*time.Millisecond {
+		t.Errorf("expected the first backoff to be between 50ms and 100ms, got %s", schedule[0])
+	}
+	// 100ms, 200ms, 400ms, 800ms and then 1s at most, jittered down to half
+	if len(schedule) < 10 || len(schedule) > 25 {
+		t.Errorf("expected between 10 and 25 retries, got %d", len(schedule))
+	}
+}
+
+func TestHTTPReverseProxyTargetTimeout(t *testing.T) {
+	cfg := setupTestConfig("8081")
+	proxy, cancel := setupProxy(t, cfg)
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d/pass", cfg.proxyPort), nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	for k, v := range cfg.headers {
+		req.Header.Set(k, v)
+	}
+	// 10 retries from 100ms would wait for more than a minute
+	req.Header.Set("X-Gozero-Target-Timeout", "500ms")
+
+	// Nothing listens on the target port, the request gives up once the timeout is over
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	elapsed := time.Since(start)
+
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("expected status code %d, got %d", http.StatusGatewayTimeout, resp.StatusCode)
+	}
+	if elapsed < 500*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("expected the request to wait about 500ms, waited %s", elapsed)
+	}
+
+	// Within the timeout the request waits for the target to come up
+	req.Header.Set("X-Gozero-Target-Timeout", "5s")
+	servers := make(chan *testServer, 1)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		servers <- setupHTTP1Server(t, cfg.targetPort)
+	}()
+	defer func() {
+		server := <-servers
+		server.server.Shutdown(context.Background())
+	}()
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to make request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestHTTPReverseProxyClientGivesUp(t *testing.T) {
+	cfg := setupTestConfig("8081")
+	// After the first probe the prober would sleep for a minute
+	cfg.headers["X-Gozero-Target-Backoff"] = "1m"
+	proxy, cancel := setupProxy(t, cfg)
+	defer cancel()
+	defer proxy.Shutdown(context.Background())
+
+	ctx, cancelRequest := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancelRequest()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://localhost:%d/pass", cfg.proxyPort), nil)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	for k, v := range cfg.headers {
+		req.Header.Set(k, v)
+	}
+
+	// Nothing listens on the target port, the client gives up while its request is parked
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatalf("expected the client to give up, got status code %d", resp.StatusCode)
+	}
+
+	// The prober stops instead of sleeping through its backoff, so the next request tries the target right away
+	deadline := time.Now().Add(time.Second)
+	for proxy.room.isCold("localhost:8081") {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the prober to stop once the client gave up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got, err := testutil.GatherAndCount(metric.Registry, "gozero_cold_start_abandoned_total"); err != nil || got == 0 {
+		t.Errorf("expected the abandoned wait to be counted, got %d series: %v", got, err)
+	}
+}
+
+func TestWaitingRoomWakeStops(t *testing.T) {
+	room := newWaitingRoom(10, 100*time.Millisecond)
+	probed := make(chan struct{}, 1)
+	room.wake("app.svc:80", []time.Duration{time.Hour}, func(ctx context.Context) error {
+		probed <- struct{}{}
+		return errors.New("connection refused")
+	})
+	<-probed
+
+	// Without waiters the prober stops once the max wait of the waiting page is over
+	if !room.isCold("app.svc:80") {
+		t.Fatalf("expected the target to be cold while the waiting page is shown")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if room.isCold("app.svc:80") {
+		t.Errorf("expected the prober to stop after the max wait")
+	}
+}
+
+func TestTargetACLResolvesAllowedNames(t *testing.T) {
+	acl, err := newTargetACL([]string{"*.example.com", "localhost"}, []string{"10.0.0.0/8", "metadata.internal"}, nil)
+	if err != nil {
+		t.Fatalf("failed to create acl: %v", err)
+	}
+	addresses := map[string]string{
+		"app.example.com":    "192.0.2.10",
+		"db.example.com":     "10.1.2.3",
+		"rebind.example.com": "169.254.169.254",
+		"ula.example.com":    "fd00:ec2::254",
+		"localhost":          "127.0.0.1",
+		"metadata.internal":  "192.0.2.20",
+	}
+	acl.lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP(addresses[host])}, nil
+	}
+
+	tests := []struct {
+		name    string
+		host    string
+		allowed bool
+	}{
+		{name: "allowed name", host: "app.example.com", allowed: true},
+		{name: "allowed name pointing to a denied address", host: "db.example.com"},
+		{name: "allowed name pointing to the metadata endpoint", host: "rebind.example.com"},
+		{name: "allowed name pointing to a unique local address", host: "ula.example.com"},
+		{name: "allowed name which is denied by default", host: "localhost", allowed: true},
+		{name: "denied name", host: "metadata.internal"},
+		{name: "denied name with trailing dot", host: "metadata.internal."},
+		{name: "allowed name with trailing dot", host: "app.example.com.", allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := acl.check(context.Background(), &target{host: tt.host, port: "80"})
+			if tt.allowed && err != nil {
+				t.Errorf("expected %s to be allowed, got %v", tt.host, err)
+			}
+			if !tt.allowed && !errors.Is(err, errTargetForbidden) {
+				t.Errorf("expected %s to be forbidden, got %v", tt.host, err)
+			}
+		})
+	}
+}
+
+func TestTargetACLChecksDialedAddress(t *testing.T) {
+	acl, err := newTargetACL([]string{"*.example.com", "localhost"}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create acl: %v", err)
+	}
+	// The name points to an allowed address when it is checked
+	acl.lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("192.0.2.10")}, nil
+	}
+	if err := acl.check(context.Background(), &target{host: "app.example.com", port: "80"}); err != nil {
+		t.Fatalf("expected app.example.com to be allowed, got %v", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// and to a loopback address when it is dialed
+	dialer := &net.Dialer{Control: acl.dialControl("app.example.com")}
+	if conn, err := dialer.Dial("tcp", listener.Addr().String()); !errors.Is(err, errTargetForbidden) {
+		if conn != nil {
+			conn.Close()
+		}
+		t.Errorf("expected the dial of a denied address to be forbidden, got %v", err)
+	}
+
+	// A name which is allowed to point to a loopback address is dialed
+	dialer = &net.Dialer{Control: acl.dialControl("localhost")}
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("expected the dial of localhost to be allowed, got %v", err)
+	}
+	conn.Close()
+}
+
+func TestWaitingRoomReportsFailureOnce(t *testing.T) {
+	room := newWaitingRoom(10, 100*time.Millisecond)
+	var (
+		mu       sync.Mutex
+		failures int
+	)
+	room.onFailure = func(host string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failures++
+	}
+
+	// Every parked request times out while the target never comes up
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, "http://app.svc/", nil)
+			err := room.wait(req, "app.svc:80", 0, []time.Duration{time.Hour}, func(ctx context.Context) error {
+				return errors.New("connection refused")
+			})
+			if !errors.Is(err, errWaitTimeout) {
+				t.Errorf("expected the request to time out, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if failures != 1 {
+		t.Errorf("expected a single failure for the prober, got %d", failures)
+	}
+}
+
+func TestWaitingRoomOutlivesProber(t *testing.T) {
+	room := newWaitingRoom(10, time.Hour)
+	var failures atomic.Int32
+	room.onFailure = func(host string, err error) { failures.Add(1) }
+
+	// The prober of the first request gives up early
+	first := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, "http://app.svc/", nil)
+		first <- room.wait(req, "app.svc:80", 0, []time.Duration{20 * time.Millisecond}, func(ctx context.Context) error {
+			return errors.New("connection refused")
+		})
+	}()
+	time.Sleep(5 * time.Millisecond)
+
+	// The second request parks in the same room and goes on with its own schedule once that prober failed
+	start := time.Now()
+	var probedAt time.Duration
+	req, _ := http.NewRequest(http.MethodGet, "http://app.svc/", nil)
+	err := room.wait(req, "app.svc:80", time.Second, []time.Duration{100 * time.Millisecond, 100 * time.Millisecond}, func(ctx context.Context) error {
+		probedAt = time.Since(start)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected the request to be released, got %v", err)
+	}
+	if err := <-first; err == nil {
+		t.Errorf("expected the first request to fail")
+	}
+
+	// It doesn't restart its schedule with a probe right away
+	if probedAt < 80*time.Millisecond {
+		t.Errorf("expected the first probe after the backoff the request was in, probed after %s", probedAt)
+	}
+	if failures.Load() != 1 {
+		t.Errorf("expected the failed prober to be reported once, got %d", failures.Load())
+	}
 }
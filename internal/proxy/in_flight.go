@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/araminian/gozero/internal/metric"
+)
+
+// InFlight are the requests a target is serving right now, including open streams and upgraded connections
+type InFlight struct {
+	Count int
+	// IdleTimeout is the idle timeout of the target, zero for the default
+	IdleTimeout time.Duration
+}
+
+// inFlightTracker counts the requests in flight per target
+type inFlightTracker struct {
+	mu    sync.Mutex
+	hosts map[string]*InFlight
+}
+
+func newInFlightTracker() *inFlightTracker {
+	return &inFlightTracker{hosts: make(map[string]*InFlight)}
+}
+
+// start counts a request to the host until the returned function is called
+func (f *inFlightTracker) start(host string, idleTimeout time.Duration) func() {
+	f.mu.Lock()
+	inFlight, ok := f.hosts[host]
+	if !ok {
+		inFlight = &InFlight{}
+		f.hosts[host] = inFlight
+	}
+	inFlight.Count++
+	inFlight.IdleTimeout = idleTimeout
+	f.mu.Unlock()
+	metric.ObserveInFlight(host, 1)
+
+	return func() {
+		f.mu.Lock()
+		inFlight.Count--
+		if inFlight.Count == 0 {
+			delete(f.hosts, host)
+		}
+		f.mu.Unlock()
+		metric.ObserveInFlight(host, -1)
+	}
+}
+
+// snapshot returns the hosts with requests in flight
+func (f *inFlightTracker) snapshot() map[string]InFlight {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result := make(map[string]InFlight, len(f.hosts))
+	for host, inFlight := range f.hosts {
+		result[host] = *inFlight
+	}
+	return result
+}
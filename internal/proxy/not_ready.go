@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+
+	"github.com/araminian/gozero/internal/config"
+	"github.com/araminian/gozero/internal/route"
+)
+
+// profileRules are the rules of the built-in profiles, on top of connection errors
+var profileRules = map[string][]route.NotReadyRule{
+	route.ProfileDirect: nil,
+	route.ProfileIstio: {
+		{Status: []int{http.StatusServiceUnavailable}, Body: "no healthy upstream|upstream connect error"},
+		{GRPCStatus: []string{"UNAVAILABLE"}, Headers: map[string]string{grpcMessageHeader: "no healthy upstream|upstream connect error"}},
+	},
+	route.ProfileLinkerd: {
+		{Status: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}, Headers: map[string]string{"L5d-Proxy-Error": "."}},
+		{GRPCStatus: []string{"UNAVAILABLE"}, Headers: map[string]string{"L5d-Proxy-Error": "."}},
+	},
+	route.ProfileNginx: {
+		{Status: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}, Headers: map[string]string{"Server": "^nginx"}},
+	},
+}
+
+// notReadyClassifier tells from the result of a round trip whether the target is not ready yet
+type notReadyClassifier struct {
+	rules     []notReadyRule
+	bodyLimit int64
+}
+
+// notReadyRule is a compiled route.NotReadyRule
+type notReadyRule struct {
+	status     map[int]bool
+	grpcStatus map[codes.Code]bool
+	headers    map[string]*regexp.Regexp
+	body       *regexp.Regexp
+}
+
+// newNotReadyClassifier compiles the configured rules and the rules of the profile, the one of the config wins
+func newNotReadyClassifier(profile string, cfg *route.NotReady) (*notReadyClassifier, error) {
+	c := &notReadyClassifier{bodyLimit: defaultNotReadyBodyLimit}
+
+	var rules []route.NotReadyRule
+	if cfg != nil {
+		if cfg.Profile != "" {
+			profile = cfg.Profile
+		}
+		if cfg.BodyLimit > 0 {
+			c.bodyLimit = cfg.BodyLimit
+		}
+		rules = cfg.Rules
+	}
+	builtIn, ok := profileRules[profile]
+	if !ok {
+		return nil, fmt.Errorf("unknown not ready profile %q", profile)
+	}
+	rules = append(append([]route.NotReadyRule{}, builtIn...), rules...)
+
+	for _, r := range rules {
+		rule := notReadyRule{
+			status:     make(map[int]bool, len(r.Status)),
+			grpcStatus: make(map[codes.Code]bool, len(r.GRPCStatus)),
+			headers:    make(map[string]*regexp.Regexp, len(r.Headers)),
+		}
+		for _, status := range r.Status {
+			rule.status[status] = true
+		}
+		for _, name := range r.GRPCStatus {
+			code, err := route.GRPCCode(name)
+			if err != nil {
+				return nil, err
+			}
+			rule.grpcStatus[code] = true
+		}
+		for name, expr := range r.Headers {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression of header %s: %w", name, err)
+			}
+			rule.headers[http.CanonicalHeaderKey(name)] = re
+		}
+		if r.Body != "" {
+			re, err := regexp.Compile(r.Body)
+			if err != nil {
+				return nil, fmt.Errorf("invalid body regular expression: %w", err)
+			}
+			rule.body = re
+		}
+		c.rules = append(c.rules, rule)
+	}
+
+	return c, nil
+}
+
+// notReady returns an error if the round trip shows that the target is not able to serve requests yet.
+// A response which signals a not-ready target is closed, any other response is left readable.
+func (c *notReadyClassifier) notReady(resp *http.Response, err error, originalHost, targetHost string) error {
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	peeked := false
+	for _, rule := range c.rules {
+		if !rule.matchesHead(resp) {
+			continue
+		}
+		if rule.body != nil {
+			if isStream(resp) {
+				continue
+			}
+			// The body is read once, up to the limit, and stays readable for the client
+			if !peeked {
+				body = peekBody(resp, c.bodyLimit)
+				peeked = true
+			}
+			if !rule.body.Match(body) {
+				continue
+			}
+		}
+
+		resp.Body.Close()
+		msg := fmt.Sprintf("service '%s' -> '%s' is not available: status code: %d", originalHost, targetHost, resp.StatusCode)
+		config.Log.Debug("service is not available", zap.String("Status", resp.Status), zap.String("from", originalHost), zap.String("to", targetHost))
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+// matchesHead reports whether the status and headers of the response match the rule
+func (r *notReadyRule) matchesHead(resp *http.Response) bool {
+	if len(r.status) > 0 && !r.status[resp.StatusCode] {
+		return false
+	}
+	if len(r.grpcStatus) > 0 {
+		// Only trailers-only responses carry the status in the headers
+		code, err := strconv.Atoi(resp.Header.Get(grpcStatusHeader))
+		if err != nil || !r.grpcStatus[codes.Code(code)] {
+			return false
+		}
+	}
+	for name, re := range r.headers {
+		values := resp.Header.Values(name)
+		matched := false
+		for _, value := range values {
+			if re.MatchString(value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// isStream reports whether the body of the response stays open, so it must not be read before it is passed on
+func isStream(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		return true
+	}
+	contentType := resp.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "text/event-stream") || strings.HasPrefix(contentType, "application/grpc")
+}
+
+// peekBody returns up to limit bytes of the body which already arrived and keeps them in front of the body
+func peekBody(resp *http.Response, limit int64) []byte {
+	reader := bufio.NewReaderSize(resp.Body, int(limit))
+	// Peek waits for the first read only, a slow body is judged by what it sent so far
+	reader.Peek(1)
+	prefix, _ := reader.Peek(min(reader.Buffered(), int(limit)))
+
+	// Upgraded connections are written to through their body
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok {
+		resp.Body = struct {
+			io.Reader
+			io.WriteCloser
+		}{reader, rwc}
+	} else {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{reader, resp.Body}
+	}
+	return prefix
+}
@@ -8,4 +8,8 @@ type Proxier interface {
 	Start(ctx context.Context) error
 	Shutdown(ctx context.Context) error
 	Requests() <-chan Requests
+	Dropped() uint64
+	InFlight() map[string]InFlight
+	Health() map[string]TargetHealth
+	Breakers() map[string]TargetBreaker
 }
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/araminian/gozero/internal/config"
+)
+
+var (
+	// errStaleAttempt is returned to a transport still reading the body of an attempt which was superseded by a retry
+	errStaleAttempt = errors.New("request body belongs to a previous attempt")
+	// errBodyReleased is returned when the body is read again after the recording was dropped
+	errBodyReleased = errors.New("request body can't be replayed anymore")
+)
+
+// replayableBody records the request body while it is being sent, so a retry can send it again.
+// The body is recorded in memory up to memoryLimit bytes and spills over to a temporary file above it.
+// Recording stops once the request is committed to an attempt, the rest of the body is streamed as is.
+type replayableBody struct {
+	mu     sync.Mutex
+	readMu sync.Mutex
+
+	src         io.ReadCloser
+	srcErr      error
+	memoryLimit int64
+
+	buf       bytes.Buffer
+	file      *os.File
+	size      int64
+	recording bool
+	released  bool
+	attempt   int
+	// closed is the last attempt whose reader was closed
+	closed int
+}
+
+func newReplayableBody(src io.ReadCloser, memoryLimit int64) *replayableBody {
+	return &replayableBody{
+		src:         src,
+		memoryLimit: memoryLimit,
+		recording:   true,
+	}
+}
+
+// newReader returns the body for a new attempt. Readers of previous attempts become stale.
+func (b *replayableBody) newReader() io.ReadCloser {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempt++
+	return &replayReader{body: b, attempt: b.attempt}
+}
+
+// commit stops recording, the current attempt is the last one which reads the body
+func (b *replayableBody) commit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.recording = false
+	// The transport may have closed the body of the attempt before it returned
+	if b.closed == b.attempt {
+		b.releaseLocked()
+	}
+}
+
+// release drops the recorded body and makes every reader stale
+func (b *replayableBody) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempt++
+	b.releaseLocked()
+}
+
+func (b *replayableBody) releaseLocked() {
+	b.released = true
+	b.buf = bytes.Buffer{}
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+		b.file = nil
+	}
+}
+
+// record appends data read from the source to the recorded body
+func (b *replayableBody) record(data []byte) error {
+	if b.file == nil && int64(b.buf.Len()+len(data)) > b.memoryLimit {
+		file, err := os.CreateTemp("", "gozero-body-*")
+		if err != nil {
+			return err
+		}
+		config.Log.Debug("Request body exceeds memory limit, spilling to file", zap.Int64("limit", b.memoryLimit), zap.String("file", file.Name()))
+		if _, err := file.Write(b.buf.Bytes()); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return err
+		}
+		b.buf = bytes.Buffer{}
+		b.file = file
+	}
+
+	if b.file != nil {
+		if _, err := b.file.WriteAt(data, b.size); err != nil {
+			return err
+		}
+	} else {
+		b.buf.Write(data)
+	}
+	b.size += int64(len(data))
+	return nil
+}
+
+// readRecorded copies recorded bytes starting at offset into p
+func (b *replayableBody) readRecorded(p []byte, offset int64) (int, error) {
+	remaining := b.size - offset
+	if int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	if b.file != nil {
+		return b.file.ReadAt(p, offset)
+	}
+	return copy(p, b.buf.Bytes()[offset:]), nil
+}
+
+// replayReader is the body of a single attempt
+type replayReader struct {
+	body    *replayableBody
+	attempt int
+	offset  int64
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	b := r.body
+	for {
+		b.mu.Lock()
+		if r.attempt != b.attempt {
+			b.mu.Unlock()
+			return 0, errStaleAttempt
+		}
+		if r.offset < b.size {
+			if b.released {
+				b.mu.Unlock()
+				return 0, errBodyReleased
+			}
+			n, err := b.readRecorded(p, r.offset)
+			r.offset += int64(n)
+			b.mu.Unlock()
+			return n, err
+		}
+		if b.srcErr != nil {
+			err := b.srcErr
+			b.mu.Unlock()
+			return 0, err
+		}
+		if !b.recording {
+			// The attempt is committed and caught up with the recording, stream the rest as is
+			b.releaseLocked()
+			b.mu.Unlock()
+
+			b.readMu.Lock()
+			defer b.readMu.Unlock()
+			n, err := b.src.Read(p)
+			b.mu.Lock()
+			r.offset += int64(n)
+			b.size += int64(n)
+			if err != nil {
+				b.srcErr = err
+			}
+			b.mu.Unlock()
+			return n, err
+		}
+		b.mu.Unlock()
+
+		if err := r.fill(len(p)); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// fill reads the next chunk of the source into the recording
+func (r *replayReader) fill(size int) error {
+	b := r.body
+	b.readMu.Lock()
+	defer b.readMu.Unlock()
+
+	// Another attempt may have read the source while we were waiting
+	b.mu.Lock()
+	caughtUp := r.offset >= b.size && b.srcErr == nil
+	b.mu.Unlock()
+	if !caughtUp {
+		return nil
+	}
+
+	chunk := make([]byte, size)
+	n, err := b.src.Read(chunk)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n > 0 {
+		if recordErr := b.record(chunk[:n]); recordErr != nil {
+			b.srcErr = recordErr
+			return recordErr
+		}
+	}
+	if err != nil {
+		b.srcErr = err
+	}
+	return nil
+}
+
+// Close releases the recorded body once the committed attempt is done with it.
+// The source body is owned and closed by the server.
+func (r *replayReader) Close() error {
+	b := r.body
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if r.attempt != b.attempt {
+		return nil
+	}
+	b.closed = r.attempt
+	if !b.recording {
+		b.releaseLocked()
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/araminian/gozero/internal/config"
+	"github.com/araminian/gozero/internal/route"
+)
+
+// errTargetNotSet is returned when neither the route table nor the headers tell where to send the request
+var errTargetNotSet = errors.New("target host is not set")
+
+type targetContextKey struct{}
+
+// target is the service a request is proxied to
+type target struct {
+	host    string
+	port    string
+	scheme  string
+	retries int
+	backoff time.Duration
+	// timeout is how long a request waits for the target at most, zero to wait for the retries
+	timeout time.Duration
+	tls     upstreamTLS
+	// balancer spreads the requests over the endpoints of the target, nil to send them to host:port
+	balancer *balancer
+	// health checks the target actively, nil to only learn about it from the requests
+	health *healthChecker
+	// notReady tells from a response that the target is not ready yet
+	notReady *notReadyClassifier
+
+	// scale policy, zero values are left to the store
+	idleTimeout time.Duration
+	scaleValue  int
+	minActive   time.Duration
+	metricMode  string
+}
+
+// url returns the base URL of the target
+func (t *target) url() (*url.URL, error) {
+	return url.Parse(fmt.Sprintf("%s://%s:%s", t.scheme, t.host, t.port))
+}
+
+// request is the scale up event of a request to the target
+func (t *target) request(host, path string, received time.Time) Requests {
+	return Requests{
+		Host:        host,
+		Path:        path,
+		IdleTimeout: t.idleTimeout,
+		ScaleValue:  t.scaleValue,
+		MinActive:   t.minActive,
+		MetricMode:  t.metricMode,
+		Received:    received,
+	}
+}
+
+func withTarget(ctx context.Context, t *target) context.Context {
+	return context.WithValue(ctx, targetContextKey{}, t)
+}
+
+func targetFromContext(ctx context.Context) (*target, bool) {
+	t, ok := ctx.Value(targetContextKey{}).(*target)
+	return t, ok
+}
+
+// resolveTarget finds the target of the request. The route table is consulted first,
+// anything it doesn't set is taken from the X-Gozero-Target-* headers or the defaults.
+func (p *HTTPReverseProxy) resolveTarget(req *http.Request) (*target, error) {
+	t := &target{}
+
+	if r, ok := p.routes.Match(req.Host, req.URL.Path); ok {
+		config.Log.Debug("Matched route", zap.String("host", req.Host), zap.String("path", req.URL.Path), zap.String("to", r.Target.Host))
+		t.host = r.Target.Host
+		t.scheme = r.Target.Scheme
+		t.retries = r.Target.Retries
+		t.backoff = r.Target.Backoff
+		t.timeout = r.Target.Timeout
+		t.idleTimeout = r.Target.IdleTimeout
+		t.scaleValue = r.Target.ScaleValue
+		t.minActive = r.Target.MinActive
+		t.metricMode = r.Target.MetricMode
+		t.tls = upstreamTLS{serverName: r.Target.ServerName, insecureSkipVerify: r.Target.InsecureSkipVerify}
+		t.balancer = p.balancers[&r.Target]
+		t.health = p.healthChecks[&r.Target]
+		t.notReady = p.classifiers[&r.Target]
+		if r.Target.Port != 0 {
+			t.port = strconv.Itoa(r.Target.Port)
+		}
+	}
+
+	if t.host == "" {
+		isDev := config.GetEnvOrDefaultString("IS_DEV", "false") == "true"
+		if isDev {
+			t.host = "www.trivago.com"
+		} else {
+			t.host = req.Header.Get(targetHostHeader)
+		}
+	}
+	if t.host == "" {
+		return nil, errTargetNotSet
+	}
+
+	if t.scheme == "" {
+		t.scheme = req.Header.Get(targetSchemeHeader)
+	}
+	if t.scheme == "" {
+		t.scheme = defaultTargetScheme
+		config.Log.Debug("Target scheme is not set", zap.String("scheme", t.scheme), zap.String("from", req.URL.String()), zap.String("to", t.host))
+	}
+
+	if t.port == "" {
+		t.port = req.Header.Get(targetPortHeader)
+	}
+	if t.port == "" {
+		t.port = strconv.Itoa(defaultTargetPort)
+		config.Log.Debug("Target port is not set", zap.String("port", t.port), zap.String("from", req.URL.String()), zap.String("to", t.host))
+	}
+
+	if t.retries == 0 {
+		retries, err := strconv.Atoi(req.Header.Get(targetRetriesHeader))
+		if err != nil {
+			retries = defaultMaxRetries
+		}
+		t.retries = retries
+	}
+
+	if t.backoff == 0 {
+		backoff, err := time.ParseDuration(req.Header.Get(targetBackoffHeader))
+		if err != nil {
+			backoff = defaultInitialBackoff
+		}
+		t.backoff = backoff
+	}
+
+	if t.timeout == 0 {
+		// Without a timeout the request waits for the retries, at most the max wait
+		if timeout, err := time.ParseDuration(req.Header.Get(targetTimeoutHeader)); err == nil && timeout > 0 {
+			t.timeout = timeout
+		}
+	}
+
+	if t.notReady == nil {
+		t.notReady = p.profiles[p.notReadyProfile]
+		if profile, ok := p.profiles[req.Header.Get(notReadyProfileHeader)]; ok {
+			t.notReady = profile
+		}
+	}
+
+	t.resolveScalePolicy(req, p.scaleLimits)
+
+	return t, nil
+}
+
+// scaleLimits are the highest scale policy the headers can ask for, the route table isn't limited
+type scaleLimits struct {
+	idleTimeout time.Duration
+	minActive   time.Duration
+	scaleValue  int
+}
+
+// resolveScalePolicy fills the scale policy the route table didn't set from the headers.
+// Invalid header values are ignored so the defaults apply, values above the limits are lowered to them.
+func (t *target) resolveScalePolicy(req *http.Request, limits scaleLimits) {
+	if t.idleTimeout == 0 {
+		if idleTimeout, err := time.ParseDuration(req.Header.Get(idleTimeoutHeader)); err == nil && idleTimeout > 0 {
+			t.idleTimeout = min(idleTimeout, limits.idleTimeout)
+		}
+	}
+
+	if t.scaleValue == 0 {
+		if scaleValue, err := strconv.Atoi(req.Header.Get(scaleValueHeader)); err == nil && scaleValue > 0 {
+			t.scaleValue = min(scaleValue, limits.scaleValue)
+		}
+	}
+
+	if t.minActive == 0 {
+		if minActive, err := time.ParseDuration(req.Header.Get(minActiveHeader)); err == nil && minActive > 0 {
+			t.minActive = min(minActive, limits.minActive)
+		}
+	}
+
+	if t.metricMode == "" {
+		switch mode := req.Header.Get(metricModeHeader); mode {
+		case "":
+		case route.MetricModeValue, route.MetricModeRate:
+			t.metricMode = mode
+		default:
+			config.Log.Debug("Ignoring unsupported metric mode", zap.String("mode", mode), zap.String("to", t.host))
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package proxy
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
@@ -9,111 +8,421 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"strconv"
+	"net/http/httptrace"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eapache/go-resiliency/retrier"
 	"go.uber.org/zap"
 	"golang.org/x/net/http2"
 
+	"github.com/araminian/gozero/internal/coldstart"
 	"github.com/araminian/gozero/internal/config"
+	"github.com/araminian/gozero/internal/metric"
 )
 
-// retryRoundTripper implements retry logic for HTTP requests
+// retryRoundTripper sends requests to the target and parks them in the waiting room
+// while the target is cold, instead of retrying every request against the upstream
 type retryRoundTripper struct {
-	next http.RoundTripper
+	next           http.RoundTripper
+	room           *waitingRoom
+	bodyBufferSize int64
+	coldStarts     *coldstart.Tracker
+	waitingPage    *waitingPage
+	breakers       *breakers
+	// notReady is used for requests without a target
+	notReady *notReadyClassifier
 }
 
 func (rr *retryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	maxRetries, err := strconv.Atoi(req.Header.Get(targetRetriesHeader))
-	if err != nil {
-		maxRetries = defaultMaxRetries
+	// Record the body while it is sent, so it can be sent again after the target is ready
+	var body *replayableBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = newReplayableBody(req.Body, rr.bodyBufferSize)
+		req.GetBody = func() (io.ReadCloser, error) {
+			return body.newReader(), nil
+		}
 	}
 
-	backoff, err := time.ParseDuration(req.Header.Get(targetBackoffHeader))
-	if err != nil {
-		backoff = defaultInitialBackoff
+	resp, err := rr.roundTrip(req, body)
+	if body != nil {
+		if err != nil {
+			body.release()
+		} else {
+			body.commit()
+		}
 	}
 
-	re := retrier.New(retrier.ExponentialBackoff(maxRetries, backoff), nil)
-
-	var resp *http.Response
-	var respErr error
+	return resp, err
+}
 
+func (rr *retryRoundTripper) roundTrip(req *http.Request, body *replayableBody) (resp *http.Response, err error) {
 	targetHost := req.Host
 	originalHost := req.Header.Get("X-Forwarded-Host")
+	start := time.Now()
 
-	respErr = re.Run(func() error {
+	// A target which failed too often in a row fails fast until its cool-off is over
+	done, err := rr.breakers.allow(targetHost)
+	if err != nil {
+		return nil, err
+	}
+	verdict := true
+	defer func() { done(err, verdict) }()
+
+	t, hasTarget := targetFromContext(req.Context())
+	var health *healthChecker
+	classifier := rr.notReady
+	if hasTarget {
+		health = t.health
+		classifier = t.notReady
+	}
+	notReady := classifier.notReady
+
+	// With a health check, only a healthy target gets requests right away and a failing one fails fast
+	healthy := true
+	if health != nil {
+		switch health.use(req.Context()) {
+		case HealthFailing:
+			return nil, fmt.Errorf("%w: '%s' -> '%s'", errTargetFailing, originalHost, targetHost)
+		case HealthWaking:
+			healthy = false
+		}
+	}
+
+	// Requests for a target which is known to be cold don't hit the upstream until the prober says so
+	if healthy && !rr.room.isCold(targetHost) {
 		config.Log.Debug("Sending request", zap.String("from", originalHost), zap.String("to", targetHost))
-		resp, respErr = rr.next.RoundTrip(req)
-		if respErr != nil {
-			config.Log.Debug("Request failed, will retry", zap.Error(respErr), zap.String("from", originalHost), zap.String("to", targetHost))
-			return respErr
+		resp, wrote, err := rr.send(req, body)
+		// The target resolved to a forbidden address when it was dialed, it won't become ready
+		if errors.Is(err, errTargetForbidden) {
+			verdict = false
+			return nil, err
+		}
+		notReadyErr := notReady(resp, err, originalHost, targetHost)
+		if notReadyErr == nil {
+			rr.coldStarts.Served(targetHost, time.Now())
+			return resp, nil
 		}
 
-		noHealthyUpstreamValue := "no healthy upstream"
-		noHealthyUpstreamStatusCode := http.StatusServiceUnavailable
+		// A failed connection which already carried the request may have reached the service
+		if err != nil && wrote && !isIdempotent(req) && req.Header.Get(retryNonIdempotentHeader) != "true" {
+			msg := fmt.Sprintf("request '%s' -> '%s' failed after it was sent, not retrying non-idempotent %s request: %v", originalHost, targetHost, req.Method, err)
+			config.Log.Error("not retrying non-idempotent request", zap.String("from", originalHost), zap.String("To", targetHost), zap.String("method", req.Method), zap.Error(err))
+			return nil, errors.New(msg)
+		}
+		config.Log.Debug("Request failed, waiting for service", zap.Error(notReadyErr), zap.String("from", originalHost), zap.String("to", targetHost))
+	}
 
-		if resp.StatusCode == noHealthyUpstreamStatusCode {
-			bodyBytes, err := io.ReadAll(resp.Body)
-			resp.Body.Close()
-			resp.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+	maxRetries, backoff, timeout := defaultMaxRetries, defaultInitialBackoff, time.Duration(0)
+	if hasTarget {
+		maxRetries, backoff, timeout = t.retries, t.backoff, t.timeout
+	}
+	// The timeout is the total wait of the request, including the attempts so far
+	if timeout > 0 {
+		timeout = max(timeout-time.Since(start), time.Millisecond)
+	}
 
-			if err == nil && strings.Contains(string(bodyBytes), noHealthyUpstreamValue) {
-				msg := fmt.Sprintf("service '%s' -> '%s' is not available: status code: %d", originalHost, targetHost, resp.StatusCode)
-				config.Log.Debug("service is not available", zap.String("Status", resp.Status), zap.String("from", originalHost), zap.String("to", targetHost))
-				return errors.New(msg)
-			}
-		}
+	rr.coldStarts.Cold(targetHost, coldstart.ReasonUpstreamUnavailable, start)
 
+	probe := func(ctx context.Context) error {
+		metric.ObserveRetryAttempt(targetHost)
+		resp, err := rr.next.RoundTrip(newProbeRequest(ctx, req))
+		if notReadyErr := notReady(resp, err, originalHost, targetHost); notReadyErr != nil {
+			return notReadyErr
+		}
+		resp.Body.Close()
 		return nil
-	})
+	}
+	schedule := retrier.ExponentialBackoff(maxRetries, backoff)
+	if timeout > 0 {
+		schedule = timeoutSchedule(timeout, backoff, defaultMaxBackoff)
+	}
+	// The health check tells when the target is ready, instead of the request
+	if health != nil {
+		probe = func(ctx context.Context) error {
+			metric.ObserveRetryAttempt(targetHost)
+			return health.probe(ctx)
+		}
+		maxWait := rr.room.maxWait
+		if timeout > 0 {
+			maxWait = min(maxWait, timeout)
+		}
+		schedule = health.schedule(maxWait)
+	}
 
-	if respErr != nil {
-		msg := fmt.Sprintf("all retry attempts failed for service '%s' -> '%s': %v. Service failed to scaled up or not passing probes", originalHost, targetHost, respErr)
-		config.Log.Error("all retry attempts failed", zap.String("from", originalHost), zap.String("To", targetHost), zap.Error(respErr))
-		return resp, errors.New(msg)
+	// Browsers get the waiting page right away, the target is probed in the background
+	if rr.waitingPage != nil && wantsWaitingPage(req) {
+		config.Log.Debug("Returning waiting page", zap.String("from", originalHost), zap.String("to", targetHost))
+		rr.room.wake(targetHost, schedule, probe)
+		verdict = false
+		return rr.waitingPage.response(req)
 	}
 
+	waitStart := time.Now()
+	err = rr.room.wait(req, targetHost, timeout, schedule, probe)
+	outcome := waitOutcome(err)
+	metric.ObserveColdStartWait(targetHost, outcome, time.Since(waitStart))
+	if outcome == "canceled" || outcome == "deadline" {
+		// The client went away or its deadline is over, the prober stops once nobody else waits
+		config.Log.Info("Client gave up waiting for service", zap.String("from", originalHost), zap.String("to", targetHost), zap.String("reason", outcome), zap.Duration("waited", time.Since(waitStart)))
+		metric.ObserveAbandonedWait(targetHost, outcome)
+	}
+	if err != nil {
+		// The waiting room counts a failed wait once per prober, not once per parked request
+		verdict = false
+		return nil, err
+	}
+
+	config.Log.Debug("Sending released request", zap.String("from", originalHost), zap.String("to", targetHost))
+	resp, _, err = rr.send(req, body)
+	if notReadyErr := notReady(resp, err, originalHost, targetHost); notReadyErr != nil {
+		msg := fmt.Sprintf("service '%s' -> '%s' is still not available after it became ready: %v", originalHost, targetHost, notReadyErr)
+		config.Log.Error("service is not available after release", zap.String("from", originalHost), zap.String("To", targetHost), zap.Error(notReadyErr))
+		return nil, errors.New(msg)
+	}
+
+	rr.coldStarts.Served(targetHost, time.Now())
 	return resp, nil
 }
 
-// conditionalTransport handles both HTTP/1.1 and HTTP/2 transports
-type conditionalTransport struct {
-	h2Transport *http2.Transport
-	h1Transport *http.Transport
+// send sends a single attempt of the request with a fresh copy of the body.
+// It reports whether the request headers were written to an upstream connection.
+func (rr *retryRoundTripper) send(req *http.Request, body *replayableBody) (*http.Response, bool, error) {
+	var wrote atomic.Bool
+	trace := &httptrace.ClientTrace{
+		WroteHeaders: func() {
+			wrote.Store(true)
+		},
+	}
+
+	attempt := req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	if body != nil {
+		attempt.Body = body.newReader()
+	}
+
+	start := time.Now()
+	resp, err := rr.next.RoundTrip(attempt)
+	metric.ObserveUpstream(req.Host, time.Since(start))
+	return resp, wrote.Load(), err
 }
 
-// newConditionalTransport creates a new transport that can handle both HTTP/1.1 and HTTP/2
-func newConditionalTransport() *conditionalTransport {
-	http2Transport := &http2.Transport{
-		AllowHTTP: true,
-		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
-			return net.Dial(network, addr)
-		},
+// waitOutcome is the outcome label of a request which waited for a cold target
+func waitOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "ready"
+	case errors.Is(err, errQueueFull):
+		return "queue_full"
+	case errors.Is(err, errWaitTimeout):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "deadline"
+	default:
+		return "failed"
 	}
+}
 
-	http1Transport := &http.Transport{
-		IdleConnTimeout:       defaultIdleTimeout,
-		TLSHandshakeTimeout:   defaultTLSHandshakeTimeout,
-		ResponseHeaderTimeout: defaultResponseHeaderTimeout,
-		DialContext: (&net.Dialer{
-			Timeout: defaultDialTimeout,
-		}).DialContext,
+// isIdempotent reports whether the request can be safely sent twice
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
 	}
+	// Same convention as net/http: a request with an idempotency key can be retried
+	_, hasKey := req.Header["Idempotency-Key"]
+	_, hasXKey := req.Header["X-Idempotency-Key"]
+	return hasKey || hasXKey
+}
 
+// newProbeRequest builds the body-less request the prober uses to check if the target is reachable.
+// It keeps the protocol and headers of the original request, so the probe takes the same route.
+func newProbeRequest(ctx context.Context, req *http.Request) *http.Request {
+	// The probe outlives the request and ends with the prober, but it needs the TLS settings of the target
+	if t, ok := targetFromContext(req.Context()); ok {
+		ctx = withTarget(ctx, t)
+	}
+	probe := req.Clone(ctx)
+	probe.Method = http.MethodGet
+	probe.Body = nil
+	probe.GetBody = nil
+	probe.ContentLength = 0
+	probe.Header.Del("Content-Length")
+	// The probe must not switch protocols, it only checks if the target answers
+	probe.Header.Del("Connection")
+	probe.Header.Del("Upgrade")
+	for name := range probe.Header {
+		if strings.HasPrefix(name, "Sec-Websocket-") {
+			probe.Header.Del(name)
+		}
+	}
+	return probe
+}
+
+// upstreamTLS are the TLS settings of a target which differ from the defaults of the proxy.
+// They only come from the route table, so there is a bounded number of them.
+type upstreamTLS struct {
+	// serverName overrides the SNI and the name the certificate of the target is verified against
+	serverName         string
+	insecureSkipVerify bool
+}
+
+// protocolTransports are the transports for a set of TLS settings
+type protocolTransports struct {
+	h1 *http.Transport
+	// h2 speaks HTTP/2 over TLS to https targets, negotiated with ALPN
+	h2 *http2.Transport
+	// h2c speaks HTTP/2 in cleartext to http targets
+	h2c *http2.Transport
+}
+
+// conditionalTransport handles both HTTP/1.1 and HTTP/2 transports.
+// Targets with their own TLS settings get their own transports, so they never share connections.
+type conditionalTransport struct {
+	tlsConfig *tls.Config
+	// acl checks the addresses the targets are dialed at
+	acl *targetACL
+
+	mu         sync.Mutex
+	transports map[transportKey]*protocolTransports
+}
+
+// transportKey tells which transports a request uses
+type transportKey struct {
+	tls upstreamTLS
+	// balanced requests go to the endpoints of the route table, which the ACL doesn't check
+	balanced bool
+}
+
+// newConditionalTransport creates a new transport that can handle both HTTP/1.1 and HTTP/2.
+// The TLS config holds the CAs and the client certificate for https targets.
+func newConditionalTransport(tlsConfig *tls.Config, acl *targetACL) *conditionalTransport {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
 	return &conditionalTransport{
-		h2Transport: http2Transport,
-		h1Transport: http1Transport,
+		tlsConfig:  tlsConfig,
+		acl:        acl,
+		transports: make(map[transportKey]*protocolTransports),
+	}
+}
+
+// transportsFor returns the transports for the TLS settings, creating them on first use
+func (t *conditionalTransport) transportsFor(key transportKey) *protocolTransports {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if transports, ok := t.transports[key]; ok {
+		return transports
+	}
+
+	settings := key.tls
+	dialer := func(addr string) *net.Dialer {
+		d := &net.Dialer{Timeout: defaultDialTimeout}
+		if t.acl != nil && !key.balanced {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			d.Control = t.acl.dialControl(host)
+		}
+		return d
+	}
+
+	tlsConfig := t.tlsConfig.Clone()
+	if settings.serverName != "" {
+		tlsConfig.ServerName = settings.serverName
+	}
+	tlsConfig.InsecureSkipVerify = settings.insecureSkipVerify
+
+	transports := &protocolTransports{
+		h1: &http.Transport{
+			IdleConnTimeout:       defaultIdleTimeout,
+			TLSHandshakeTimeout:   defaultTLSHandshakeTimeout,
+			ResponseHeaderTimeout: defaultResponseHeaderTimeout,
+			TLSClientConfig:       tlsConfig,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer(addr).DialContext(ctx, network, addr)
+			},
+		},
+		h2: &http2.Transport{
+			TLSClientConfig: tlsConfig,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := (&tls.Dialer{NetDialer: dialer(addr), Config: cfg}).DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				if protocol := conn.(*tls.Conn).ConnectionState().NegotiatedProtocol; protocol != http2.NextProtoTLS {
+					conn.Close()
+					return nil, fmt.Errorf("target %s negotiated protocol %q instead of %q", addr, protocol, http2.NextProtoTLS)
+				}
+				return conn, nil
+			},
+		},
+		h2c: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dialer(addr).DialContext(ctx, network, addr)
+			},
+		},
 	}
+	t.transports[key] = transports
+	return transports
 }
 
 func (t *conditionalTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	if req.Proto == "HTTP/2.0" {
+	target, ok := targetFromContext(req.Context())
+	if !ok {
+		return t.roundTrip(req, transportKey{})
+	}
+
+	var settings upstreamTLS
+	if req.URL.Scheme == "https" {
+		settings = target.tls
+	}
+	if target.balancer == nil {
+		return t.roundTrip(req, transportKey{tls: settings})
+	}
+
+	e, err := target.balancer.pick(req)
+	if err != nil {
+		return nil, err
+	}
+	// The request goes to the endpoint, but the Host header and the certificate stay the ones of the target
+	out := *req
+	u := *req.URL
+	u.Host = e.addr
+	out.URL = &u
+	if req.URL.Scheme == "https" && settings.serverName == "" {
+		settings.serverName = target.host
+	}
+
+	config.Log.Debug("Balancing request", zap.String("to", target.host), zap.String("endpoint", e.addr))
+	e.active.Add(1)
+	resp, err := t.roundTrip(&out, transportKey{tls: settings, balanced: true})
+	if err != nil {
+		target.balancer.done(e, err)
+		return nil, err
+	}
+	resp.Body = trackBody(resp.Body, func() { target.balancer.done(e, nil) })
+	return resp, nil
+}
+
+// roundTrip sends the request with the transport for its protocol and TLS settings
+func (t *conditionalTransport) roundTrip(req *http.Request, key transportKey) (*http.Response, error) {
+	transports := t.transportsFor(key)
+
+	// Over TLS, HTTP/2 is negotiated by ALPN and says nothing about the target, only gRPC needs it
+	if req.Proto == "HTTP/2.0" && (req.TLS == nil || isGRPC(req)) {
 		config.Log.Debug("Protocol: HTTP/2.0, Using HTTP/2 transport for request", zap.String("url", req.URL.String()))
-		return t.h2Transport.RoundTrip(req)
+		if req.URL.Scheme == "https" {
+			return transports.h2.RoundTrip(req)
+		}
+		return transports.h2c.RoundTrip(req)
 	}
 	config.Log.Debug("Protocol: HTTP/1.1, Using HTTP/1.1 transport for request", zap.String("url", req.URL.String()))
-	return t.h1Transport.RoundTrip(req)
+	return transports.h1.RoundTrip(req)
 }
@@ -1,7 +1,14 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"fmt"
 	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/araminian/gozero/internal/coldstart"
+	"github.com/araminian/gozero/internal/route"
 )
 
 // HTTPReverseProxyConfig is a function type for configuring the proxy
@@ -9,8 +16,28 @@ type HTTPReverseProxyConfig func(*httpReverseProxyConfig) error
 
 // httpReverseProxyConfig holds the configuration for the HTTP reverse proxy
 type httpReverseProxyConfig struct {
-	listenPort    *int
-	requestBuffer *int
+	listenPort       *int
+	requestBuffer    *int
+	queueDepth       *int
+	maxWait          *time.Duration
+	bodyBuffer       *int64
+	routes           *route.Table
+	allowTargets     []string
+	denyTargets      []string
+	targetPorts      []int
+	coldStarts       *coldstart.Tracker
+	waitingPage      *string
+	pageRefresh      *time.Duration
+	certificates     []certificateFiles
+	tlsReload        *time.Duration
+	upstreamCA       *string
+	clientCert       *certificateFiles
+	notReady         *string
+	breakerThreshold *int
+	breakerCoolOff   *time.Duration
+	maxIdleTimeout   *time.Duration
+	maxMinActive     *time.Duration
+	maxScaleValue    *int
 }
 
 // WithBufferSize sets the buffer size for the proxy
@@ -29,16 +56,255 @@ func WithListenPort(port int) HTTPReverseProxyConfig {
 	}
 }
 
+// WithQueueDepth sets how many requests can wait for a single cold target
+func WithQueueDepth(depth int) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		if depth <= 0 {
+			return fmt.Errorf("queue depth must be positive, got %d", depth)
+		}
+		cfg.queueDepth = &depth
+		return nil
+	}
+}
+
+// WithMaxWait sets how long a request waits for a cold target before giving up
+func WithMaxWait(wait time.Duration) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		if wait <= 0 {
+			return fmt.Errorf("max wait must be positive, got %s", wait)
+		}
+		cfg.maxWait = &wait
+		return nil
+	}
+}
+
+// WithBodyBufferSize sets how many bytes of a request body are kept in memory for retries,
+// larger bodies are spilled to a temporary file
+func WithBodyBufferSize(size int64) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		if size < 0 {
+			return fmt.Errorf("body buffer size must not be negative, got %d", size)
+		}
+		cfg.bodyBuffer = &size
+		return nil
+	}
+}
+
+// WithRouteTable sets the static route table which is consulted before the X-Gozero-Target-* headers
+func WithRouteTable(table *route.Table) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		cfg.routes = table
+		return nil
+	}
+}
+
+// WithTargetAllowlist sets the targets the proxy may forward to: hosts, DNS suffixes (*.svc.cluster.local) or CIDRs.
+// Once set, any other target is rejected.
+func WithTargetAllowlist(entries ...string) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		cfg.allowTargets = append(cfg.allowTargets, entries...)
+		return nil
+	}
+}
+
+// WithTargetDenylist sets the targets the proxy must never forward to: hosts, DNS suffixes or CIDRs
+func WithTargetDenylist(entries ...string) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		cfg.denyTargets = append(cfg.denyTargets, entries...)
+		return nil
+	}
+}
+
+// WithTargetPorts restricts the target ports the proxy may forward to
+func WithTargetPorts(ports ...int) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		for _, port := range ports {
+			if port <= 0 || port > 65535 {
+				return fmt.Errorf("invalid target port %d", port)
+			}
+		}
+		cfg.targetPorts = append(cfg.targetPorts, ports...)
+		return nil
+	}
+}
+
+// WithColdStartTracker sets the tracker which measures the cold starts of the targets
+func WithColdStartTracker(tracker *coldstart.Tracker) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		cfg.coldStarts = tracker
+		return nil
+	}
+}
+
+// WithWaitingPage returns a waiting page to browsers which open a cold target, instead of holding
+// their request until the target is ready. The template file is a Go html/template, empty for the built-in page.
+func WithWaitingPage(templateFile string) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		cfg.waitingPage = &templateFile
+		return nil
+	}
+}
+
+// WithWaitingPageRefresh sets how often the waiting page checks whether the target is ready
+func WithWaitingPageRefresh(refresh time.Duration) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		if refresh < time.Second {
+			return fmt.Errorf("waiting page refresh must be at least 1s, got %s", refresh)
+		}
+		cfg.pageRefresh = &refresh
+		return nil
+	}
+}
+
+// WithTLSCertificate terminates TLS on the listener with the certificate and key files. It can be given
+// several times, the certificate is then picked by SNI and the first one is the default.
+func WithTLSCertificate(certFile, keyFile string) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		if certFile == "" || keyFile == "" {
+			return fmt.Errorf("TLS certificate needs both a certificate and a key file")
+		}
+		cfg.certificates = append(cfg.certificates, certificateFiles{certFile: certFile, keyFile: keyFile})
+		return nil
+	}
+}
+
+// WithTLSReloadInterval sets how often the certificate files are checked for changes
+func WithTLSReloadInterval(interval time.Duration) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		if interval <= 0 {
+			return fmt.Errorf("TLS reload interval must be positive, got %s", interval)
+		}
+		cfg.tlsReload = &interval
+		return nil
+	}
+}
+
+// WithUpstreamCA trusts the CAs in the PEM file for https targets, in addition to the system CAs
+func WithUpstreamCA(caFile string) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		cfg.upstreamCA = &caFile
+		return nil
+	}
+}
+
+// WithUpstreamClientCertificate presents the certificate to https targets which ask for one (mTLS).
+// The files are reloaded like the certificates of the listener.
+func WithUpstreamClientCertificate(certFile, keyFile string) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		if certFile == "" || keyFile == "" {
+			return fmt.Errorf("upstream client certificate needs both a certificate and a key file")
+		}
+		cfg.clientCert = &certificateFiles{certFile: certFile, keyFile: keyFile}
+		return nil
+	}
+}
+
+// WithNotReadyProfile sets the built-in profile which tells from a response that a target is not ready yet:
+// direct, istio (default), linkerd or nginx. Route targets and the X-Gozero-Not-Ready-Profile header override it.
+func WithNotReadyProfile(profile string) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		if !route.IsProfile(profile) {
+			return fmt.Errorf("unknown not ready profile %q", profile)
+		}
+		cfg.notReady = &profile
+		return nil
+	}
+}
+
+// WithBreakerThreshold sets after how many failed requests in a row the circuit breaker of a target opens,
+// zero turns the breakers off
+func WithBreakerThreshold(failures int) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		if failures < 0 {
+			return fmt.Errorf("breaker threshold must not be negative, got %d", failures)
+		}
+		cfg.breakerThreshold = &failures
+		return nil
+	}
+}
+
+// WithBreakerCoolOff sets how long requests to a target fail fast once its circuit breaker opened
+func WithBreakerCoolOff(coolOff time.Duration) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		if coolOff <= 0 {
+			return fmt.Errorf("breaker cool-off must be positive, got %s", coolOff)
+		}
+		cfg.breakerCoolOff = &coolOff
+		return nil
+	}
+}
+
+// WithMaxIdleTimeout sets the longest idle timeout the X-Gozero-Idle-Timeout header can ask for
+func WithMaxIdleTimeout(idleTimeout time.Duration) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		if idleTimeout <= 0 {
+			return fmt.Errorf("max idle timeout must be positive, got %s", idleTimeout)
+		}
+		cfg.maxIdleTimeout = &idleTimeout
+		return nil
+	}
+}
+
+// WithMaxMinActive sets the longest min active the X-Gozero-Min-Active header can ask for
+func WithMaxMinActive(minActive time.Duration) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		if minActive <= 0 {
+			return fmt.Errorf("max min active must be positive, got %s", minActive)
+		}
+		cfg.maxMinActive = &minActive
+		return nil
+	}
+}
+
+// WithMaxScaleValue sets the highest scale value the X-Gozero-Scale-Value header can ask for
+func WithMaxScaleValue(value int) HTTPReverseProxyConfig {
+	return func(cfg *httpReverseProxyConfig) error {
+		if value <= 0 {
+			return fmt.Errorf("max scale value must be positive, got %d", value)
+		}
+		cfg.maxScaleValue = &value
+		return nil
+	}
+}
+
 // HTTPReverseProxy is the main proxy structure
 type HTTPReverseProxy struct {
 	listenPort        int
 	httpServer        *http.Server
 	requestBufferSize int
 	requestsCh        chan Requests
+	queueDepth        int
+	maxWait           time.Duration
+	bodyBufferSize    int64
+	routes            *route.Table
+	balancers         map[*route.Target]*balancer
+	healthChecks      map[*route.Target]*healthChecker
+	classifiers       map[*route.Target]*notReadyClassifier
+	profiles          map[string]*notReadyClassifier
+	notReadyProfile   string
+	acl               *targetACL
+	coldStarts        *coldstart.Tracker
+	room              *waitingRoom
+	breakers          *breakers
+	waitingPage       *waitingPage
+	inFlight          *inFlightTracker
+	certificates      *certificates
+	tlsReload         time.Duration
+	clientCerts       *certificates
+	upstreamTLS       *tls.Config
+	scaleLimits       scaleLimits
+	dropped           atomic.Uint64
 }
 
 // Requests represents a proxy request
 type Requests struct {
 	Host string
 	Path string
+	// Scale policy of the target, zero values mean the defaults of the store
+	IdleTimeout time.Duration
+	ScaleValue  int
+	MinActive   time.Duration
+	MetricMode  string
+	// Received is when the request arrived
+	Received time.Time
 }
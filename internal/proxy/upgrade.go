@@ -0,0 +1,12 @@
+package proxy
+
+import (
+	"net/http"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// isUpgrade reports whether the request asks to switch protocols, e.g. to a WebSocket
+func isUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && httpguts.HeaderValuesContainsToken(r.Header["Connection"], "Upgrade")
+}
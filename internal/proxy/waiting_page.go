@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// waitingPageStatusPath is polled by the waiting page to find out if the target is ready.
+// Only polls with the token of a page being served are answered by the proxy, the others go to the target.
+const waitingPageStatusPath = "/.well-known/gozero/status"
+
+//go:embed waiting_page.html
+var defaultWaitingPage string
+
+// waitingPage is returned to browsers instead of holding their request while the target is cold
+type waitingPage struct {
+	tmpl    *template.Template
+	refresh time.Duration
+
+	mu sync.Mutex
+	// tokens are the tokens of the pages being served by target, they expire once nobody polled for a few refreshes
+	tokens map[string]*pageToken
+}
+
+// pageToken tells the polls of a waiting page from requests of the target for the status path
+type pageToken struct {
+	value   string
+	expires time.Time
+}
+
+// waitingPageData is what a waiting page template can use
+type waitingPageData struct {
+	// Host is the host the browser asked for
+	Host string
+	// Target is the target which is starting
+	Target           string
+	StatusPath       string
+	RefreshSeconds   int
+	PollMilliseconds int64
+}
+
+// newWaitingPage parses the template of the waiting page, the built-in page if file is empty
+func newWaitingPage(file string, refresh time.Duration) (*waitingPage, error) {
+	text := defaultWaitingPage
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read waiting page template: %w", err)
+		}
+		text = string(content)
+	}
+
+	tmpl, err := template.New("waiting_page").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse waiting page template: %w", err)
+	}
+
+	return &waitingPage{tmpl: tmpl, refresh: refresh, tokens: make(map[string]*pageToken)}, nil
+}
+
+// token returns the token of the pages of the target, it is created for the first page
+func (p *waitingPage) token(target string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	t, ok := p.tokens[target]
+	if !ok || now.After(t.expires) {
+		for host, t := range p.tokens {
+			if now.After(t.expires) {
+				delete(p.tokens, host)
+			}
+		}
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", fmt.Errorf("failed to create waiting page token: %w", err)
+		}
+		t = &pageToken{value: hex.EncodeToString(b)}
+		p.tokens[target] = t
+	}
+	t.expires = now.Add(p.tokenTTL())
+	return t.value, nil
+}
+
+// isPoll reports whether the request polls the status of a waiting page of the target, it keeps the token valid
+func (p *waitingPage) isPoll(req *http.Request, target string) bool {
+	if req.URL.Path != waitingPageStatusPath {
+		return false
+	}
+	token := req.URL.Query().Get("token")
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.tokens[target]
+	if !ok || token != t.value || time.Now().After(t.expires) {
+		return false
+	}
+	t.expires = time.Now().Add(p.tokenTTL())
+	return true
+}
+
+// tokenTTL is how long a token is valid after the last page or poll, a few polls may get lost
+func (p *waitingPage) tokenTTL() time.Duration {
+	return 3 * max(p.refresh, time.Second)
+}
+
+// response renders the waiting page for the request to a cold target
+func (p *waitingPage) response(req *http.Request) (*http.Response, error) {
+	host := req.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = req.Host
+	}
+
+	token, err := p.token(req.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	err = p.tmpl.Execute(&body, waitingPageData{
+		Host:             host,
+		Target:           req.Host,
+		StatusPath:       waitingPageStatusPath + "?token=" + token,
+		RefreshSeconds:   int(p.refresh.Seconds()),
+		PollMilliseconds: p.refresh.Milliseconds(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to render waiting page: %w", err)
+	}
+
+	header := make(http.Header)
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Cache-Control", "no-store")
+	header.Set("Retry-After", strconv.Itoa(int(p.refresh.Seconds())))
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable)),
+		StatusCode:    http.StatusServiceUnavailable,
+		Proto:         req.Proto,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		Header:        header,
+		Body:          io.NopCloser(&body),
+		ContentLength: int64(body.Len()),
+		Request:       req,
+	}, nil
+}
+
+// serveWaitingPageStatus tells the waiting page whether the target is ready
+func serveWaitingPageStatus(w http.ResponseWriter, ready bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]bool{"ready": ready})
+}
+
+// wantsWaitingPage reports whether the request comes from a browser navigating to a page.
+// API, gRPC and upgrade requests keep waiting for the target.
+func wantsWaitingPage(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.Header.Get("Upgrade") != "" {
+		return false
+	}
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+		return false
+	}
+	return prefersHTML(req.Header.Get("Accept"))
+}
+
+// prefersHTML reports whether text/html has the highest quality in the Accept header
+func prefersHTML(accept string) bool {
+	html, best := 0.0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(param, "=")
+			if !ok || strings.TrimSpace(key) != "q" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				quality = q
+			}
+		}
+
+		if strings.EqualFold(strings.TrimSpace(mediaType), "text/html") {
+			html = max(html, quality)
+		}
+		best = max(best, quality)
+	}
+	return html > 0 && html >= best
+}
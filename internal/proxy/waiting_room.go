@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/eapache/go-resiliency/retrier"
+	"go.uber.org/zap"
+
+	"github.com/araminian/gozero/internal/config"
+)
+
+var (
+	// errQueueFull is returned when too many requests are already waiting for a cold target
+	errQueueFull = errors.New("too many requests are waiting for the service to start")
+	// errWaitTimeout is returned when a parked request waited longer than the configured max wait
+	errWaitTimeout = errors.New("timed out waiting for the service to start")
+	// errNoWaiters stops the prober once every parked request has given up
+	errNoWaiters = errors.New("no requests are waiting for the service")
+)
+
+// room holds the requests parked for a single cold target
+type room struct {
+	ready   chan struct{}
+	waiters int
+	// keepUntil keeps the prober running without waiters, see wake
+	keepUntil time.Time
+	// stop cancels the prober once nobody waits for it anymore
+	stop      context.CancelFunc
+	stopTimer *time.Timer
+	err       error
+	// failed is set once a parked request reported that the target didn't come up
+	failed bool
+}
+
+// waitingRoom parks requests for cold targets until a single prober per target
+// finds the target reachable, then releases all of them at once.
+type waitingRoom struct {
+	mu       sync.Mutex
+	rooms    map[string]*room
+	maxDepth int
+	maxWait  time.Duration
+	// onFailure is told once per prober that the target didn't come up, nil to not tell anyone
+	onFailure func(host string, err error)
+}
+
+// probeFunc checks once whether the target is reachable, it gives up once ctx is done
+type probeFunc func(ctx context.Context) error
+
+func newWaitingRoom(maxDepth int, maxWait time.Duration) *waitingRoom {
+	return &waitingRoom{
+		rooms:    make(map[string]*room),
+		maxDepth: maxDepth,
+		maxWait:  maxWait,
+	}
+}
+
+// isCold reports whether a prober is currently waiting for the target to become reachable
+func (w *waitingRoom) isCold(host string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.rooms[host]
+	return ok
+}
+
+// wait parks the request until the target is reachable, at most for its timeout or the max wait. The first
+// request for a cold target starts the prober which is shared by every request parked after it.
+func (w *waitingRoom) wait(req *http.Request, host string, timeout time.Duration, schedule []time.Duration, probe probeFunc) error {
+	maxWait := w.maxWait
+	if timeout > 0 && timeout < maxWait {
+		maxWait = timeout
+	}
+	start := time.Now()
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+
+	config.Log.Debug("Parking request until service is ready", zap.String("to", host))
+
+	next, nextProbe := schedule, probe
+	for {
+		r, err := w.park(host, next, nextProbe)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-r.ready:
+			w.leave(host, r)
+			if r.err == nil {
+				return nil
+			}
+			w.fail(host, r, r.err)
+			// With a timeout, the request outlives a prober which gave up early
+			rest := remainingSchedule(schedule, time.Since(start))
+			if timeout <= 0 || len(rest) == 0 {
+				return r.err
+			}
+			next, nextProbe = rest[1:], delayedProbe(rest[0], probe)
+		case <-req.Context().Done():
+			w.leave(host, r)
+			return req.Context().Err()
+		case <-timer.C:
+			w.leave(host, r)
+			err := fmt.Errorf("%w: '%s' was not ready after %s", errWaitTimeout, host, maxWait)
+			w.fail(host, r, err)
+			return err
+		}
+	}
+}
+
+// fail reports that the target didn't come up for the requests parked in the room.
+// It is reported once per room, no matter how many requests were parked in it.
+func (w *waitingRoom) fail(host string, r *room, err error) {
+	w.mu.Lock()
+	first := !r.failed
+	r.failed = true
+	w.mu.Unlock()
+
+	if first && w.onFailure != nil {
+		w.onFailure(host, err)
+	}
+}
+
+// park adds a waiter to the room of the target, it starts the prober if the target has no room yet
+func (w *waitingRoom) park(host string, schedule []time.Duration, probe probeFunc) (*room, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	r, ok := w.rooms[host]
+	if !ok {
+		r = w.open(host, schedule, probe)
+	}
+	if r.waiters >= w.maxDepth {
+		return nil, fmt.Errorf("%w: '%s' has %d requests waiting", errQueueFull, host, w.maxDepth)
+	}
+	r.waiters++
+	return r, nil
+}
+
+// leave removes a waiter from the room, the last one stops the prober
+func (w *waitingRoom) leave(host string, r *room) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	r.waiters--
+	w.stopIfUnused(host, r)
+}
+
+// open creates the room of the target and starts its prober, w.mu must be held
+func (w *waitingRoom) open(host string, schedule []time.Duration, probe probeFunc) *room {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &room{ready: make(chan struct{}), stop: cancel}
+	w.rooms[host] = r
+	go w.runProber(ctx, host, r, schedule, probe)
+	return r
+}
+
+// stopIfUnused cancels the prober of a room nobody waits for once its keepUntil is over, instead of
+// letting it sleep through its backoff. The room is closed right away, so a new request starts a new prober.
+// w.mu must be held.
+func (w *waitingRoom) stopIfUnused(host string, r *room) {
+	if r.waiters > 0 {
+		return
+	}
+	if wait := time.Until(r.keepUntil); wait > 0 {
+		if r.stopTimer == nil {
+			r.stopTimer = time.AfterFunc(wait, func() {
+				w.mu.Lock()
+				defer w.mu.Unlock()
+				w.stopIfUnused(host, r)
+			})
+		} else {
+			r.stopTimer.Reset(wait)
+		}
+		return
+	}
+
+	if w.rooms[host] == r {
+		delete(w.rooms, host)
+	}
+	r.stop()
+}
+
+// wake starts probing the target without parking a request, so the target is known to be
+// cold until it is reachable even if nobody waits for it, e.g. a browser showing the waiting page.
+func (w *waitingRoom) wake(host string, schedule []time.Duration, probe probeFunc) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	r, ok := w.rooms[host]
+	if !ok {
+		r = w.open(host, schedule, probe)
+	}
+	r.keepUntil = time.Now().Add(w.maxWait)
+	w.stopIfUnused(host, r)
+}
+
+// runProber probes the target following the schedule and releases the parked requests
+// once it succeeds, the schedule is exhausted, or nobody is waiting anymore.
+func (w *waitingRoom) runProber(ctx context.Context, host string, r *room, schedule []time.Duration, probe probeFunc) {
+	config.Log.Debug("Starting prober", zap.String("to", host))
+
+	re := newRetrier(schedule)
+	err := re.RunCtx(ctx, func(ctx context.Context) error {
+		// The room is closed along with the check, so a request can't park in a room whose prober stops
+		w.mu.Lock()
+		if r.waiters == 0 && time.Now().After(r.keepUntil) {
+			if w.rooms[host] == r {
+				delete(w.rooms, host)
+			}
+			w.mu.Unlock()
+			return errNoWaiters
+		}
+		w.mu.Unlock()
+		return probe(ctx)
+	})
+
+	w.mu.Lock()
+	if w.rooms[host] == r {
+		delete(w.rooms, host)
+	}
+	if r.stopTimer != nil {
+		r.stopTimer.Stop()
+	}
+	w.mu.Unlock()
+	r.stop()
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, errNoWaiters) {
+		config.Log.Debug("Stopping prober, nobody is waiting for the service", zap.String("to", host))
+		r.err = fmt.Errorf("%w: '%s'", errNoWaiters, host)
+	} else if err != nil {
+		config.Log.Error("all retry attempts failed", zap.String("To", host), zap.Error(err))
+		r.err = fmt.Errorf("all retry attempts failed for service '%s': %w. Service failed to scaled up or not passing probes", host, err)
+	} else {
+		config.Log.Debug("Service is ready, releasing parked requests", zap.String("to", host))
+	}
+	close(r.ready)
+}
+
+// remainingSchedule is what is left of the schedule after elapsed, the backoff elapsed falls into is shortened
+func remainingSchedule(schedule []time.Duration, elapsed time.Duration) []time.Duration {
+	for i, backoff := range schedule {
+		if elapsed < backoff {
+			return append([]time.Duration{backoff - elapsed}, schedule[i+1:]...)
+		}
+		elapsed -= backoff
+	}
+	return nil
+}
+
+// delayedProbe waits for delay before the first probe, so a request which outlived a prober doesn't probe right away
+func delayedProbe(delay time.Duration, probe probeFunc) probeFunc {
+	first := true
+	return func(ctx context.Context) error {
+		if first {
+			first = false
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return probe(ctx)
+	}
+}
+
+// newRetrier creates a retrier which stops as soon as nobody is waiting for the result
+func newRetrier(schedule []time.Duration) *retrier.Retrier {
+	return retrier.New(schedule, retrier.BlacklistClassifier{errNoWaiters})
+}
+
+// timeoutSchedule spreads the retries over the timeout with a jittered backoff doubling from initial up to limit
+func timeoutSchedule(timeout, initial, limit time.Duration) []time.Duration {
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+
+	var schedule []time.Duration
+	next := initial
+	for total := time.Duration(0); total < timeout; {
+		backoff := min(next/2+rand.N(next/2+1), timeout-total)
+		schedule = append(schedule, backoff)
+		total += backoff
+		next = min(2*next, max(limit, initial))
+	}
+	return schedule
+}
@@ -0,0 +1,383 @@
+package route
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// MetricModeValue exposes the fixed scale value while the target is active
+	MetricModeValue = "value"
+	// MetricModeRate exposes the request rate of the target while it is active
+	MetricModeRate = "rate"
+)
+
+const (
+	// PolicyRoundRobin sends the requests to the endpoints in turn
+	PolicyRoundRobin = "round-robin"
+	// PolicyLeastConnections sends a request to the endpoint with the fewest requests in flight
+	PolicyLeastConnections = "least-connections"
+	// PolicyHash sends requests with the same header or cookie value to the same endpoint
+	PolicyHash = "hash"
+)
+
+// Built-in profiles which tell from a response that the target is not ready. Connection errors always do.
+const (
+	// ProfileDirect only treats connection errors as not ready, e.g. plain Kubernetes Services
+	ProfileDirect = "direct"
+	// ProfileIstio also treats the Envoy responses of a target without healthy endpoints as not ready
+	ProfileIstio = "istio"
+	// ProfileLinkerd also treats the error responses of the Linkerd proxy as not ready
+	ProfileLinkerd = "linkerd"
+	// ProfileNginx also treats the 502, 503 and 504 responses of nginx as not ready
+	ProfileNginx = "nginx"
+)
+
+const (
+	// HealthCheckHTTP checks that a GET of the path returns a 2xx or 3xx status
+	HealthCheckHTTP = "http"
+	// HealthCheckGRPC checks the target with the gRPC health protocol (grpc.health.v1)
+	HealthCheckGRPC = "grpc"
+	// HealthCheckTCP checks that the target accepts connections
+	HealthCheckTCP = "tcp"
+)
+
+// Table is a static route table which maps the incoming host and path to a target service
+type Table struct {
+	Routes []Route `yaml:"routes"`
+}
+
+// Route matches requests by host and path prefix and sends them to the target
+type Route struct {
+	// Host is the incoming host, either exact (app.example.com), a wildcard (*.example.com) or empty for any host
+	Host string `yaml:"host"`
+	// PathPrefix is the path prefix of the request, empty matches every path
+	PathPrefix string `yaml:"pathPrefix"`
+	Target     Target `yaml:"target"`
+}
+
+// Target is where matched requests are sent to. Zero values fall back to the request headers or defaults.
+type Target struct {
+	Host    string        `yaml:"host"`
+	Port    int           `yaml:"port"`
+	Scheme  string        `yaml:"scheme"`
+	Retries int           `yaml:"retries"`
+	Backoff time.Duration `yaml:"backoff"`
+	// Timeout is how long a request waits for the target at most, the retries are spread over it
+	Timeout time.Duration `yaml:"timeout"`
+	// ServerName overrides the SNI and the name the certificate of an https target is verified against
+	ServerName string `yaml:"serverName"`
+	// InsecureSkipVerify doesn't verify the certificate of an https target
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+	// IdleTimeout is how long the target stays scaled up after the last request
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+	// ScaleValue is the value exposed to KEDA while the target is active
+	ScaleValue int `yaml:"scaleValue"`
+	// MinActive is how long the target stays scaled up at least once it was woken up
+	MinActive time.Duration `yaml:"minActive"`
+	// MetricMode is what the exposed value is based on, either "value" or "rate"
+	MetricMode string `yaml:"metricMode"`
+	// Balancer spreads the requests over several endpoints of the target, instead of sending them to host:port
+	Balancer *Balancer `yaml:"balancer"`
+	// HealthCheck checks the target actively while it is in use
+	HealthCheck *HealthCheck `yaml:"healthCheck"`
+	// NotReady tells from a response that the target is not ready
+	NotReady *NotReady `yaml:"notReady"`
+}
+
+// NotReady tells from a response that the target is not ready yet, so the request waits for it
+type NotReady struct {
+	// Profile is the built-in profile the rules are added to, istio by default
+	Profile string `yaml:"profile"`
+	// Rules are matched in addition to the profile, a response matching any rule means not ready
+	Rules []NotReadyRule `yaml:"rules"`
+	// BodyLimit is how many bytes of the body a body rule reads at most
+	BodyLimit int64 `yaml:"bodyLimit"`
+}
+
+// NotReadyRule matches a response which means the target is not ready, all of its conditions must match
+type NotReadyRule struct {
+	// Status are the HTTP status codes
+	Status []int `yaml:"status"`
+	// GRPCStatus are the gRPC status codes of trailers-only responses, e.g. UNAVAILABLE
+	GRPCStatus []string `yaml:"grpcStatus"`
+	// Headers are regular expressions which the response headers must match
+	Headers map[string]string `yaml:"headers"`
+	// Body is a regular expression which the beginning of the body must match
+	Body string `yaml:"body"`
+}
+
+// HealthCheck checks a target independent of the requests to it
+type HealthCheck struct {
+	// Type is http (default), grpc or tcp
+	Type string `yaml:"type"`
+	// Path is the path of the http check, / by default
+	Path string `yaml:"path"`
+	// Service is the service of the grpc check, empty for the whole server
+	Service string `yaml:"service"`
+	// Interval is the time between two checks
+	Interval time.Duration `yaml:"interval"`
+	// Timeout bounds a single check
+	Timeout time.Duration `yaml:"timeout"`
+	// UnhealthyThreshold is how many checks in a row must fail before a healthy target is failing
+	UnhealthyThreshold int `yaml:"unhealthyThreshold"`
+}
+
+// Balancer lists the endpoints of a target and how requests are spread over them.
+// The target is still scaled by its host, the endpoints are only where the requests go.
+type Balancer struct {
+	// Policy is round-robin (default), least-connections or hash
+	Policy string `yaml:"policy"`
+	// HashHeader and HashCookie are the request header or cookie the hash policy uses, the header wins
+	HashHeader string `yaml:"hashHeader"`
+	HashCookie string `yaml:"hashCookie"`
+	// Endpoints is a static list of host:port endpoints
+	Endpoints []string `yaml:"endpoints"`
+	// DNS is resolved to A/AAAA records, the endpoints use the port of the target
+	DNS string `yaml:"dns"`
+	// SRV is resolved to SRV records, e.g. _http._tcp.app.app-a.svc.cluster.local
+	SRV string `yaml:"srv"`
+	// Refresh is how often DNS and SRV are resolved again
+	Refresh time.Duration `yaml:"refresh"`
+	// FailureTimeout is how long an endpoint which failed is left out
+	FailureTimeout time.Duration `yaml:"failureTimeout"`
+}
+
+// LoadFile reads a route table from a YAML file
+func LoadFile(path string) (*Table, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read route table %s: %w", path, err)
+	}
+
+	return Parse(data)
+}
+
+// Parse parses and validates a route table from YAML
+func Parse(data []byte) (*Table, error) {
+	table := &Table{}
+	if err := yaml.Unmarshal(data, table); err != nil {
+		return nil, fmt.Errorf("failed to parse route table: %w", err)
+	}
+
+	for i := range table.Routes {
+		r := &table.Routes[i]
+		if r.Target.Host == "" {
+			return nil, fmt.Errorf("route %d (%s%s): target host is required", i, r.Host, r.PathPrefix)
+		}
+		if r.Target.Scheme != "" && r.Target.Scheme != "http" && r.Target.Scheme != "https" {
+			return nil, fmt.Errorf("route %d (%s%s): unsupported target scheme %q", i, r.Host, r.PathPrefix, r.Target.Scheme)
+		}
+		if r.Target.Port < 0 || r.Target.Port > 65535 {
+			return nil, fmt.Errorf("route %d (%s%s): invalid target port %d", i, r.Host, r.PathPrefix, r.Target.Port)
+		}
+		if r.Target.Timeout < 0 {
+			return nil, fmt.Errorf("route %d (%s%s): timeout must not be negative", i, r.Host, r.PathPrefix)
+		}
+		if r.Target.ScaleValue < 0 || r.Target.IdleTimeout < 0 || r.Target.MinActive < 0 {
+			return nil, fmt.Errorf("route %d (%s%s): scale policy must not be negative", i, r.Host, r.PathPrefix)
+		}
+		if r.Target.MetricMode != "" && r.Target.MetricMode != MetricModeValue && r.Target.MetricMode != MetricModeRate {
+			return nil, fmt.Errorf("route %d (%s%s): unsupported metric mode %q", i, r.Host, r.PathPrefix, r.Target.MetricMode)
+		}
+		if err := r.Target.Balancer.validate(); err != nil {
+			return nil, fmt.Errorf("route %d (%s%s): %w", i, r.Host, r.PathPrefix, err)
+		}
+		if err := r.Target.HealthCheck.validate(); err != nil {
+			return nil, fmt.Errorf("route %d (%s%s): %w", i, r.Host, r.PathPrefix, err)
+		}
+		if err := r.Target.NotReady.validate(); err != nil {
+			return nil, fmt.Errorf("route %d (%s%s): %w", i, r.Host, r.PathPrefix, err)
+		}
+		r.Host = strings.ToLower(r.Host)
+	}
+
+	// Most specific routes first: exact hosts, then wildcards, then any host; longer prefixes first
+	sort.SliceStable(table.Routes, func(i, j int) bool {
+		a, b := table.Routes[i], table.Routes[j]
+		if hostRank(a.Host) != hostRank(b.Host) {
+			return hostRank(a.Host) < hostRank(b.Host)
+		}
+		if hostRank(a.Host) == 1 && len(a.Host) != len(b.Host) {
+			return len(a.Host) > len(b.Host)
+		}
+		return len(a.PathPrefix) > len(b.PathPrefix)
+	})
+
+	return table, nil
+}
+
+// validate checks that the balancer has exactly one source of endpoints and a known policy
+func (b *Balancer) validate() error {
+	if b == nil {
+		return nil
+	}
+
+	sources := 0
+	if len(b.Endpoints) > 0 {
+		sources++
+	}
+	if b.DNS != "" {
+		sources++
+	}
+	if b.SRV != "" {
+		sources++
+	}
+	if sources != 1 {
+		return fmt.Errorf("balancer needs exactly one of endpoints, dns or srv")
+	}
+
+	for _, endpoint := range b.Endpoints {
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			return fmt.Errorf("invalid balancer endpoint %q: %w", endpoint, err)
+		}
+	}
+
+	switch b.Policy {
+	case "", PolicyRoundRobin, PolicyLeastConnections:
+	case PolicyHash:
+		if b.HashHeader == "" && b.HashCookie == "" {
+			return fmt.Errorf("hash policy needs a hashHeader or hashCookie")
+		}
+	default:
+		return fmt.Errorf("unsupported balancer policy %q", b.Policy)
+	}
+
+	if b.Refresh < 0 || b.FailureTimeout < 0 {
+		return fmt.Errorf("balancer durations must not be negative")
+	}
+	return nil
+}
+
+// validate checks the type and the durations of the health check
+func (h *HealthCheck) validate() error {
+	if h == nil {
+		return nil
+	}
+
+	switch h.Type {
+	case "", HealthCheckHTTP, HealthCheckGRPC, HealthCheckTCP:
+	default:
+		return fmt.Errorf("unsupported health check type %q", h.Type)
+	}
+
+	if h.Interval < 0 || h.Timeout < 0 || h.UnhealthyThreshold < 0 {
+		return fmt.Errorf("health check settings must not be negative")
+	}
+	return nil
+}
+
+// IsProfile reports whether the name is a built-in not ready profile
+func IsProfile(name string) bool {
+	switch name {
+	case ProfileDirect, ProfileIstio, ProfileLinkerd, ProfileNginx:
+		return true
+	}
+	return false
+}
+
+// GRPCCode parses a gRPC status code by its name, e.g. UNAVAILABLE or Unavailable
+func GRPCCode(name string) (codes.Code, error) {
+	normalized := strings.ReplaceAll(name, "_", "")
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if strings.EqualFold(normalized, c.String()) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown gRPC status code %q", name)
+}
+
+// validate checks the profile and that every rule has valid conditions
+func (n *NotReady) validate() error {
+	if n == nil {
+		return nil
+	}
+
+	if n.Profile != "" && !IsProfile(n.Profile) {
+		return fmt.Errorf("unknown not ready profile %q", n.Profile)
+	}
+	if n.BodyLimit < 0 {
+		return fmt.Errorf("not ready body limit must not be negative")
+	}
+
+	for i, rule := range n.Rules {
+		if len(rule.Status) == 0 && len(rule.GRPCStatus) == 0 && len(rule.Headers) == 0 && rule.Body == "" {
+			return fmt.Errorf("not ready rule %d has no condition", i)
+		}
+		// Reading the body of any response would hang on streams and upgraded connections
+		if rule.Body != "" && len(rule.Status) == 0 {
+			return fmt.Errorf("not ready rule %d: a body condition needs status codes", i)
+		}
+		for _, status := range rule.Status {
+			if status < 100 || status > 599 {
+				return fmt.Errorf("not ready rule %d: invalid status code %d", i, status)
+			}
+		}
+		for _, name := range rule.GRPCStatus {
+			if _, err := GRPCCode(name); err != nil {
+				return fmt.Errorf("not ready rule %d: %w", i, err)
+			}
+		}
+		for name, expr := range rule.Headers {
+			if _, err := regexp.Compile(expr); err != nil {
+				return fmt.Errorf("not ready rule %d: invalid regular expression of header %s: %w", i, name, err)
+			}
+		}
+		if _, err := regexp.Compile(rule.Body); err != nil {
+			return fmt.Errorf("not ready rule %d: invalid body regular expression: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Match returns the route for the incoming host and path, or false if no route matches
+func (t *Table) Match(host, path string) (*Route, bool) {
+	if t == nil {
+		return nil, false
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	for i := range t.Routes {
+		r := &t.Routes[i]
+		if matchHost(r.Host, host) && strings.HasPrefix(path, r.PathPrefix) {
+			return r, true
+		}
+	}
+
+	return nil, false
+}
+
+func matchHost(pattern, host string) bool {
+	switch {
+	case pattern == "" || pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:])
+	default:
+		return pattern == host
+	}
+}
+
+// hostRank orders host patterns from the most to the least specific
+func hostRank(pattern string) int {
+	switch {
+	case pattern == "" || pattern == "*":
+		return 2
+	case strings.HasPrefix(pattern, "*."):
+		return 1
+	default:
+		return 0
+	}
+}
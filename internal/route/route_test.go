@@ -0,0 +1,240 @@
+package route
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+const testTable = `
+routes:
+- pathPrefix: /
+  target:
+    host: default.svc.cluster.local
+- host: "*.example.com"
+  target:
+    host: wildcard.svc.cluster.local
+- host: app.example.com
+  target:
+    host: app.app-a.svc.cluster.local
+    port: 3000
+    scheme: http
+    retries: 5
+    backoff: 250ms
+    timeout: 90s
+    idleTimeout: 15m
+    scaleValue: 3
+    minActive: 20m
+    metricMode: rate
+- host: app.example.com
+  pathPrefix: /api
+  target:
+    host: api.app-a.svc.cluster.local
+    port: 8080
+    scheme: https
+    serverName: api.internal.example.com
+    insecureSkipVerify: true
+`
+
+func TestMatch(t *testing.T) {
+	table, err := Parse([]byte(testTable))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		host       string
+		path       string
+		wantTarget string
+	}{
+		{name: "exact host", host: "app.example.com", path: "/", wantTarget: "app.app-a.svc.cluster.local"},
+		{name: "exact host with port", host: "APP.example.com:8443", path: "/index.html", wantTarget: "app.app-a.svc.cluster.local"},
+		{name: "longest path prefix", host: "app.example.com", path: "/api/users", wantTarget: "api.app-a.svc.cluster.local"},
+		{name: "wildcard host", host: "other.example.com", path: "/api", wantTarget: "wildcard.svc.cluster.local"},
+		{name: "any host", host: "localhost", path: "/", wantTarget: "default.svc.cluster.local"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, ok := table.Match(tt.host, tt.path)
+			require.True(t, ok)
+			assert.Equal(t, tt.wantTarget, r.Target.Host)
+		})
+	}
+
+	r, ok := table.Match("app.example.com", "/")
+	require.True(t, ok)
+	assert.Equal(t, Target{
+		Host:        "app.app-a.svc.cluster.local",
+		Port:        3000,
+		Scheme:      "http",
+		Retries:     5,
+		Backoff:     250 * time.Millisecond,
+		Timeout:     90 * time.Second,
+		IdleTimeout: 15 * time.Minute,
+		ScaleValue:  3,
+		MinActive:   20 * time.Minute,
+		MetricMode:  MetricModeRate,
+	}, r.Target)
+
+	r, ok = table.Match("app.example.com", "/api")
+	require.True(t, ok)
+	assert.Equal(t, Target{
+		Host:               "api.app-a.svc.cluster.local",
+		Port:               8080,
+		Scheme:             "https",
+		ServerName:         "api.internal.example.com",
+		InsecureSkipVerify: true,
+	}, r.Target)
+}
+
+func TestParseBalancer(t *testing.T) {
+	table, err := Parse([]byte(`
+routes:
+- host: app.example.com
+  target:
+    host: app.app-a.svc.cluster.local
+    port: 8080
+    balancer:
+      policy: hash
+      hashCookie: session
+      dns: app-headless.app-a.svc.cluster.local
+      refresh: 10s
+`))
+	require.NoError(t, err)
+
+	r, ok := table.Match("app.example.com", "/")
+	require.True(t, ok)
+	assert.Equal(t, &Balancer{
+		Policy:     PolicyHash,
+		HashCookie: "session",
+		DNS:        "app-headless.app-a.svc.cluster.local",
+		Refresh:    10 * time.Second,
+	}, r.Target.Balancer)
+}
+
+func TestParseHealthCheck(t *testing.T) {
+	table, err := Parse([]byte(`
+routes:
+- target:
+    host: app.app-a.svc.cluster.local
+    healthCheck:
+      type: grpc
+      service: todo.v2.TodoService
+      interval: 2s
+      timeout: 500ms
+      unhealthyThreshold: 2
+`))
+	require.NoError(t, err)
+
+	r, ok := table.Match("app.example.com", "/")
+	require.True(t, ok)
+	assert.Equal(t, &HealthCheck{
+		Type:               HealthCheckGRPC,
+		Service:            "todo.v2.TodoService",
+		Interval:           2 * time.Second,
+		Timeout:            500 * time.Millisecond,
+		UnhealthyThreshold: 2,
+	}, r.Target.HealthCheck)
+}
+
+func TestParseNotReady(t *testing.T) {
+	table, err := Parse([]byte(`
+routes:
+- target:
+    host: app.app-a.svc.cluster.local
+    notReady:
+      profile: linkerd
+      bodyLimit: 1024
+      rules:
+      - status: [503]
+        headers:
+          x-envoy-upstream-service-time: "."
+        body: starting
+      - grpcStatus: [UNAVAILABLE]
+`))
+	require.NoError(t, err)
+
+	r, ok := table.Match("app.example.com", "/")
+	require.True(t, ok)
+	assert.Equal(t, &NotReady{
+		Profile:   ProfileLinkerd,
+		BodyLimit: 1024,
+		Rules: []NotReadyRule{
+			{Status: []int{503}, Headers: map[string]string{"x-envoy-upstream-service-time": "."}, Body: "starting"},
+			{GRPCStatus: []string{"UNAVAILABLE"}},
+		},
+	}, r.Target.NotReady)
+}
+
+func TestGRPCCode(t *testing.T) {
+	for _, name := range []string{"UNAVAILABLE", "Unavailable", "unavailable"} {
+		code, err := GRPCCode(name)
+		require.NoError(t, err)
+		assert.Equal(t, codes.Unavailable, code)
+	}
+
+	code, err := GRPCCode("DEADLINE_EXCEEDED")
+	require.NoError(t, err)
+	assert.Equal(t, codes.DeadlineExceeded, code)
+
+	_, err = GRPCCode("NOT_A_CODE")
+	assert.Error(t, err)
+}
+
+func TestMatchNoRoute(t *testing.T) {
+	table, err := Parse([]byte(`
+routes:
+- host: app.example.com
+  target:
+    host: app.app-a.svc.cluster.local
+`))
+	require.NoError(t, err)
+
+	_, ok := table.Match("other.example.com", "/")
+	assert.False(t, ok)
+
+	var empty *Table
+	_, ok = empty.Match("app.example.com", "/")
+	assert.False(t, ok)
+}
+
+func TestLoadFileInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		table string
+	}{
+		{name: "missing target host", table: "routes:\n- host: app.example.com\n"},
+		{name: "invalid scheme", table: "routes:\n- target:\n    host: app\n    scheme: ftp\n"},
+		{name: "invalid yaml", table: "routes: [\n"},
+		{name: "negative timeout", table: "routes:\n- target:\n    host: app\n    timeout: -1s\n"},
+		{name: "invalid metric mode", table: "routes:\n- target:\n    host: app\n    metricMode: cpu\n"},
+		{name: "balancer without endpoints", table: "routes:\n- target:\n    host: app\n    balancer:\n      policy: round-robin\n"},
+		{name: "balancer with endpoints and dns", table: "routes:\n- target:\n    host: app\n    balancer:\n      endpoints: [a:80]\n      dns: app\n"},
+		{name: "balancer endpoint without port", table: "routes:\n- target:\n    host: app\n    balancer:\n      endpoints: [a]\n"},
+		{name: "hash without key", table: "routes:\n- target:\n    host: app\n    balancer:\n      policy: hash\n      endpoints: [a:80]\n"},
+		{name: "invalid health check type", table: "routes:\n- target:\n    host: app\n    healthCheck:\n      type: udp\n"},
+		{name: "negative health check interval", table: "routes:\n- target:\n    host: app\n    healthCheck:\n      interval: -1s\n"},
+		{name: "unknown not ready profile", table: "routes:\n- target:\n    host: app\n    notReady:\n      profile: envoy\n"},
+		{name: "not ready rule without condition", table: "routes:\n- target:\n    host: app\n    notReady:\n      rules:\n      - status: []\n"},
+		{name: "invalid not ready status", table: "routes:\n- target:\n    host: app\n    notReady:\n      rules:\n      - status: [42]\n"},
+		{name: "unknown grpc status", table: "routes:\n- target:\n    host: app\n    notReady:\n      rules:\n      - grpcStatus: [BROKEN]\n"},
+		{name: "invalid not ready body regexp", table: "routes:\n- target:\n    host: app\n    notReady:\n      rules:\n      - status: [503]\n        body: \"(\"\n"},
+		{name: "not ready body without status", table: "routes:\n- target:\n    host: app\n    notReady:\n      rules:\n      - body: starting\n"},
+		{name: "invalid balancer policy", table: "routes:\n- target:\n    host: app\n    balancer:\n      policy: random\n      endpoints: [a:80]\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "routes.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tt.table), 0o600))
+
+			_, err := LoadFile(path)
+			assert.Error(t, err)
+		})
+	}
+}
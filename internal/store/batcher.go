@@ -0,0 +1,200 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/araminian/gozero/internal/config"
+)
+
+const defaultFlushInterval = time.Second
+
+// BatchStorer is a store which can write many scale ups at once
+type BatchStorer interface {
+	// ScaleUpBatch writes the scale ups and returns the hosts which had no active key before
+	ScaleUpBatch(requests []ScaleUpRequest) ([]string, error)
+}
+
+type BatcherConfig func(*batcherConfig) error
+
+type batcherConfig struct {
+	FlushInterval *time.Duration
+	OnFlush       func(requests []ScaleUpRequest)
+	OnActivate    func(req ScaleUpRequest)
+}
+
+// WithFlushInterval sets how often the pending scale ups are written, each host is written
+// at most once per interval
+func WithFlushInterval(interval time.Duration) BatcherConfig {
+	return func(cfg *batcherConfig) error {
+		if interval <= 0 {
+			return fmt.Errorf("flush interval must be positive, got %s", interval)
+		}
+		cfg.FlushInterval = &interval
+		return nil
+	}
+}
+
+// WithOnFlush is called with the scale ups after they were written to the store
+func WithOnFlush(onFlush func(requests []ScaleUpRequest)) BatcherConfig {
+	return func(cfg *batcherConfig) error {
+		cfg.OnFlush = onFlush
+		return nil
+	}
+}
+
+// WithOnActivate is called with every scale up which activated a host without an active key
+func WithOnActivate(onActivate func(req ScaleUpRequest)) BatcherConfig {
+	return func(cfg *batcherConfig) error {
+		cfg.OnActivate = onActivate
+		return nil
+	}
+}
+
+// Batcher coalesces the scale ups of a host and writes them to the store in batches,
+// so a slow store never holds up the caller. The first scale up of a host which wasn't
+// written recently is written right away, as it may be waking the host up.
+type Batcher struct {
+	store         BatchStorer
+	flushInterval time.Duration
+	onFlush       func(requests []ScaleUpRequest)
+	onActivate    func(req ScaleUpRequest)
+
+	mu      sync.Mutex
+	pending map[string]*ScaleUpRequest
+	written map[string]time.Time
+	kick    chan struct{}
+}
+
+func NewBatcher(store BatchStorer, configs ...BatcherConfig) (*Batcher, error) {
+	cfg := &batcherConfig{}
+
+	for _, config := range configs {
+		if err := config(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	flushInterval := defaultFlushInterval
+	if cfg.FlushInterval != nil {
+		flushInterval = *cfg.FlushInterval
+	}
+
+	return &Batcher{
+		store:         store,
+		flushInterval: flushInterval,
+		onFlush:       cfg.OnFlush,
+		onActivate:    cfg.OnActivate,
+		pending:       make(map[string]*ScaleUpRequest),
+		written:       make(map[string]time.Time),
+		kick:          make(chan struct{}, 1),
+	}, nil
+}
+
+// Add queues a scale up, it never blocks on the store
+func (b *Batcher) Add(req ScaleUpRequest) {
+	// An invalid scale up would fail every batch it is in
+	if _, err := req.config(); err != nil {
+		config.Log.Error("Dropping invalid scale up", zap.String("host", req.Host), zap.Error(err))
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if pending, ok := b.pending[req.Host]; ok {
+		pending.merge(req)
+		return
+	}
+	b.pending[req.Host] = &req
+
+	if time.Since(b.written[req.Host]) >= b.flushInterval {
+		select {
+		case b.kick <- struct{}{}:
+		default:
+			// A flush is already due
+		}
+	}
+}
+
+// Run writes the pending scale ups until the context is done, then writes what is left
+func (b *Batcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			b.flush()
+			return
+		case <-ticker.C:
+			b.flush()
+		case <-b.kick:
+			b.flush()
+		}
+	}
+}
+
+func (b *Batcher) flush() {
+	b.mu.Lock()
+	if len(b.pending) == 0 {
+		b.mu.Unlock()
+		return
+	}
+	batch := make([]ScaleUpRequest, 0, len(b.pending))
+	for _, req := range b.pending {
+		batch = append(batch, *req)
+	}
+	b.pending = make(map[string]*ScaleUpRequest)
+	b.mu.Unlock()
+
+	activated, err := b.store.ScaleUpBatch(batch)
+	if err != nil {
+		config.Log.Error("Error scaling up hosts", zap.Int("hosts", len(batch)), zap.Error(err))
+		b.requeue(batch)
+		return
+	}
+
+	now := time.Now()
+	b.mu.Lock()
+	for _, req := range batch {
+		b.written[req.Host] = now
+	}
+	for host, at := range b.written {
+		if now.Sub(at) >= b.flushInterval {
+			delete(b.written, host)
+		}
+	}
+	b.mu.Unlock()
+
+	if b.onActivate != nil && len(activated) > 0 {
+		byHost := make(map[string]ScaleUpRequest, len(batch))
+		for _, req := range batch {
+			byHost[req.Host] = req
+		}
+		for _, host := range activated {
+			b.onActivate(byHost[host])
+		}
+	}
+
+	if b.onFlush != nil {
+		b.onFlush(batch)
+	}
+}
+
+// requeue puts a batch which failed to be written back, so it is retried with the next flush
+func (b *Batcher) requeue(batch []ScaleUpRequest) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, req := range batch {
+		if later, ok := b.pending[req.Host]; ok {
+			req.merge(*later)
+		}
+		b.pending[req.Host] = &req
+	}
+}
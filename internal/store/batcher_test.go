@@ -0,0 +1,182 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/araminian/gozero/internal/config"
+)
+
+// slowStore takes its time for every batch, like a Redis with a high latency
+type slowStore struct {
+	delay time.Duration
+	fail  atomic.Bool
+
+	mu      sync.Mutex
+	batches [][]ScaleUpRequest
+}
+
+func (s *slowStore) ScaleUpBatch(requests []ScaleUpRequest) ([]string, error) {
+	time.Sleep(s.delay)
+	if s.fail.Load() {
+		return nil, assert.AnError
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, requests)
+	return nil, nil
+}
+
+// totals returns the written requests and the number of writes per host
+func (s *slowStore) totals() (map[string]int, map[string]int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	requests, writes := make(map[string]int), make(map[string]int)
+	for _, batch := range s.batches {
+		for _, req := range batch {
+			requests[req.Host] += req.Requests
+			writes[req.Host]++
+		}
+	}
+	return requests, writes
+}
+
+func startBatcher(t *testing.T, s BatchStorer, configs ...BatcherConfig) *Batcher {
+	t.Helper()
+	config.InitLogger(zapcore.ErrorLevel)
+
+	b, err := NewBatcher(s, configs...)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return b
+}
+
+func TestBatcherSlowStore(t *testing.T) {
+	s := &slowStore{delay: 200 * time.Millisecond}
+	b := startBatcher(t, s, WithFlushInterval(100*time.Millisecond))
+
+	hosts := []string{"a.svc:80", "b.svc:80", "c.svc:80"}
+	start := time.Now()
+	for i := 0; i < 30000; i++ {
+		b.Add(ScaleUpRequest{Host: hosts[i%len(hosts)], Value: 10, Duration: time.Minute, Requests: 1})
+	}
+	// Adding never waits for the store
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		requests, _ := s.totals()
+		return requests["a.svc:80"] == 10000 && requests["b.svc:80"] == 10000 && requests["c.svc:80"] == 10000
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// The requests are coalesced into a few writes per host
+	_, writes := s.totals()
+	for _, host := range hosts {
+		assert.LessOrEqual(t, writes[host], 5, host)
+	}
+}
+
+func TestBatcherWritesFirstScaleUpImmediately(t *testing.T) {
+	var flushed atomic.Int32
+	s := &slowStore{}
+	b := startBatcher(t, s,
+		WithFlushInterval(time.Hour),
+		WithOnFlush(func(requests []ScaleUpRequest) { flushed.Add(int32(len(requests))) }),
+	)
+
+	b.Add(ScaleUpRequest{Host: "cold.svc:80", Value: 10, Duration: time.Minute, Requests: 1})
+	assert.Eventually(t, func() bool { return flushed.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	// Later scale ups of the same host wait for the interval
+	b.Add(ScaleUpRequest{Host: "cold.svc:80", Value: 10, Duration: time.Minute, Requests: 1})
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), flushed.Load())
+}
+
+func TestBatcherRetriesFailedWrites(t *testing.T) {
+	s := &slowStore{}
+	s.fail.Store(true)
+	b := startBatcher(t, s, WithFlushInterval(50*time.Millisecond))
+
+	b.Add(ScaleUpRequest{Host: "a.svc:80", Value: 10, Duration: time.Minute, Requests: 2})
+	time.Sleep(100 * time.Millisecond)
+	b.Add(ScaleUpRequest{Host: "a.svc:80", Value: 5, Duration: time.Minute, Requests: 1})
+	s.fail.Store(false)
+
+	assert.Eventually(t, func() bool {
+		requests, _ := s.totals()
+		return requests["a.svc:80"] == 3
+	}, time.Second, 10*time.Millisecond)
+
+	// The latest policy wins
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	assert.Equal(t, 5, s.batches[len(s.batches)-1][0].Value)
+}
+
+func TestBatcherMemoryStore(t *testing.T) {
+	m, err := NewMemoryStore(context.Background(), WithMemoryRequestRateWindow(10*time.Second))
+	require.NoError(t, err)
+	defer m.Close()
+
+	b := startBatcher(t, m, WithFlushInterval(50*time.Millisecond))
+	for i := 0; i < 25; i++ {
+		b.Add(ScaleUpRequest{Host: "app.foo.svc.cluster.local:3000", Value: 10, Duration: time.Minute, Requests: 1})
+	}
+
+	assert.Eventually(t, func() bool {
+		rates, err := m.GetRequestRates()
+		return err == nil && rates["app-foo-svc-cluster-local"] == 2.5
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestBatcherReportsActivatedHosts(t *testing.T) {
+	m, err := NewMemoryStore(context.Background())
+	require.NoError(t, err)
+	defer m.Close()
+	require.NoError(t, m.ScaleUp("warm.svc:80", 10, time.Minute))
+
+	activated := make(chan ScaleUpRequest, 2)
+	b := startBatcher(t, m,
+		WithFlushInterval(50*time.Millisecond),
+		WithOnActivate(func(req ScaleUpRequest) { activated <- req }),
+	)
+
+	received := time.Now()
+	b.Add(ScaleUpRequest{Host: "cold.svc:80", Value: 10, Duration: time.Minute, Requests: 1, Received: received})
+	b.Add(ScaleUpRequest{Host: "cold.svc:80", Value: 10, Duration: time.Minute, Requests: 1, Received: received.Add(time.Second)})
+	b.Add(ScaleUpRequest{Host: "warm.svc:80", Value: 10, Duration: time.Minute, Requests: 1, Received: received})
+
+	select {
+	case req := <-activated:
+		assert.Equal(t, "cold.svc:80", req.Host)
+		// The first request of the coalesced scale ups counts
+		assert.True(t, req.Received.Equal(received))
+	case <-time.After(time.Second):
+		t.Fatal("cold host was not reported as activated")
+	}
+
+	// The host is active now
+	b.Add(ScaleUpRequest{Host: "cold.svc:80", Value: 10, Duration: time.Minute, Requests: 1})
+	time.Sleep(150 * time.Millisecond)
+	assert.Empty(t, activated)
+}
@@ -0,0 +1,408 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultJanitorInterval = 10 * time.Second
+
+type MemoryConfig func(*memoryConfig) error
+
+type memoryConfig struct {
+	RequestRateWindow *time.Duration
+	JanitorInterval   *time.Duration
+}
+
+// WithMemoryRequestRateWindow sets the sliding window the request rate of a host is calculated over
+func WithMemoryRequestRateWindow(window time.Duration) MemoryConfig {
+	return func(cfg *memoryConfig) error {
+		if window < time.Second {
+			return fmt.Errorf("request rate window must be at least 1s, got %s", window)
+		}
+		cfg.RequestRateWindow = &window
+		return nil
+	}
+}
+
+// WithJanitorInterval sets how often expired hosts and request rate buckets are removed
+func WithJanitorInterval(interval time.Duration) MemoryConfig {
+	return func(cfg *memoryConfig) error {
+		if interval <= 0 {
+			return fmt.Errorf("janitor interval must be positive, got %s", interval)
+		}
+		cfg.JanitorInterval = &interval
+		return nil
+	}
+}
+
+type memoryEntry struct {
+	value      int
+	metricMode string
+	expires    time.Time
+}
+
+// inFlightEntry is the in flight count a replica reported for a host
+type inFlightEntry struct {
+	count   int
+	expires time.Time
+}
+
+// MemoryStore keeps the state in the process, for a single GoZero replica or local development.
+// It behaves like the Redis store, expired hosts are hidden right away and removed by a janitor.
+type MemoryStore struct {
+	RequestRateWindow time.Duration
+
+	mu       sync.Mutex
+	entries  map[string]*memoryEntry
+	buckets  map[string]map[int64]int64
+	inFlight map[string]map[string]inFlightEntry
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewMemoryStore(ctx context.Context, configs ...MemoryConfig) (*MemoryStore, error) {
+	cfg := &memoryConfig{}
+
+	for _, config := range configs {
+		if err := config(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		requestRateWindow = defaultRequestRateWindow
+		janitorInterval   = defaultJanitorInterval
+	)
+
+	if cfg.RequestRateWindow != nil {
+		requestRateWindow = *cfg.RequestRateWindow
+	}
+	if cfg.JanitorInterval != nil {
+		janitorInterval = *cfg.JanitorInterval
+	}
+
+	m := &MemoryStore{
+		RequestRateWindow: requestRateWindow,
+		entries:           make(map[string]*memoryEntry),
+		buckets:           make(map[string]map[int64]int64),
+		inFlight:          make(map[string]map[string]inFlightEntry),
+		done:              make(chan struct{}),
+	}
+	go m.janitor(ctx, janitorInterval)
+
+	return m, nil
+}
+
+func (m *MemoryStore) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.done)
+	})
+	return nil
+}
+
+// ScaleUp marks the host as active with the given value until it has been idle for scaleDuration.
+// A host which is already active is only ever extended, never shortened.
+func (m *MemoryStore) ScaleUp(host string, scaleThreshold int, scaleDuration time.Duration, configs ...ScaleUpConfig) error {
+	cfg, err := newScaleUpConfig(configs...)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scaleUp(host, scaleThreshold, scaleDuration, cfg, time.Now())
+
+	return nil
+}
+
+// ScaleUpBatch scales up and records the requests of many hosts, nothing is written if one is invalid.
+// It returns the hosts which were not active before.
+func (m *MemoryStore) ScaleUpBatch(requests []ScaleUpRequest) ([]string, error) {
+	cfgs := make([]*scaleUpConfig, 0, len(requests))
+	for _, req := range requests {
+		cfg, err := req.config()
+		if err != nil {
+			return nil, fmt.Errorf("invalid scale up of host %s: %w", req.Host, err)
+		}
+		cfgs = append(cfgs, cfg)
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var activated []string
+	for i, req := range requests {
+		if m.scaleUp(req.Host, req.Value, req.Duration, cfgs[i], now) {
+			activated = append(activated, req.Host)
+		}
+		if req.Requests > 0 {
+			m.recordRequests(req.Host, req.Requests, now)
+		}
+	}
+
+	return activated, nil
+}
+
+// scaleUp marks the host as active and reports whether it was not active before, m.mu must be held
+func (m *MemoryStore) scaleUp(host string, scaleThreshold int, scaleDuration time.Duration, cfg *scaleUpConfig, now time.Time) bool {
+	entry, ok := m.activeEntry(host, now)
+	if !ok {
+		// A newly activated host stays up for at least the min active window
+		entry = &memoryEntry{expires: now.Add(max(scaleDuration, cfg.minActive))}
+		m.entries[host] = entry
+	}
+	if expires := now.Add(scaleDuration); expires.After(entry.expires) {
+		entry.expires = expires
+	}
+	entry.value = scaleThreshold
+	entry.metricMode = cfg.metricMode
+
+	return !ok
+}
+
+// ResetTimer keeps an active host up for at least scaleDuration from now, it never shortens its scale up
+func (m *MemoryStore) ResetTimer(host string, scaleDuration time.Duration) error {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if entry, ok := m.activeEntry(host, now); ok {
+		if expires := now.Add(scaleDuration); expires.After(entry.expires) {
+			entry.expires = expires
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) ScaleDown(host string) error {
+	return nil
+}
+
+// GetAllScaleUpKeys returns the keys of the active hosts in the same format as the Redis store
+func (m *MemoryStore) GetAllScaleUpKeys() ([]string, error) {
+	hosts := m.activeHosts()
+
+	keys := make([]string, len(hosts))
+	for i, host := range hosts {
+		keys[i] = fmt.Sprintf("%s:%s", scaleUpKeyPrefix, host)
+	}
+
+	return keys, nil
+}
+
+// GetAllScaleUpKeysValues returns the value of every active host by its metric name.
+// Hosts in rate mode report their request rate, but at least 1 while they are active.
+func (m *MemoryStore) GetAllScaleUpKeysValues() (map[string]string, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make(map[string]string, len(m.entries))
+	for host, entry := range m.entries {
+		if !now.Before(entry.expires) {
+			continue
+		}
+		if entry.metricMode == metricModeRate {
+			result[metricName(host)] = rateValue(m.requestRate(host, now))
+			continue
+		}
+		result[metricName(host)] = strconv.Itoa(entry.value)
+	}
+
+	return result, nil
+}
+
+// GetScaleUpValue returns the value of the active host with the given metric name
+func (m *MemoryStore) GetScaleUpValue(name string) (string, bool, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for host, entry := range m.entries {
+		if metricName(host) != name || !now.Before(entry.expires) {
+			continue
+		}
+		if entry.metricMode == metricModeRate {
+			return rateValue(m.requestRate(host, now)), true, nil
+		}
+		return strconv.Itoa(entry.value), true, nil
+	}
+
+	return "", false, nil
+}
+
+// RecordRequests counts requests for the host in the current one second bucket
+func (m *MemoryStore) RecordRequests(host string, count int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.recordRequests(host, count, time.Now())
+
+	return nil
+}
+
+// recordRequests counts the requests in the bucket of the current second, m.mu must be held
+func (m *MemoryStore) recordRequests(host string, count int, now time.Time) {
+	if m.buckets[host] == nil {
+		m.buckets[host] = make(map[int64]int64)
+	}
+	m.buckets[host][now.Unix()] += int64(count)
+}
+
+// GetRequestRates returns the requests per second of every active host over the sliding window
+func (m *MemoryStore) GetRequestRates() (map[string]float64, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make(map[string]float64, len(m.entries))
+	for host, entry := range m.entries {
+		if now.Before(entry.expires) {
+			result[metricName(host)] = m.requestRate(host, now)
+		}
+	}
+
+	return result, nil
+}
+
+// RecordInFlight stores the requests in flight per host of a single replica until ttl passes.
+// A count of 0 removes the replica from the host.
+func (m *MemoryStore) RecordInFlight(replica string, counts map[string]int, ttl time.Duration) error {
+	expires := time.Now().Add(ttl)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for host, count := range counts {
+		if count <= 0 {
+			delete(m.inFlight[host], replica)
+			continue
+		}
+		if m.inFlight[host] == nil {
+			m.inFlight[host] = make(map[string]inFlightEntry)
+		}
+		m.inFlight[host][replica] = inFlightEntry{count: count, expires: expires}
+	}
+
+	return nil
+}
+
+// GetInFlight returns the requests in flight of every active host by its metric name, summed over all replicas
+func (m *MemoryStore) GetInFlight() (map[string]int, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make(map[string]int, len(m.entries))
+	for host, entry := range m.entries {
+		if !now.Before(entry.expires) {
+			continue
+		}
+		var total int
+		for _, inFlight := range m.inFlight[host] {
+			if now.Before(inFlight.expires) {
+				total += inFlight.count
+			}
+		}
+		result[metricName(host)] = total
+	}
+
+	return result, nil
+}
+
+// activeEntry returns the entry of the host if it didn't expire yet, m.mu must be held
+func (m *MemoryStore) activeEntry(host string, now time.Time) (*memoryEntry, bool) {
+	entry, ok := m.entries[host]
+	if !ok || !now.Before(entry.expires) {
+		return nil, false
+	}
+	return entry, true
+}
+
+func (m *MemoryStore) activeHosts() []string {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hosts := make([]string, 0, len(m.entries))
+	for host, entry := range m.entries {
+		if now.Before(entry.expires) {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	return hosts
+}
+
+// requestRate sums the buckets of the host inside the window, m.mu must be held
+func (m *MemoryStore) requestRate(host string, now time.Time) float64 {
+	windowStart := now.Add(-m.RequestRateWindow).Unix()
+
+	var total int64
+	for second, count := range m.buckets[host] {
+		if second > windowStart {
+			total += count
+		}
+	}
+
+	return float64(total) / m.RequestRateWindow.Seconds()
+}
+
+func (m *MemoryStore) janitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.done:
+			return
+		case <-ticker.C:
+			m.deleteExpired(time.Now())
+		}
+	}
+}
+
+// deleteExpired removes expired hosts, request rate buckets which left the window and stale in flight counts
+func (m *MemoryStore) deleteExpired(now time.Time) {
+	windowStart := now.Add(-m.RequestRateWindow).Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for host, entry := range m.entries {
+		if !now.Before(entry.expires) {
+			delete(m.entries, host)
+		}
+	}
+
+	for host, buckets := range m.buckets {
+		for second := range buckets {
+			if second <= windowStart {
+				delete(buckets, second)
+			}
+		}
+		if len(buckets) == 0 {
+			delete(m.buckets, host)
+		}
+	}
+
+	for host, replicas := range m.inFlight {
+		for replica, inFlight := range replicas {
+			if !now.Before(inFlight.expires) {
+				delete(replicas, replica)
+			}
+		}
+		if len(replicas) == 0 {
+			delete(m.inFlight, host)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStoreJanitor(t *testing.T) {
+	s, err := NewMemoryStore(context.Background(),
+		WithMemoryRequestRateWindow(time.Second),
+		WithJanitorInterval(50*time.Millisecond),
+	)
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NoError(t, s.ScaleUp("app.foo.svc.cluster.local:3000", 10, time.Second))
+	require.NoError(t, s.RecordRequests("app.foo.svc.cluster.local:3000", 1))
+
+	// Expired hosts and buckets which left the window are removed, not only hidden
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.entries) == 0 && len(s.buckets) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+}
@@ -3,44 +3,40 @@ package store
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
-)
-
-type RedisConfig func(*redisConfig) error
+	"go.uber.org/zap"
 
-type redisConfig struct {
-	Host *string
-	Port *int
-}
+	"github.com/araminian/gozero/internal/config"
+)
 
 const (
-	defaultHost      = "localhost"
-	defaultPort      = 6379
-	scaleUpKeyPrefix = "gozero:scale_up"
+	defaultHost              = "localhost"
+	defaultPort              = 6379
+	defaultRequestRateWindow = time.Minute
+	defaultConnectTimeout    = 5 * time.Second
+	scaleUpKeyPrefix         = "gozero:scale_up"
+	scaleUpIndexKey          = "gozero:scale_up_index"
+	scaleModeKeyPrefix       = "gozero:scale_mode"
+	requestRateKeyPrefix     = "gozero:request_rate"
+	inFlightKeyPrefix        = "gozero:in_flight"
+	metricModeValue          = "value"
+	metricModeRate           = "rate"
+	// minRedisMajorVersion is the oldest Redis with the NX and GT options of EXPIRE, ZADD GT needs 6.2
+	minRedisMajorVersion = 7
 )
 
-func WithRedisHost(host string) RedisConfig {
-	return func(cfg *redisConfig) error {
-		cfg.Host = &host
-		return nil
-	}
-}
-
-func WithRedisPort(port int) RedisConfig {
-	return func(cfg *redisConfig) error {
-		cfg.Port = &port
-		return nil
-	}
-}
-
 type RedisClient struct {
-	Client *redis.Client
-	Ctx    context.Context
+	Client            redis.UniversalClient
+	Ctx               context.Context
+	RequestRateWindow time.Duration
 }
 
+// NewRedisClient connects to a single Redis, a Sentinel master or a Redis Cluster.
+// It fails if Redis can't be reached, so a wrong address or credentials show up at startup.
 func NewRedisClient(ctx context.Context, configs ...RedisConfig) (*RedisClient, error) {
 	cfg := &redisConfig{}
 
@@ -51,8 +47,9 @@ func NewRedisClient(ctx context.Context, configs ...RedisConfig) (*RedisClient,
 	}
 
 	var (
-		host = defaultHost
-		port = defaultPort
+		host              = defaultHost
+		port              = defaultPort
+		requestRateWindow = defaultRequestRateWindow
 	)
 
 	if cfg.Host != nil {
@@ -61,12 +58,102 @@ func NewRedisClient(ctx context.Context, configs ...RedisConfig) (*RedisClient,
 	if cfg.Port != nil {
 		port = *cfg.Port
 	}
+	if cfg.RequestRateWindow != nil {
+		requestRateWindow = *cfg.RequestRateWindow
+	}
 
-	client := redis.NewClient(&redis.Options{
-		Addr: fmt.Sprintf("%s:%d", host, port),
-	})
+	opts := &redis.UniversalOptions{
+		Addrs:     []string{fmt.Sprintf("%s:%d", host, port)},
+		TLSConfig: cfg.TLS,
+	}
+	if cfg.Username != nil {
+		opts.Username = *cfg.Username
+	}
+	if cfg.Password != nil {
+		opts.Password = *cfg.Password
+	}
+	if cfg.DB != nil {
+		opts.DB = *cfg.DB
+	}
+	if cfg.SentinelPassword != nil {
+		opts.SentinelPassword = *cfg.SentinelPassword
+	}
+
+	var (
+		client redis.UniversalClient
+		target string
+	)
+	switch {
+	case cfg.SentinelMaster != nil && len(cfg.ClusterAddrs) > 0:
+		return nil, fmt.Errorf("redis sentinel and cluster can't be used together")
+	case cfg.SentinelMaster != nil:
+		opts.MasterName = *cfg.SentinelMaster
+		opts.Addrs = cfg.SentinelAddrs
+		client = redis.NewFailoverClient(opts.Failover())
+		target = fmt.Sprintf("sentinel master %s via %s", opts.MasterName, strings.Join(opts.Addrs, ","))
+	case len(cfg.ClusterAddrs) > 0:
+		if opts.DB != 0 {
+			return nil, fmt.Errorf("redis cluster only supports db 0, got %d", opts.DB)
+		}
+		opts.Addrs = cfg.ClusterAddrs
+		client = redis.NewClusterClient(opts.Cluster())
+		target = fmt.Sprintf("cluster %s", strings.Join(opts.Addrs, ","))
+	default:
+		client = redis.NewClient(opts.Simple())
+		target = opts.Addrs[0]
+	}
+
+	client.AddHook(metricsHook{})
 
-	return &RedisClient{Client: client, Ctx: ctx}, nil
+	pingCtx, cancel := context.WithTimeout(ctx, defaultConnectTimeout)
+	defer cancel()
+	if err := client.Ping(pingCtx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis %s: %w", target, err)
+	}
+	if err := checkRedisVersion(pingCtx, client); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("redis %s can't be used: %w", target, err)
+	}
+
+	return &RedisClient{Client: client, Ctx: ctx, RequestRateWindow: requestRateWindow}, nil
+}
+
+// checkRedisVersion fails for a Redis older than 7.0, whose EXPIRE doesn't know NX and GT.
+// A Redis which doesn't tell its version, e.g. with INFO disabled, is assumed to be recent enough.
+func checkRedisVersion(ctx context.Context, client redis.UniversalClient) error {
+	info, err := client.Info(ctx, "server").Result()
+	if err != nil {
+		config.Log.Warn("Failed to check the version of redis, it must be 7.0 or later", zap.Error(err))
+		return nil
+	}
+
+	version, major, ok := parseRedisVersion(info)
+	if !ok {
+		config.Log.Warn("Redis didn't tell its version, it must be 7.0 or later")
+		return nil
+	}
+	if major < minRedisMajorVersion {
+		return fmt.Errorf("redis %s is too old, GoZero needs redis %d.0 or later", version, minRedisMajorVersion)
+	}
+	return nil
+}
+
+// parseRedisVersion returns the version and its major version from the server section of INFO
+func parseRedisVersion(info string) (string, int, bool) {
+	for _, line := range strings.Split(info, "\n") {
+		version, ok := strings.CutPrefix(strings.TrimSpace(line), "redis_version:")
+		if !ok {
+			continue
+		}
+		major, _, _ := strings.Cut(version, ".")
+		n, err := strconv.Atoi(major)
+		if err != nil {
+			return version, 0, false
+		}
+		return version, n, true
+	}
+	return "", 0, false
 }
 
 func (r *RedisClient) Ping() (bool, error) {
@@ -82,63 +169,393 @@ func (r *RedisClient) Close() error {
 	return r.Client.Close()
 }
 
-func (r *RedisClient) ScaleUp(host string, scaleThreshold int, scaleDuration time.Duration) error {
-	setScaleUpKey := fmt.Sprintf("%s:%s", scaleUpKeyPrefix, host)
+// ScaleUp marks the host as active with the given value until it has been idle for scaleDuration.
+// A host which is already active is only ever extended, never shortened.
+func (r *RedisClient) ScaleUp(host string, scaleThreshold int, scaleDuration time.Duration, configs ...ScaleUpConfig) error {
+	cfg, err := newScaleUpConfig(configs...)
+	if err != nil {
+		return err
+	}
 
-	resultSet := r.Client.Set(r.Ctx, setScaleUpKey, scaleThreshold, scaleDuration)
-	if resultSet.Err() != nil {
-		return resultSet.Err()
+	pipe := r.Client.TxPipeline()
+	r.scaleUp(pipe, host, scaleThreshold, scaleDuration, cfg)
+	_, err = pipe.Exec(r.Ctx)
+	return err
+}
+
+// ScaleUpBatch scales up and records the requests of many hosts in a single round trip.
+// It returns the hosts which had no active key before.
+func (r *RedisClient) ScaleUpBatch(requests []ScaleUpRequest) ([]string, error) {
+	if len(requests) == 0 {
+		return nil, nil
 	}
 
-	return nil
+	pipe := r.Client.TxPipeline()
+	activatedCmds := make([]*redis.BoolCmd, 0, len(requests))
+	for _, req := range requests {
+		cfg, err := req.config()
+		if err != nil {
+			return nil, fmt.Errorf("invalid scale up of host %s: %w", req.Host, err)
+		}
+		activatedCmds = append(activatedCmds, r.scaleUp(pipe, req.Host, req.Value, req.Duration, cfg))
+		if req.Requests > 0 {
+			r.recordRequests(pipe, req.Host, req.Requests)
+		}
+	}
+
+	if _, err := pipe.Exec(r.Ctx); err != nil {
+		return nil, err
+	}
+
+	var activated []string
+	for i, cmd := range activatedCmds {
+		if cmd.Val() {
+			activated = append(activated, requests[i].Host)
+		}
+	}
+	return activated, nil
 }
 
+// scaleUp queues the scale up of a host, the returned command tells if the host had no active key
+func (r *RedisClient) scaleUp(pipe redis.Pipeliner, host string, scaleThreshold int, scaleDuration time.Duration, cfg *scaleUpConfig) *redis.BoolCmd {
+	setScaleUpKey := fmt.Sprintf("%s:%s", scaleUpKeyPrefix, host)
+	setScaleModeKey := fmt.Sprintf("%s:%s", scaleModeKeyPrefix, host)
+
+	// A newly activated host stays up for at least the min active window
+	activeDuration := max(scaleDuration, cfg.minActive)
+
+	pipe.SetArgs(r.Ctx, setScaleUpKey, scaleThreshold, redis.SetArgs{KeepTTL: true})
+	// Only a key which was just created has no TTL yet
+	activated := pipe.ExpireNX(r.Ctx, setScaleUpKey, activeDuration)
+	pipe.ExpireGT(r.Ctx, setScaleUpKey, scaleDuration)
+	// The index may outlive the key, the key itself tells whether the host is still active
+	pipe.ZAddGT(r.Ctx, scaleUpIndexKey, indexMember(host, activeDuration))
+	if cfg.metricMode == metricModeRate {
+		pipe.SetArgs(r.Ctx, setScaleModeKey, cfg.metricMode, redis.SetArgs{KeepTTL: true})
+		pipe.ExpireNX(r.Ctx, setScaleModeKey, activeDuration)
+		pipe.ExpireGT(r.Ctx, setScaleModeKey, scaleDuration)
+	} else {
+		pipe.Del(r.Ctx, setScaleModeKey)
+	}
+	return activated
+}
+
+// ResetTimer keeps an active host up for at least scaleDuration from now, it never shortens its scale up
 func (r *RedisClient) ResetTimer(host string, scaleDuration time.Duration) error {
 	setScaleUpKey := fmt.Sprintf("%s:%s", scaleUpKeyPrefix, host)
+	setScaleModeKey := fmt.Sprintf("%s:%s", scaleModeKeyPrefix, host)
 
-	return r.Client.Expire(r.Ctx, setScaleUpKey, scaleDuration).Err()
+	pipe := r.Client.Pipeline()
+	pipe.ExpireGT(r.Ctx, setScaleUpKey, scaleDuration)
+	pipe.ExpireGT(r.Ctx, setScaleModeKey, scaleDuration)
+	pipe.ZAddGT(r.Ctx, scaleUpIndexKey, indexMember(host, scaleDuration))
+	_, err := pipe.Exec(r.Ctx)
+	return err
 }
 
 func (r *RedisClient) ScaleDown(host string) error {
 	return nil
 }
 
+// GetAllScaleUpKeys returns the keys of the active hosts, e.g. gozero:scale_up:app.app-a.svc.cluster.local:3000
 func (r *RedisClient) GetAllScaleUpKeys() ([]string, error) {
-	return r.Client.Keys(r.Ctx, scaleUpKeyPrefix+":*").Result()
+	hosts, err := r.indexedHosts()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hosts) == 0 {
+		return []string{}, nil
+	}
+
+	pipe := r.Client.Pipeline()
+	existsCommands := make([]*redis.IntCmd, len(hosts))
+	for i, host := range hosts {
+		existsCommands[i] = pipe.Exists(r.Ctx, fmt.Sprintf("%s:%s", scaleUpKeyPrefix, host))
+	}
+
+	_, err = pipe.Exec(r.Ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(hosts))
+	for i, host := range hosts {
+		if existsCommands[i].Val() > 0 {
+			keys = append(keys, fmt.Sprintf("%s:%s", scaleUpKeyPrefix, host))
+		}
+	}
+
+	return keys, nil
 }
 
+// GetAllScaleUpKeysValues returns the value of every active host by its metric name.
+// Hosts in rate mode report their request rate, but at least 1 while they are active.
 func (r *RedisClient) GetAllScaleUpKeysValues() (map[string]string, error) {
-	keys, err := r.Client.Keys(r.Ctx, scaleUpKeyPrefix+":*").Result()
+	hosts, err := r.indexedHosts()
 	if err != nil {
 		return nil, err
 	}
 
-	if len(keys) == 0 {
+	return r.scaleUpValues(hosts)
+}
+
+// GetScaleUpValue returns the value of the active host with the given metric name, it only reads the keys of that host
+func (r *RedisClient) GetScaleUpValue(name string) (string, bool, error) {
+	hosts, err := r.indexedHosts()
+	if err != nil {
+		return "", false, err
+	}
+
+	var matching []string
+	for _, host := range hosts {
+		if metricName(host) == name {
+			matching = append(matching, host)
+		}
+	}
+
+	values, err := r.scaleUpValues(matching)
+	if err != nil {
+		return "", false, err
+	}
+	value, ok := values[name]
+	return value, ok, nil
+}
+
+// scaleUpValues returns the value of the hosts by their metric name
+func (r *RedisClient) scaleUpValues(hosts []string) (map[string]string, error) {
+	if len(hosts) == 0 {
 		return make(map[string]string), nil
 	}
 
 	pipe := r.Client.Pipeline()
-	getCommands := make([]*redis.StringCmd, len(keys))
-	for i, key := range keys {
-		getCommands[i] = pipe.Get(r.Ctx, key)
+	getCommands := make([]*redis.StringCmd, len(hosts))
+	modeCommands := make([]*redis.StringCmd, len(hosts))
+	for i, host := range hosts {
+		getCommands[i] = pipe.Get(r.Ctx, fmt.Sprintf("%s:%s", scaleUpKeyPrefix, host))
+		modeCommands[i] = pipe.Get(r.Ctx, fmt.Sprintf("%s:%s", scaleModeKeyPrefix, host))
 	}
 
-	_, err = pipe.Exec(r.Ctx)
+	_, err := pipe.Exec(r.Ctx)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, len(hosts))
+	var rateHosts []string
+	for i, host := range hosts {
+		val, err := getCommands[i].Result()
+		if err != nil {
+			continue
+		}
+		result[metricName(host)] = val
+		if mode, _ := modeCommands[i].Result(); mode == metricModeRate {
+			rateHosts = append(rateHosts, host)
+		}
+	}
+
+	if len(rateHosts) > 0 {
+		rates, err := r.requestRates(rateHosts)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range rateHosts {
+			name := metricName(host)
+			result[name] = rateValue(rates[name])
+		}
+	}
+
+	return result, nil
+}
+
+// RecordRequests counts requests for the host in the current one second bucket.
+// The buckets are shared by all GoZero replicas.
+func (r *RedisClient) RecordRequests(host string, count int) error {
+	pipe := r.Client.Pipeline()
+	r.recordRequests(pipe, host, count)
+	_, err := pipe.Exec(r.Ctx)
+	return err
+}
+
+func (r *RedisClient) recordRequests(pipe redis.Pipeliner, host string, count int) {
+	rateKey := fmt.Sprintf("%s:%s", requestRateKeyPrefix, host)
+	bucket := strconv.FormatInt(time.Now().Unix(), 10)
+
+	pipe.HIncrBy(r.Ctx, rateKey, bucket, int64(count))
+	pipe.Expire(r.Ctx, rateKey, r.RequestRateWindow+time.Second)
+}
+
+// GetRequestRates returns the requests per second of every active host over the sliding window
+func (r *RedisClient) GetRequestRates() (map[string]float64, error) {
+	keys, err := r.GetAllScaleUpKeys()
 	if err != nil {
 		return nil, err
 	}
 
-	result := make(map[string]string, len(keys))
+	hosts := make([]string, len(keys))
 	for i, key := range keys {
-		val, err := getCommands[i].Result()
+		hosts[i] = strings.TrimPrefix(key, scaleUpKeyPrefix+":")
+	}
+
+	return r.requestRates(hosts)
+}
+
+// requestRates returns the requests per second of the given hosts by their metric name
+func (r *RedisClient) requestRates(hosts []string) (map[string]float64, error) {
+	result := make(map[string]float64, len(hosts))
+	if len(hosts) == 0 {
+		return result, nil
+	}
+
+	pipe := r.Client.Pipeline()
+	getCommands := make([]*redis.MapStringStringCmd, len(hosts))
+	for i, host := range hosts {
+		getCommands[i] = pipe.HGetAll(r.Ctx, fmt.Sprintf("%s:%s", requestRateKeyPrefix, host))
+	}
+
+	_, err := pipe.Exec(r.Ctx)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	windowStart := time.Now().Add(-r.RequestRateWindow).Unix()
+	prune := r.Client.Pipeline()
+	for i, host := range hosts {
+		buckets, err := getCommands[i].Result()
 		if err != nil {
 			continue
 		}
-		// Key format: gozero:scale_up:app.app-a.svc.cluster.local:3000
-		parts := strings.Split(key, ":")
-		parts[2] = strings.ReplaceAll(parts[2], ".", "-")
-		result[parts[2]] = val
+
+		var total int64
+		var stale []string
+		for bucket, value := range buckets {
+			second, err := strconv.ParseInt(bucket, 10, 64)
+			if err != nil || second <= windowStart {
+				stale = append(stale, bucket)
+				continue
+			}
+			count, _ := strconv.ParseInt(value, 10, 64)
+			total += count
+		}
+		if len(stale) > 0 {
+			prune.HDel(r.Ctx, fmt.Sprintf("%s:%s", requestRateKeyPrefix, host), stale...)
+		}
+
+		result[metricName(host)] = float64(total) / r.RequestRateWindow.Seconds()
+	}
+
+	// Buckets which left the window are removed lazily
+	if prune.Len() > 0 {
+		if _, err := prune.Exec(r.Ctx); err != nil {
+			return nil, err
+		}
 	}
 
 	return result, nil
 }
+
+// RecordInFlight stores the requests in flight per host of a single GoZero replica until ttl passes.
+// A count of 0 removes the replica from the host.
+func (r *RedisClient) RecordInFlight(replica string, counts map[string]int, ttl time.Duration) error {
+	if len(counts) == 0 {
+		return nil
+	}
+
+	expires := time.Now().Add(ttl).UnixMilli()
+	pipe := r.Client.Pipeline()
+	for host, count := range counts {
+		inFlightKey := fmt.Sprintf("%s:%s", inFlightKeyPrefix, host)
+		if count <= 0 {
+			pipe.HDel(r.Ctx, inFlightKey, replica)
+			continue
+		}
+		pipe.HSet(r.Ctx, inFlightKey, replica, fmt.Sprintf("%d:%d", count, expires))
+		pipe.Expire(r.Ctx, inFlightKey, ttl)
+	}
+
+	_, err := pipe.Exec(r.Ctx)
+	return err
+}
+
+// GetInFlight returns the requests in flight of every active host by its metric name, summed over all replicas
+func (r *RedisClient) GetInFlight() (map[string]int, error) {
+	keys, err := r.GetAllScaleUpKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]int, len(keys))
+	if len(keys) == 0 {
+		return result, nil
+	}
+
+	hosts := make([]string, len(keys))
+	pipe := r.Client.Pipeline()
+	getCommands := make([]*redis.MapStringStringCmd, len(keys))
+	for i, key := range keys {
+		hosts[i] = strings.TrimPrefix(key, scaleUpKeyPrefix+":")
+		getCommands[i] = pipe.HGetAll(r.Ctx, fmt.Sprintf("%s:%s", inFlightKeyPrefix, hosts[i]))
+	}
+
+	if _, err := pipe.Exec(r.Ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	for i, host := range hosts {
+		var total int
+		for _, value := range getCommands[i].Val() {
+			// Replicas which stopped reporting are ignored
+			count, expires, ok := parseInFlight(value)
+			if ok && expires > now {
+				total += count
+			}
+		}
+		result[metricName(host)] = total
+	}
+
+	return result, nil
+}
+
+// parseInFlight parses the in flight count of a replica, stored as <count>:<expires unix ms>
+func parseInFlight(value string) (int, int64, bool) {
+	countValue, expiresValue, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, 0, false
+	}
+	count, err := strconv.Atoi(countValue)
+	if err != nil {
+		return 0, 0, false
+	}
+	expires, err := strconv.ParseInt(expiresValue, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return count, expires, true
+}
+
+// indexedHosts returns the hosts in the index which may still be active. Hosts which expired
+// are pruned from the index lazily, so the cost depends on the active hosts only.
+func (r *RedisClient) indexedHosts() ([]string, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	pipe := r.Client.Pipeline()
+	pipe.ZRemRangeByScore(r.Ctx, scaleUpIndexKey, "-inf", "("+now)
+	members := pipe.ZRangeByScore(r.Ctx, scaleUpIndexKey, &redis.ZRangeBy{Min: now, Max: "+inf"})
+	if _, err := pipe.Exec(r.Ctx); err != nil {
+		return nil, err
+	}
+
+	return members.Val(), nil
+}
+
+// indexMember is the index entry of a host which expires after the given duration
+func indexMember(host string, expiresIn time.Duration) redis.Z {
+	return redis.Z{Score: float64(time.Now().Add(expiresIn).UnixMilli()), Member: host}
+}
+
+// metricName converts a host into the name it is exposed as, e.g. app.app-a.svc.cluster.local:3000 -> app-app-a-svc-cluster-local
+func metricName(host string) string {
+	host = strings.Split(host, ":")[0]
+	return strings.ReplaceAll(host, ".", "-")
+}
@@ -0,0 +1,155 @@
+package store
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type RedisConfig func(*redisConfig) error
+
+type redisConfig struct {
+	Host              *string
+	Port              *int
+	RequestRateWindow *time.Duration
+	Username          *string
+	Password          *string
+	DB                *int
+	TLS               *tls.Config
+	SentinelMaster    *string
+	SentinelAddrs     []string
+	SentinelPassword  *string
+	ClusterAddrs      []string
+}
+
+func WithRedisHost(host string) RedisConfig {
+	return func(cfg *redisConfig) error {
+		cfg.Host = &host
+		return nil
+	}
+}
+
+func WithRedisPort(port int) RedisConfig {
+	return func(cfg *redisConfig) error {
+		cfg.Port = &port
+		return nil
+	}
+}
+
+// WithRequestRateWindow sets the sliding window the request rate of a host is calculated over
+func WithRequestRateWindow(window time.Duration) RedisConfig {
+	return func(cfg *redisConfig) error {
+		if window < time.Second {
+			return fmt.Errorf("request rate window must be at least 1s, got %s", window)
+		}
+		cfg.RequestRateWindow = &window
+		return nil
+	}
+}
+
+// WithRedisUsername sets the ACL username, empty means the default user
+func WithRedisUsername(username string) RedisConfig {
+	return func(cfg *redisConfig) error {
+		cfg.Username = &username
+		return nil
+	}
+}
+
+func WithRedisPassword(password string) RedisConfig {
+	return func(cfg *redisConfig) error {
+		cfg.Password = &password
+		return nil
+	}
+}
+
+// WithRedisPasswordFile reads the password from a file, e.g. a mounted Kubernetes secret
+func WithRedisPasswordFile(path string) RedisConfig {
+	return func(cfg *redisConfig) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read redis password file: %w", err)
+		}
+		password := strings.TrimSpace(string(data))
+		cfg.Password = &password
+		return nil
+	}
+}
+
+// WithRedisDB selects the database, it must be 0 for Redis Cluster
+func WithRedisDB(db int) RedisConfig {
+	return func(cfg *redisConfig) error {
+		if db < 0 {
+			return fmt.Errorf("redis db must not be negative, got %d", db)
+		}
+		cfg.DB = &db
+		return nil
+	}
+}
+
+// WithRedisTLS connects over TLS. The server is verified with the CA file, or the system
+// roots if it is empty. The client certificate and key are only sent if both are set.
+func WithRedisTLS(caFile, certFile, keyFile string) RedisConfig {
+	return func(cfg *redisConfig) error {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+		if caFile != "" {
+			ca, err := os.ReadFile(caFile)
+			if err != nil {
+				return fmt.Errorf("failed to read redis CA file: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return fmt.Errorf("no certificates found in redis CA file %s", caFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+
+		if (certFile == "") != (keyFile == "") {
+			return fmt.Errorf("redis client certificate and key must be set together")
+		}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return fmt.Errorf("failed to load redis client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		cfg.TLS = tlsConfig
+		return nil
+	}
+}
+
+// WithRedisSentinel connects to the master with the given name through the Sentinels
+func WithRedisSentinel(masterName string, addrs ...string) RedisConfig {
+	return func(cfg *redisConfig) error {
+		if masterName == "" || len(addrs) == 0 {
+			return fmt.Errorf("redis sentinel needs a master name and at least one address")
+		}
+		cfg.SentinelMaster = &masterName
+		cfg.SentinelAddrs = addrs
+		return nil
+	}
+}
+
+// WithRedisSentinelPassword sets the password of the Sentinels, if it differs from the one of Redis
+func WithRedisSentinelPassword(password string) RedisConfig {
+	return func(cfg *redisConfig) error {
+		cfg.SentinelPassword = &password
+		return nil
+	}
+}
+
+// WithRedisCluster connects to a Redis Cluster, the addresses are used to discover the nodes
+func WithRedisCluster(addrs ...string) RedisConfig {
+	return func(cfg *redisConfig) error {
+		if len(addrs) == 0 {
+			return fmt.Errorf("redis cluster needs at least one address")
+		}
+		cfg.ClusterAddrs = addrs
+		return nil
+	}
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisConfig(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	require.NoError(t, os.WriteFile(passwordFile, []byte("s3cret\n"), 0o600))
+	invalidCA := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(invalidCA, []byte("not a certificate"), 0o600))
+
+	cfg := &redisConfig{}
+	require.NoError(t, WithRedisPasswordFile(passwordFile)(cfg))
+	assert.Equal(t, "s3cret", *cfg.Password)
+
+	require.NoError(t, WithRedisTLS("", "", "")(cfg))
+	assert.NotNil(t, cfg.TLS)
+
+	assert.Error(t, WithRedisPasswordFile(filepath.Join(dir, "missing"))(cfg))
+	assert.Error(t, WithRedisTLS(invalidCA, "", "")(cfg))
+	assert.Error(t, WithRedisTLS("", "client.crt", "")(cfg))
+	assert.Error(t, WithRedisDB(-1)(cfg))
+	assert.Error(t, WithRedisSentinel("mymaster")(cfg))
+	assert.Error(t, WithRedisCluster()(cfg))
+}
+
+func TestNewRedisClientFailsFast(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := NewRedisClient(ctx, WithRedisHost("127.0.0.1"), WithRedisPort(1))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to connect to redis 127.0.0.1:1")
+
+	_, err = NewRedisClient(ctx,
+		WithRedisSentinel("mymaster", "127.0.0.1:26379"),
+		WithRedisCluster("127.0.0.1:7000"),
+	)
+	assert.Error(t, err)
+
+	_, err = NewRedisClient(ctx, WithRedisCluster("127.0.0.1:7000"), WithRedisDB(1))
+	assert.Error(t, err)
+}
+
+func TestParseRedisVersion(t *testing.T) {
+	version, major, ok := parseRedisVersion("# Server\r\nredis_version:7.2.4\r\nredis_mode:standalone\r\n")
+	require.True(t, ok)
+	assert.Equal(t, "7.2.4", version)
+	assert.Equal(t, 7, major)
+
+	_, major, ok = parseRedisVersion("# Server\r\nredis_version:6.2.14\r\n")
+	require.True(t, ok)
+	assert.Less(t, major, minRedisMajorVersion)
+
+	_, _, ok = parseRedisVersion("# Server\r\nredis_mode:standalone\r\n")
+	assert.False(t, ok)
+}
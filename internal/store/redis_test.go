@@ -120,3 +120,130 @@ func TestScaleUp(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestRequestRates(t *testing.T) {
+	ctx := context.Background()
+	redis := setupRedis(t)
+	defer redis.Cleanup(ctx)
+
+	redisClient, err := NewRedisClient(ctx,
+		WithRedisHost(redis.host),
+		WithRedisPort(redis.GetPort()),
+		WithRequestRateWindow(10*time.Second),
+	)
+	require.NoError(t, err)
+	defer redisClient.Close()
+
+	require.NoError(t, redisClient.ScaleUp("app.foo.svc.cluster.local:3000", 10, time.Second*300))
+	require.NoError(t, redisClient.ScaleUp("idle.foo.svc.cluster.local:3000", 10, time.Second*300))
+	require.NoError(t, redisClient.RecordRequests("app.foo.svc.cluster.local:3000", 20))
+	require.NoError(t, redisClient.RecordRequests("app.foo.svc.cluster.local:3000", 5))
+
+	// A bucket which already left the window doesn't count
+	staleBucket := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	require.NoError(t, redisClient.Client.HSet(ctx, requestRateKeyPrefix+":app.foo.svc.cluster.local:3000", staleBucket, 1000).Err())
+
+	rates, err := redisClient.GetRequestRates()
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]float64{
+		"app-foo-svc-cluster-local":  2.5,
+		"idle-foo-svc-cluster-local": 0,
+	}, rates)
+
+	// Stale buckets are pruned
+	exists, err := redisClient.Client.HExists(ctx, requestRateKeyPrefix+":app.foo.svc.cluster.local:3000", staleBucket).Result()
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestScaleUpPolicy(t *testing.T) {
+	ctx := context.Background()
+	redis := setupRedis(t)
+	defer redis.Cleanup(ctx)
+
+	redisClient, err := NewRedisClient(ctx,
+		WithRedisHost(redis.host),
+		WithRedisPort(redis.GetPort()),
+		WithRequestRateWindow(10*time.Second),
+	)
+	require.NoError(t, err)
+	defer redisClient.Close()
+
+	ttl := func(host string) time.Duration {
+		t.Helper()
+		d, err := redisClient.Client.TTL(ctx, scaleUpKeyPrefix+":"+host).Result()
+		require.NoError(t, err)
+		return d
+	}
+
+	// A newly activated host stays up for the min active window
+	require.NoError(t, redisClient.ScaleUp("preview.foo.svc.cluster.local:3000", 3, time.Minute, WithMinActive(15*time.Minute)))
+	assert.InDelta(t, (15 * time.Minute).Seconds(), ttl("preview.foo.svc.cluster.local:3000").Seconds(), 2)
+
+	// Later requests don't shorten it
+	require.NoError(t, redisClient.ScaleUp("preview.foo.svc.cluster.local:3000", 3, time.Minute, WithMinActive(15*time.Minute)))
+	assert.InDelta(t, (15 * time.Minute).Seconds(), ttl("preview.foo.svc.cluster.local:3000").Seconds(), 2)
+
+	// But they extend it
+	require.NoError(t, redisClient.ScaleUp("preview.foo.svc.cluster.local:3000", 3, time.Hour))
+	assert.InDelta(t, time.Hour.Seconds(), ttl("preview.foo.svc.cluster.local:3000").Seconds(), 2)
+
+	// Hosts in rate mode report their request rate, but at least 1
+	require.NoError(t, redisClient.ScaleUp("app.foo.svc.cluster.local:3000", 10, time.Minute, WithMetricMode("rate")))
+	require.NoError(t, redisClient.ScaleUp("idle.foo.svc.cluster.local:3000", 10, time.Minute, WithMetricMode("rate")))
+	require.NoError(t, redisClient.RecordRequests("app.foo.svc.cluster.local:3000", 25))
+
+	values, err := redisClient.GetAllScaleUpKeysValues()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"preview-foo-svc-cluster-local": "3",
+		"app-foo-svc-cluster-local":     "3",
+		"idle-foo-svc-cluster-local":    "1",
+	}, values)
+
+	// Switching back to the fixed value
+	require.NoError(t, redisClient.ScaleUp("app.foo.svc.cluster.local:3000", 10, time.Minute, WithMetricMode("value")))
+	values, err = redisClient.GetAllScaleUpKeysValues()
+	require.NoError(t, err)
+	assert.Equal(t, "10", values["app-foo-svc-cluster-local"])
+
+	assert.Error(t, redisClient.ScaleUp("app.foo.svc.cluster.local:3000", 10, time.Minute, WithMetricMode("cpu")))
+}
+
+func TestScaleUpIndex(t *testing.T) {
+	ctx := context.Background()
+	redis := setupRedis(t)
+	defer redis.Cleanup(ctx)
+
+	redisClient, err := NewRedisClient(ctx,
+		WithRedisHost(redis.host),
+		WithRedisPort(redis.GetPort()),
+	)
+	require.NoError(t, err)
+	defer redisClient.Close()
+
+	// Keys of other apps sharing the database, or stale keys outside the index, are never read
+	require.NoError(t, redisClient.Client.Set(ctx, scaleUpKeyPrefix+":unindexed", 10, time.Minute).Err())
+	require.NoError(t, redisClient.Client.Set(ctx, "other:app", 1, 0).Err())
+
+	require.NoError(t, redisClient.ScaleUp("app.foo.svc.cluster.local:3000", 10, time.Minute))
+	require.NoError(t, redisClient.ScaleUp("short.foo.svc.cluster.local:3000", 10, time.Second))
+
+	keys, err := redisClient.GetAllScaleUpKeys()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		scaleUpKeyPrefix + ":app.foo.svc.cluster.local:3000",
+		scaleUpKeyPrefix + ":short.foo.svc.cluster.local:3000",
+	}, keys)
+
+	// Expired hosts are pruned from the index when it is read
+	assert.Eventually(t, func() bool {
+		values, err := redisClient.GetAllScaleUpKeysValues()
+		if err != nil || len(values) != 1 {
+			return false
+		}
+		members, err := redisClient.Client.ZRange(ctx, scaleUpIndexKey, 0, -1).Result()
+		return err == nil && len(members) == 1 && members[0] == "app.foo.svc.cluster.local:3000"
+	}, 5*time.Second, 100*time.Millisecond)
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ScaleUpConfig tunes the policy of a single ScaleUp call
+type ScaleUpConfig func(*scaleUpConfig) error
+
+type scaleUpConfig struct {
+	minActive  time.Duration
+	metricMode string
+}
+
+// WithMinActive keeps a newly activated host up for at least the given duration,
+// even if it is idle for less than its scale duration.
+func WithMinActive(minActive time.Duration) ScaleUpConfig {
+	return func(cfg *scaleUpConfig) error {
+		if minActive < 0 {
+			return fmt.Errorf("min active must not be negative, got %s", minActive)
+		}
+		cfg.minActive = minActive
+		return nil
+	}
+}
+
+// WithMetricMode sets what the value of the host is based on, either "value" for the
+// fixed scale value or "rate" for its request rate. Empty means "value".
+func WithMetricMode(mode string) ScaleUpConfig {
+	return func(cfg *scaleUpConfig) error {
+		switch mode {
+		case "", metricModeValue, metricModeRate:
+			cfg.metricMode = mode
+			return nil
+		default:
+			return fmt.Errorf("unsupported metric mode %q", mode)
+		}
+	}
+}
+
+// ScaleUpRequest is a scale up of a host together with the number of requests seen for it,
+// it lets many hosts be written at once.
+type ScaleUpRequest struct {
+	Host       string
+	Value      int
+	Duration   time.Duration
+	MinActive  time.Duration
+	MetricMode string
+	// Requests is the number of proxied requests to count for the request rate
+	Requests int
+	// Received is when the first of the requests arrived
+	Received time.Time
+}
+
+func (r ScaleUpRequest) config() (*scaleUpConfig, error) {
+	return newScaleUpConfig(WithMinActive(r.MinActive), WithMetricMode(r.MetricMode))
+}
+
+// merge folds a later scale up of the same host into r, the later policy wins
+func (r *ScaleUpRequest) merge(later ScaleUpRequest) {
+	requests, received := r.Requests+later.Requests, r.Received
+	if received.IsZero() {
+		received = later.Received
+	}
+	*r = later
+	r.Requests = requests
+	r.Received = received
+}
+
+func newScaleUpConfig(configs ...ScaleUpConfig) (*scaleUpConfig, error) {
+	cfg := &scaleUpConfig{}
+	for _, config := range configs {
+		if err := config(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// rateValue is the value of a host in rate mode: its request rate rounded up, but at least 1
+// so the host stays active until it expires.
+func rateValue(rate float64) string {
+	return strconv.FormatInt(max(1, int64(math.Ceil(rate))), 10)
+}
@@ -0,0 +1,226 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// conformanceStore is the contract every store backend has to fulfil
+type conformanceStore interface {
+	Close() error
+	ScaleUp(host string, scaleThreshold int, scaleDuration time.Duration, configs ...ScaleUpConfig) error
+	ScaleUpBatch(requests []ScaleUpRequest) ([]string, error)
+	ResetTimer(host string, scaleDuration time.Duration) error
+	GetAllScaleUpKeys() ([]string, error)
+	GetAllScaleUpKeysValues() (map[string]string, error)
+	GetScaleUpValue(name string) (string, bool, error)
+	RecordRequests(host string, count int) error
+	GetRequestRates() (map[string]float64, error)
+	RecordInFlight(replica string, counts map[string]int, ttl time.Duration) error
+	GetInFlight() (map[string]int, error)
+}
+
+// testStoreConformance runs the same behaviour tests against a store backend.
+// newStore must return an empty store with a request rate window of 10 seconds.
+func testStoreConformance(t *testing.T, newStore func(t *testing.T) conformanceStore) {
+	t.Run("scale up", func(t *testing.T) {
+		s := newStore(t)
+
+		require.NoError(t, s.ScaleUp("app.foo.svc.cluster.local:3000", 10, time.Minute))
+		require.NoError(t, s.ScaleUp("api.foo.svc.cluster.local:8080", 5, time.Minute))
+
+		keys, err := s.GetAllScaleUpKeys()
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []string{
+			fmt.Sprintf("%s:app.foo.svc.cluster.local:3000", scaleUpKeyPrefix),
+			fmt.Sprintf("%s:api.foo.svc.cluster.local:8080", scaleUpKeyPrefix),
+		}, keys)
+
+		values, err := s.GetAllScaleUpKeysValues()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"app-foo-svc-cluster-local": "10",
+			"api-foo-svc-cluster-local": "5",
+		}, values)
+
+		value, ok, err := s.GetScaleUpValue("api-foo-svc-cluster-local")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "5", value)
+
+		_, ok, err = s.GetScaleUpValue("other-foo-svc-cluster-local")
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("expires after scale duration", func(t *testing.T) {
+		s := newStore(t)
+
+		require.NoError(t, s.ScaleUp("app.foo.svc.cluster.local:3000", 10, time.Second))
+		assert.Eventually(t, func() bool {
+			values, err := s.GetAllScaleUpKeysValues()
+			return err == nil && len(values) == 0
+		}, 5*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("reset timer", func(t *testing.T) {
+		s := newStore(t)
+
+		require.NoError(t, s.ScaleUp("app.foo.svc.cluster.local:3000", 10, time.Second))
+		require.NoError(t, s.ResetTimer("app.foo.svc.cluster.local:3000", time.Minute))
+		time.Sleep(1500 * time.Millisecond)
+
+		keys, err := s.GetAllScaleUpKeys()
+		require.NoError(t, err)
+		assert.Len(t, keys, 1)
+
+		// A reset never shortens the scale up
+		require.NoError(t, s.ResetTimer("app.foo.svc.cluster.local:3000", time.Second))
+		time.Sleep(1500 * time.Millisecond)
+		keys, err = s.GetAllScaleUpKeys()
+		require.NoError(t, err)
+		assert.Len(t, keys, 1)
+	})
+
+	t.Run("in flight", func(t *testing.T) {
+		s := newStore(t)
+
+		require.NoError(t, s.ScaleUp("app.foo.svc.cluster.local:3000", 10, time.Minute))
+		require.NoError(t, s.ScaleUp("idle.foo.svc.cluster.local:3000", 10, time.Minute))
+		require.NoError(t, s.RecordInFlight("replica-a", map[string]int{"app.foo.svc.cluster.local:3000": 2}, time.Minute))
+		require.NoError(t, s.RecordInFlight("replica-b", map[string]int{"app.foo.svc.cluster.local:3000": 3}, time.Second))
+		// Hosts which are not scaled up are not reported
+		require.NoError(t, s.RecordInFlight("replica-a", map[string]int{"other.foo.svc.cluster.local:3000": 1}, time.Minute))
+
+		inFlight, err := s.GetInFlight()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{
+			"app-foo-svc-cluster-local":  5,
+			"idle-foo-svc-cluster-local": 0,
+		}, inFlight)
+
+		// Replicas which stop reporting are dropped after the ttl, a count of 0 removes the replica
+		require.NoError(t, s.RecordInFlight("replica-a", map[string]int{"app.foo.svc.cluster.local:3000": 0}, time.Minute))
+		assert.Eventually(t, func() bool {
+			inFlight, err := s.GetInFlight()
+			return err == nil && inFlight["app-foo-svc-cluster-local"] == 0
+		}, 5*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("min active and extend only", func(t *testing.T) {
+		s := newStore(t)
+
+		require.NoError(t, s.ScaleUp("preview.foo.svc.cluster.local:3000", 10, time.Second, WithMinActive(time.Minute)))
+		require.NoError(t, s.ScaleUp("app.foo.svc.cluster.local:3000", 10, time.Minute))
+		require.NoError(t, s.ScaleUp("app.foo.svc.cluster.local:3000", 10, time.Second))
+		time.Sleep(1500 * time.Millisecond)
+
+		values, err := s.GetAllScaleUpKeysValues()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"preview-foo-svc-cluster-local": "10",
+			"app-foo-svc-cluster-local":     "10",
+		}, values)
+	})
+
+	t.Run("request rates", func(t *testing.T) {
+		s := newStore(t)
+
+		require.NoError(t, s.ScaleUp("app.foo.svc.cluster.local:3000", 10, time.Minute, WithMetricMode("rate")))
+		require.NoError(t, s.ScaleUp("idle.foo.svc.cluster.local:3000", 10, time.Minute, WithMetricMode("rate")))
+		require.NoError(t, s.RecordRequests("app.foo.svc.cluster.local:3000", 20))
+		require.NoError(t, s.RecordRequests("app.foo.svc.cluster.local:3000", 5))
+		// Requests for hosts which are not scaled up are not reported
+		require.NoError(t, s.RecordRequests("other.foo.svc.cluster.local:3000", 5))
+
+		rates, err := s.GetRequestRates()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]float64{
+			"app-foo-svc-cluster-local":  2.5,
+			"idle-foo-svc-cluster-local": 0,
+		}, rates)
+
+		values, err := s.GetAllScaleUpKeysValues()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"app-foo-svc-cluster-local":  "3",
+			"idle-foo-svc-cluster-local": "1",
+		}, values)
+
+		value, ok, err := s.GetScaleUpValue("app-foo-svc-cluster-local")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "3", value)
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		s := newStore(t)
+
+		require.NoError(t, s.ScaleUp("app.foo.svc.cluster.local:3000", 10, time.Minute))
+		activated, err := s.ScaleUpBatch([]ScaleUpRequest{
+			{Host: "app.foo.svc.cluster.local:3000", Value: 10, Duration: time.Minute, Requests: 25},
+			{Host: "rate.foo.svc.cluster.local:3000", Value: 10, Duration: time.Minute, MetricMode: "rate", Requests: 50},
+		})
+		require.NoError(t, err)
+		// Only hosts which had no active key are activated
+		assert.Equal(t, []string{"rate.foo.svc.cluster.local:3000"}, activated)
+
+		values, err := s.GetAllScaleUpKeysValues()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{
+			"app-foo-svc-cluster-local":  "10",
+			"rate-foo-svc-cluster-local": "5",
+		}, values)
+
+		rates, err := s.GetRequestRates()
+		require.NoError(t, err)
+		assert.Equal(t, 2.5, rates["app-foo-svc-cluster-local"])
+
+		// Nothing is written if one scale up is invalid
+		_, err = s.ScaleUpBatch([]ScaleUpRequest{
+			{Host: "other.foo.svc.cluster.local:3000", Value: 10, Duration: time.Minute},
+			{Host: "invalid.foo.svc.cluster.local:3000", Value: 10, Duration: time.Minute, MetricMode: "cpu"},
+		})
+		assert.Error(t, err)
+		keys, err := s.GetAllScaleUpKeys()
+		require.NoError(t, err)
+		assert.Len(t, keys, 2)
+	})
+
+	t.Run("invalid metric mode", func(t *testing.T) {
+		s := newStore(t)
+
+		assert.Error(t, s.ScaleUp("app.foo.svc.cluster.local:3000", 10, time.Minute, WithMetricMode("cpu")))
+	})
+}
+
+func TestMemoryStoreConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T) conformanceStore {
+		s, err := NewMemoryStore(context.Background(), WithMemoryRequestRateWindow(10*time.Second))
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestRedisStoreConformance(t *testing.T) {
+	testStoreConformance(t, func(t *testing.T) conformanceStore {
+		ctx := context.Background()
+		redis := setupRedis(t)
+		t.Cleanup(func() { redis.Cleanup(ctx) })
+
+		s, err := NewRedisClient(ctx,
+			WithRedisHost(redis.host),
+			WithRedisPort(redis.GetPort()),
+			WithRequestRateWindow(10*time.Second),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}